@@ -0,0 +1,89 @@
+package api
+
+import (
+	"sort"
+)
+
+// FieldDiff is a field which differs between the agent in AM and the agent named would configure
+type FieldDiff struct {
+	Field   string   `json:"field"`
+	Current []string `json:"current"`
+	Desired []string `json:"desired"`
+}
+
+// DiffAgent compares the live agent with the desired payload. The managed fields, like redirection uris, scopes,
+// signing algorithm and consent, must be equal regardless of order. Optional fields the request neither sets nor
+// clears are not compared, as they are left as they are.
+func DiffAgent(live Agent, desired agentPayload) []FieldDiff {
+	diff := []FieldDiff{}
+
+	fields := []struct {
+		attribute string
+		desired   []string
+		optional  bool
+	}{
+		{redirectionUrisAttribute, desired.RedirectionUris, false},
+		{scopesAttribute, desired.Scopes, false},
+		{algorithmAttribute, []string{desired.Algorithm}, false},
+		{consentImpliedAttribute, []string{desired.ConsentImplied}, false},
+		{clientTypeAttribute, []string{desired.ClientType}, false},
+		{postLogoutRedirectUrisAttribute, desired.PostLogoutRedirectUris, true},
+		{accessTokenLifetimeAttribute, optionalValue(desired.AccessTokenLifetime), true},
+		{refreshTokenLifetimeAttribute, optionalValue(desired.RefreshTokenLifetime), true},
+	}
+
+	for _, field := range fields {
+		if field.optional && len(field.desired) == 0 && !contains(desired.cleared, field.attribute) {
+			continue
+		}
+
+		if field.attribute == clientTypeAttribute && len(live.Values(clientTypeAttribute)) == 0 &&
+			desired.ClientType == DefaultClientType {
+			// agents created before the client type was managed use the AM default
+			continue
+		}
+
+		current := unindexedValues(live.Values(field.attribute))
+		wanted := unindexedValues(field.desired)
+		if !equalValues(current, wanted) {
+			diff = append(diff, FieldDiff{Field: field.attribute, Current: current, Desired: wanted})
+		}
+	}
+
+	return diff
+}
+
+// optionalValue returns the value as a list, or an empty list when the value is not set
+func optionalValue(value string) []string {
+	if len(value) == 0 {
+		return []string{}
+	}
+	return []string{value}
+}
+
+func unindexedValues(values []string) []string {
+	unindexed := []string{}
+	for _, value := range values {
+		unindexed = append(unindexed, stripIndex(value))
+	}
+	return unindexed
+}
+
+// equalValues compares the values regardless of order
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+
+	for i := range sortedA {
+		if sortedA[i] != sortedB[i] {
+			return false
+		}
+	}
+	return true
+}
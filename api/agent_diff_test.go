@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffAgent(t *testing.T) {
+	desired := buildAgentPayload("testAgent", "secret", []string{"[0]=https://testapp.domain/a"}, nil)
+
+	t.Run("Equal agent gives no diff", func(t *testing.T) {
+		live := Agent{
+			redirectionUrisAttribute: []interface{}{"[0]=https://testapp.domain/a"},
+			scopesAttribute:          []interface{}{"[0]=openid"},
+			algorithmAttribute:       []interface{}{"RS256"},
+			consentImpliedAttribute:  []interface{}{"true"},
+		}
+
+		assert.Empty(t, DiffAgent(live, desired))
+	})
+
+	t.Run("Changed fields are reported", func(t *testing.T) {
+		live := Agent{
+			redirectionUrisAttribute: []interface{}{"[0]=https://manual.domain/a"},
+			scopesAttribute:          []interface{}{"[0]=openid", "[1]=profile"},
+			algorithmAttribute:       "HS256",
+			consentImpliedAttribute:  []interface{}{"true"},
+		}
+
+		diff := DiffAgent(live, desired)
+		assert.Equal(t, []FieldDiff{
+			{redirectionUrisAttribute, []string{"https://manual.domain/a"}, []string{"https://testapp.domain/a"}},
+			{scopesAttribute, []string{"openid", "profile"}, []string{"openid"}},
+			{algorithmAttribute, []string{"HS256"}, []string{"RS256"}},
+		}, diff)
+	})
+}
+
+func TestUpdateUnchangedAgentSkipsWrite(t *testing.T) {
+
+	defer gock.Off()
+
+	gock.New(baseURL).
+		Get("/json/agents/testAgent").
+		Reply(200).
+		BodyString(`{"com.forgerock.openam.oauth2provider.redirectionURIs": ["[0]=https://testapp.domain/a"], "com.forgerock.openam.oauth2provider.scopes": ["[0]=openid"], "com.forgerock.openam.oauth2provider.idTokenSignedResponseAlg": ["RS256"], "isConsentImplied": ["true"]}`)
+
+	diff, err := amc.UpdateAgent("testAgent", []string{"[0]=https://testapp.domain/a"}, &IssoResource{}, &NamedConfigurationRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, diff)
+	assert.True(t, gock.IsDone())
+}
+
+func TestRerunOAuth2AgentIsNoOp(t *testing.T) {
+
+	defer gock.Off()
+
+	// as AM returns an agent created with the settings below, with its own lifetimes and post logout uris
+	gock.New(baseURL).
+		Get("/json/agents/testAgent").
+		Reply(200).
+		BodyString(`{"com.forgerock.openam.oauth2provider.redirectionURIs": ["[0]=https://testapp.domain/a"], "com.forgerock.openam.oauth2provider.scopes": ["[0]=openid", "[1]=profile"], "com.forgerock.openam.oauth2provider.idTokenSignedResponseAlg": ["ES256"], "isConsentImplied": ["true"], "com.forgerock.openam.oauth2provider.clientType": ["Confidential"], "com.forgerock.openam.oauth2provider.postLogoutRedirectURI": ["[0]=https://testapp.domain/loggedout"], "com.forgerock.openam.oauth2provider.accessTokenLifeTime": ["3600"], "com.forgerock.openam.oauth2provider.refreshTokenLifeTime": ["604800"]}`)
+
+	request := &NamedConfigurationRequest{OAuth2: &OAuth2Settings{
+		Scopes:                   []string{"openid", "profile"},
+		IDTokenSignedResponseAlg: "ES256",
+	}}
+	diff, err := amc.UpdateAgent("testAgent", []string{"[0]=https://testapp.domain/a"}, &IssoResource{}, request)
+	assert.NoError(t, err)
+	assert.Empty(t, diff)
+	assert.True(t, gock.IsDone())
+}
+
+func TestClearedOAuth2SettingsAreRemoved(t *testing.T) {
+
+	defer gock.Off()
+
+	gock.New(baseURL).
+		Get("/json/agents/testAgent").
+		Reply(200).
+		BodyString(`{"com.forgerock.openam.oauth2provider.redirectionURIs": ["[0]=https://testapp.domain/a"], "com.forgerock.openam.oauth2provider.scopes": ["[0]=openid"], "com.forgerock.openam.oauth2provider.idTokenSignedResponseAlg": ["RS256"], "isConsentImplied": ["true"], "com.forgerock.openam.oauth2provider.postLogoutRedirectURI": ["[0]=https://testapp.domain/loggedout"], "com.forgerock.openam.oauth2provider.accessTokenLifeTime": ["3600"]}`)
+
+	var updated map[string]interface{}
+	gock.New(baseURL).
+		Put("/json/agents/testAgent").
+		AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+			return true, json.NewDecoder(req.Body).Decode(&updated)
+		}).
+		Reply(200)
+
+	request := &NamedConfigurationRequest{OAuth2: &OAuth2Settings{PostLogoutRedirectUris: []string{}}}
+	diff, err := amc.UpdateAgent("testAgent", []string{"[0]=https://testapp.domain/a"}, &IssoResource{}, request)
+	assert.NoError(t, err)
+	assert.Equal(t, []FieldDiff{
+		{postLogoutRedirectUrisAttribute, []string{"https://testapp.domain/loggedout"}, []string{}},
+	}, diff)
+	assert.True(t, gock.IsDone())
+
+	assert.Equal(t, []interface{}{}, updated[postLogoutRedirectUrisAttribute])
+	assert.Equal(t, []interface{}{"3600"}, updated[accessTokenLifetimeAttribute])
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// RotateImmediate replaces the secret in AM and Fasit, the previous secret stops working at once
+	RotateImmediate = "immediate"
+	// RotateOverlap rotates in two steps, as AM keeps a single secret per agent. The first stores the new secret as
+	// nextPassword next to the current password in Fasit, so redeployed applications know both. The second sets it on
+	// the agent and makes it the password.
+	RotateOverlap = "overlap"
+)
+
+const (
+	// RotationStaged means the new secret is stored in Fasit, but not yet set on the agent
+	RotationStaged = "staged"
+	// RotationCompleted means the agent uses the new secret
+	RotationCompleted = "completed"
+)
+
+const (
+	agentSecretBytes   = 32
+	passwordSecret     = "password"
+	nextPasswordSecret = "nextPassword"
+)
+
+// RotationResult describes a rotated agent secret
+type RotationResult struct {
+	Application string `json:"application"`
+	Environment string `json:"environment"`
+	Agent       string `json:"agent"`
+	Strategy    string `json:"strategy"`
+	Stage       string `json:"stage"`
+}
+
+// GenerateAgentSecret returns a random secret for a single agent
+func GenerateAgentSecret() (string, error) {
+	b := make([]byte, agentSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// agentSecrets returns the Fasit secrets of an agent, with the staged secret of an overlap rotation if there is one
+func agentSecrets(secret, nextSecret string) map[string]map[string]string {
+	secrets := map[string]map[string]string{passwordSecret: {"value": secret}}
+	if len(nextSecret) > 0 {
+		secrets[nextPasswordSecret] = map[string]string{"value": nextSecret}
+	}
+	return secrets
+}
+
+// resolveAgentSecret sets the secret of the application's agent, reusing the one stored in the OpenIdConnect
+// resource of the application. A new secret is generated if there is none, or if the stored one is the shared
+// OpenIdConnectAgent password. The staged secret of an unfinished overlap rotation is kept.
+func (fasit FasitClient) resolveAgentSecret(issoResource *IssoResource, request *NamedConfigurationRequest,
+	zone string) *AppError {
+	alias := fmt.Sprintf("%s-oidc", request.Application)
+	resource, fasitErr := getFasitResource(fasit, ResourceRequest{alias, ResourceTypeOIDC}, request.Environment,
+		request.Application, zone)
+	if fasitErr != nil && fasitErr.StatusCode != http.StatusNotFound {
+		return fasitErr
+	}
+
+	if fasitErr == nil {
+		if _, ok := resource.Secrets[nextPasswordSecret]; ok {
+			next, appErr := resolveNamedSecret(resource.Secrets, nextPasswordSecret, fasit.Username, fasit.Password)
+			if appErr != nil {
+				errorCounter.WithLabelValues("resolve_secret").Inc()
+				return appErr
+			}
+			issoResource.nextAgentSecret = next["password"]
+		}
+
+		if _, ok := resource.Secrets[passwordSecret]; ok {
+			secret, appErr := resolveNamedSecret(resource.Secrets, passwordSecret, fasit.Username, fasit.Password)
+			if appErr != nil {
+				errorCounter.WithLabelValues("resolve_secret").Inc()
+				return appErr
+			}
+
+			if len(secret["password"]) > 0 && secret["password"] != issoResource.oidcAgentPassword {
+				issoResource.agentSecret = secret["password"]
+				return nil
+			}
+		}
+	}
+
+	secret, err := GenerateAgentSecret()
+	if err != nil {
+		return &AppError{err, "Could not generate agent secret", http.StatusInternalServerError}
+	}
+
+	glog.Infof("Generated new secret for agent %s-%s", request.Application, request.Environment)
+	issoResource.agentSecret = secret
+	issoResource.agentSecretChanged = true
+	return nil
+}
+
+// rotationStrategy reads the strategy query parameter of a rotation request
+func rotationStrategy(r *http.Request) (string, *AppError) {
+	strategy := r.URL.Query().Get("strategy")
+	if len(strategy) == 0 {
+		strategy = RotateImmediate
+	}
+	if strategy != RotateImmediate && strategy != RotateOverlap {
+		return "", &AppError{nil, fmt.Sprintf("Strategy has to be %s or %s, not %s", RotateImmediate, RotateOverlap,
+			strategy), http.StatusBadRequest}
+	}
+
+	return strategy, nil
+}
+
+// nextAgentSecret returns the secret the agent is rotated to, and whether it has to be set on the agent now. An
+// overlap rotation stages a new secret first, and sets the staged secret when it is run again.
+func (fasit FasitClient) nextAgentSecret(stored FasitResource, strategy string) (secret string, set bool,
+	appErr *AppError) {
+	if strategy == RotateOverlap {
+		if _, ok := stored.Secrets[nextPasswordSecret]; ok {
+			next, appErr := resolveNamedSecret(stored.Secrets, nextPasswordSecret, fasit.Username, fasit.Password)
+			if appErr != nil {
+				return "", false, appErr
+			}
+			return next["password"], true, nil
+		}
+	}
+
+	secret, err := GenerateAgentSecret()
+	if err != nil {
+		return "", false, &AppError{err, "Could not generate agent secret", http.StatusInternalServerError}
+	}
+	return secret, strategy == RotateImmediate, nil
+}
+
+func (api *API) rotate(w http.ResponseWriter, r *http.Request) *AppError {
+	requests.With(prometheus.Labels{"path": "rotate"}).Inc()
+
+	request, appErr := requestFromPath(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	strategy, appErr := rotationStrategy(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	fasit := FasitClient{api.FasitURL, request.Username, request.Password}
+	if fasitErr := validateFasitRequirements(&fasit, &request); fasitErr != nil {
+		return fasitErr
+	}
+
+	zone := GetZone(api.ClusterName)
+	if zone != ZoneFss {
+		return &AppError{nil, "Agent secrets are only managed in fss, not " + zone, http.StatusBadRequest}
+	}
+
+	holder, lock, appErr := lockRequest(r.Context(), "rotate", request.Application, request.Environment)
+	if appErr != nil {
+		lockHolderLocation(w, holder)
+		return appErr
+	}
+	defer lock.unlock()
+
+	adminResource, appErr := fasit.GetAmAdminResource(&request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	agentName := fmt.Sprintf("%s-%s", request.Application, request.Environment)
+	if !am.AgentExists(agentName) {
+		return &AppError{nil, "Agent " + agentName + " does not exist, configure the application first",
+			http.StatusNotFound}
+	}
+
+	alias := fmt.Sprintf("%s-oidc", request.Application)
+	stored, fasitErr := getFasitResource(fasit, ResourceRequest{alias, ResourceTypeOIDC}, request.Environment,
+		request.Application, zone)
+	if fasitErr != nil {
+		glog.Errorf("Could not get OpenIDConnect resource %s: %s", alias, fasitErr)
+		return fasitErr
+	}
+
+	resource := stored
+	result := RotationResult{
+		Application: request.Application,
+		Environment: request.Environment,
+		Agent:       agentName,
+		Strategy:    strategy,
+	}
+
+	secret, set, appErr := fasit.nextAgentSecret(stored, strategy)
+	if appErr != nil {
+		return appErr
+	}
+
+	// a secret set on the agent is always stored in Fasit, so the lock is only checked before changing anything
+	if appErr := lock.check(); appErr != nil {
+		return appErr
+	}
+
+	if set {
+		resource.Secrets = agentSecrets(secret, "")
+		result.Stage = RotationCompleted
+
+		if err := am.SetAgentSecret(agentName, secret); err != nil {
+			glog.Errorf("Failed to change secret of AM agent %s: %s", agentName, err)
+			return &AppError{err, "AM agent secret could not be changed", http.StatusBadGateway}
+		}
+	} else {
+		if _, ok := stored.Secrets[passwordSecret]; !ok {
+			return &AppError{nil, "Agent " + agentName + " has no secret in Fasit to overlap with, configure the " +
+				"application or rotate immediately", http.StatusConflict}
+		}
+		current, appErr := resolveNamedSecret(stored.Secrets, passwordSecret, fasit.Username, fasit.Password)
+		if appErr != nil {
+			return appErr
+		}
+		resource.Secrets = agentSecrets(current["password"], secret)
+		result.Stage = RotationStaged
+	}
+
+	if appErr := fasit.UpdateFasitResource(resource, &request); appErr != nil {
+		if !set {
+			return appErr
+		}
+		glog.Errorf("Agent %s has a new secret, but it could not be stored in Fasit: %s", agentName, appErr)
+		return &AppError{appErr, "Agent secret was changed in AM but not stored in Fasit, rotate again",
+			http.StatusBadGateway}
+	}
+
+	glog.Infof("Rotated secret of agent %s with strategy %s, %s", agentName, strategy, result.Stage)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		return &AppError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
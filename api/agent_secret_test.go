@@ -0,0 +1,300 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateAgentSecret(t *testing.T) {
+	first, err := GenerateAgentSecret()
+	assert.NoError(t, err)
+	second, err := GenerateAgentSecret()
+	assert.NoError(t, err)
+
+	assert.Len(t, first, 43)
+	assert.NotEqual(t, first, second)
+}
+
+func TestResolveAgentSecret(t *testing.T) {
+	fasit := FasitClient{"https://fasit.local", "user", "pass"}
+	request := &NamedConfigurationRequest{Application: "testapp", Environment: "t0"}
+
+	defer gock.Off()
+
+	t.Run("Stored secret is reused", func(t *testing.T) {
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", "testapp-oidc").
+			Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+		gock.New("https://fasit.local").
+			Get("/api/v2/secrets/123456").
+			Reply(200).BodyString("stored")
+
+		issoResource := IssoResource{oidcAgentPassword: "shared"}
+		assert.Nil(t, fasit.resolveAgentSecret(&issoResource, request, "fss"))
+		assert.Equal(t, "stored", issoResource.agentSecret)
+		assert.False(t, issoResource.agentSecretChanged)
+	})
+
+	t.Run("Shared secret is replaced", func(t *testing.T) {
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", "testapp-oidc").
+			Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+		gock.New("https://fasit.local").
+			Get("/api/v2/secrets/123456").
+			Reply(200).BodyString("shared")
+
+		issoResource := IssoResource{oidcAgentPassword: "shared"}
+		assert.Nil(t, fasit.resolveAgentSecret(&issoResource, request, "fss"))
+		assert.NotEqual(t, "shared", issoResource.agentSecret)
+		assert.True(t, issoResource.agentSecretChanged)
+	})
+
+	t.Run("Staged secret is kept", func(t *testing.T) {
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", "testapp-oidc").
+			Reply(200).BodyString(`{"id": 256, "secrets": {"password": {"ref": "https://fasit.local/api/v2/secrets/1"},
+				"nextPassword": {"ref": "https://fasit.local/api/v2/secrets/2"}}}`)
+		gock.New("https://fasit.local").
+			Get("/api/v2/secrets/2").
+			Reply(200).BodyString("staged")
+		gock.New("https://fasit.local").
+			Get("/api/v2/secrets/1").
+			Reply(200).BodyString("stored")
+
+		issoResource := IssoResource{oidcAgentPassword: "shared"}
+		assert.Nil(t, fasit.resolveAgentSecret(&issoResource, request, "fss"))
+		assert.Equal(t, "stored", issoResource.agentSecret)
+		assert.Equal(t, "staged", issoResource.nextAgentSecret)
+		assert.Equal(t, "staged", agentSecrets(issoResource.agentSecret,
+			issoResource.nextAgentSecret)[nextPasswordSecret]["value"])
+	})
+
+	t.Run("Secret is generated for new applications", func(t *testing.T) {
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", "testapp-oidc").
+			Reply(404)
+
+		issoResource := IssoResource{oidcAgentPassword: "shared"}
+		assert.Nil(t, fasit.resolveAgentSecret(&issoResource, request, "fss"))
+		assert.NotEmpty(t, issoResource.agentSecret)
+		assert.True(t, issoResource.agentSecretChanged)
+	})
+}
+
+func TestRotate(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"admin\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/agents/testapp-t0").
+		Times(2).
+		Reply(200).JSON(map[string]interface{}{"_rev": "1", "userpassword": nil})
+
+	gock.New(baseURL).
+		Put("/json/agents/testapp-t0").
+		AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+			var agent Agent
+			err := json.NewDecoder(req.Body).Decode(&agent)
+			_, hasRevision := agent["_rev"]
+			return err == nil && !hasRevision && len(agent.Values(passwordAttribute)[0]) == 43, err
+		}).
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", "testapp-oidc").
+		MatchParam("type", ResourceTypeOIDC).
+		Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+
+	gock.New("https://fasit.local").
+		Put("/api/v2/resources/256").
+		AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+			var resource FasitResource
+			err := json.NewDecoder(req.Body).Decode(&resource)
+			return err == nil && len(resource.Secrets) == 1 && len(resource.Secrets[passwordSecret]["value"]) == 43, err
+		}).
+		Reply(200)
+
+	req, _ := http.NewRequest("POST", "/rotate/testapp/t0", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+	var result RotationResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Equal(t, "testapp-t0", result.Agent)
+	assert.Equal(t, RotateImmediate, result.Strategy)
+	assert.Equal(t, RotationCompleted, result.Stage)
+	assert.True(t, gock.IsDone())
+}
+
+func TestRotateOverlap(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Times(2).
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Times(2).
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Times(2).
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Times(2).
+		Reply(200).BodyString("{\"properties\": {\"username\": \"rotator\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	rotate := func() RotationResult {
+		req, _ := http.NewRequest("POST", "/rotate/testapp/t0?strategy="+RotateOverlap, nil)
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		api.MakeHandler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+
+		var result RotationResult
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		return result
+	}
+
+	t.Run("First rotation stages the new secret", func(t *testing.T) {
+		gock.New(baseURL).
+			Get("/json/agents/testapp-t0").
+			Reply(200).JSON(map[string]interface{}{"_rev": "1"})
+
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", "testapp-oidc").
+			MatchParam("type", ResourceTypeOIDC).
+			Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+
+		gock.New("https://fasit.local").
+			Get("/api/v2/secrets/123456").
+			Reply(200).BodyString("current")
+
+		gock.New("https://fasit.local").
+			Put("/api/v2/resources/256").
+			AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+				var resource FasitResource
+				err := json.NewDecoder(req.Body).Decode(&resource)
+				return err == nil && len(resource.Secrets) == 2 &&
+					resource.Secrets[passwordSecret]["value"] == "current" &&
+					len(resource.Secrets[nextPasswordSecret]["value"]) == 43, err
+			}).
+			Reply(200)
+
+		result := rotate()
+		assert.Equal(t, RotateOverlap, result.Strategy)
+		assert.Equal(t, RotationStaged, result.Stage)
+	})
+
+	t.Run("Second rotation sets the staged secret", func(t *testing.T) {
+		gock.New(baseURL).
+			Post("/json/sessions").
+			MatchParam("_action", "validate").
+			Reply(200).BodyString("{\"valid\": true}")
+
+		gock.New(baseURL).
+			Get("/json/agents/testapp-t0").
+			Times(2).
+			Reply(200).JSON(map[string]interface{}{"_rev": "1", "userpassword": nil})
+
+		gock.New(baseURL).
+			Put("/json/agents/testapp-t0").
+			AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+				var agent Agent
+				err := json.NewDecoder(req.Body).Decode(&agent)
+				return err == nil && agent.Values(passwordAttribute)[0] == "staged", err
+			}).
+			Reply(200)
+
+		gock.New("https://fasit.local").
+			Get("/api/v2/scopedresource").
+			MatchParam("alias", "testapp-oidc").
+			MatchParam("type", ResourceTypeOIDC).
+			Reply(200).BodyString(`{"id": 256, "secrets": {"password": {"ref": "https://fasit.local/api/v2/secrets/1"},
+				"nextPassword": {"ref": "https://fasit.local/api/v2/secrets/2"}}}`)
+
+		gock.New("https://fasit.local").
+			Get("/api/v2/secrets/2").
+			Reply(200).BodyString("staged")
+
+		gock.New("https://fasit.local").
+			Put("/api/v2/resources/256").
+			AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+				var resource FasitResource
+				err := json.NewDecoder(req.Body).Decode(&resource)
+				return err == nil && len(resource.Secrets) == 1 &&
+					resource.Secrets[passwordSecret]["value"] == "staged", err
+			}).
+			Reply(200)
+
+		result := rotate()
+		assert.Equal(t, RotationCompleted, result.Stage)
+		assert.True(t, gock.IsDone())
+	})
+}
+
+func TestRotateWithUnknownStrategy(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	req, _ := http.NewRequest("POST", "/rotate/testapp/t0?strategy=sometime", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
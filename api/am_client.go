@@ -8,7 +8,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 )
@@ -20,6 +22,11 @@ type AMConnection struct {
 	Password string
 	tokenID  string
 	Realm    string
+
+	// session is set for connections from the session cache, which are shared by jobs
+	session    *amSession
+	tokenMutex sync.RWMutex
+	loginMutex sync.Mutex
 }
 
 // AuthNResponse contains values for further AM processes
@@ -28,30 +35,51 @@ type AuthNResponse struct {
 	SuccessURL string `json:"successUrl"`
 }
 
+const (
+	redirectionUrisAttribute        = "com.forgerock.openam.oauth2provider.redirectionURIs"
+	scopesAttribute                 = "com.forgerock.openam.oauth2provider.scopes"
+	algorithmAttribute              = "com.forgerock.openam.oauth2provider.idTokenSignedResponseAlg"
+	consentImpliedAttribute         = "isConsentImplied"
+	clientTypeAttribute             = "com.forgerock.openam.oauth2provider.clientType"
+	postLogoutRedirectUrisAttribute = "com.forgerock.openam.oauth2provider.postLogoutRedirectURI"
+	accessTokenLifetimeAttribute    = "com.forgerock.openam.oauth2provider.accessTokenLifeTime"
+	refreshTokenLifetimeAttribute   = "com.forgerock.openam.oauth2provider.refreshTokenLifeTime"
+	passwordAttribute               = "userpassword"
+)
+
 type agentPayload struct {
-	Username        string   `json:"username"`
-	Password        string   `json:"userpassword"`
-	AgentType       string   `json:"agenttype"`
-	Algorithm       string   `json:"com.forgerock.openam.oauth2provider.idTokenSignedResponseAlg"`
-	RedirectionUris []string `json:"com.forgerock.openam.oauth2provider.redirectionURIs"`
-	Scope           string   `json:"com.forgerock.openam.oauth2provider.scopes"`
-	ConsentImplied  string   `json:"isConsentImplied"`
+	Username               string   `json:"username"`
+	Password               string   `json:"userpassword"`
+	AgentType              string   `json:"agenttype"`
+	Algorithm              string   `json:"com.forgerock.openam.oauth2provider.idTokenSignedResponseAlg"`
+	RedirectionUris        []string `json:"com.forgerock.openam.oauth2provider.redirectionURIs"`
+	Scopes                 []string `json:"com.forgerock.openam.oauth2provider.scopes"`
+	ConsentImplied         string   `json:"isConsentImplied"`
+	ClientType             string   `json:"com.forgerock.openam.oauth2provider.clientType"`
+	PostLogoutRedirectUris []string `json:"com.forgerock.openam.oauth2provider.postLogoutRedirectURI,omitempty"`
+	AccessTokenLifetime    string   `json:"com.forgerock.openam.oauth2provider.accessTokenLifeTime,omitempty"`
+	RefreshTokenLifetime   string   `json:"com.forgerock.openam.oauth2provider.refreshTokenLifeTime,omitempty"`
+
+	// cleared lists the optional attributes the request clears. Optional attributes neither set nor cleared are
+	// left as they are on an existing agent.
+	cleared []string
 }
 
-// GetAmConnection returns connection to AM server
+// GetAmConnection returns connection to AM server, reusing the cached admin session when it is still valid
 func GetAmConnection(issoResource *IssoResource) (am *AMConnection, err error) {
-	return openAdminConnection(issoResource.oidcURL, issoResource.oidcUsername, issoResource.oidcPassword)
+	return amSessions.Get(issoResource.oidcURL, issoResource.realm, issoResource.oidcUsername,
+		issoResource.oidcPassword)
 }
 
-func openAdminConnection(url, username, password string) (am *AMConnection, err error) {
-	am = &AMConnection{BaseURL: url, User: username, Password: password}
+func openAdminConnection(url, realm, username, password string) (am *AMConnection, err error) {
+	am = &AMConnection{BaseURL: url, User: username, Password: password, Realm: normalizeRealm(realm)}
 	err = am.Authenticate()
 	return am, err
 }
 
 // Authenticate connects to AM server and sets tokenID in AMConnection struct
 func (am *AMConnection) Authenticate() error {
-	url := am.getRequestURL("/json/authenticate?authIndexType=service&authIndexValue=adminconsoleservice")
+	url := am.getRequestURL(am.jsonPath("/authenticate?authIndexType=service&authIndexValue=adminconsoleservice"))
 
 	headers := map[string]string{
 		"X-OpenAM-Username": FormatAmHeaderString(am.User),
@@ -59,12 +87,12 @@ func (am *AMConnection) Authenticate() error {
 		"Cache-Control":     "no-cache",
 		"Content-Type":      "application/json"}
 
-	request, client, err := executeRequest(url, http.MethodPost, headers, nil)
+	request, err := executeRequest(url, http.MethodPost, headers, nil)
 	if err != nil {
 		return err
 	}
 
-	response, err := client.Do(request)
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
 		return fmt.Errorf("could not execute request: %s", err)
 	}
@@ -79,16 +107,107 @@ func (am *AMConnection) Authenticate() error {
 		return fmt.Errorf("failed to authenticate %v: %s", response.Status, err)
 	}
 
+	am.tokenMutex.Lock()
 	am.tokenID = a.TokenID
+	am.tokenMutex.Unlock()
 
 	return nil
 }
 
+// token returns the token of the session, which may be replaced by another job logging in again
+func (am *AMConnection) token() string {
+	am.tokenMutex.RLock()
+	defer am.tokenMutex.RUnlock()
+
+	return am.tokenID
+}
+
+// do sends the request, and logs in again and retries once if AM answers 401 Unauthorized, as the session may have
+// expired or been logged out in AM since it was validated
+func (am *AMConnection) do(request *http.Request) (*http.Response, error) {
+	token := am.token()
+	response, err := http.DefaultClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusUnauthorized || (request.Body != nil && request.GetBody == nil) {
+		return response, err
+	}
+	response.Body.Close()
+
+	if err := am.reauthenticate(token); err != nil {
+		return nil, fmt.Errorf("could not log in to AM again after 401 Unauthorized: %s", err)
+	}
+
+	retry, err := am.withToken(request)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(retry)
+}
+
+// reauthenticate logs in again, unless another job already replaced the stale token
+func (am *AMConnection) reauthenticate(staleToken string) error {
+	am.loginMutex.Lock()
+	defer am.loginMutex.Unlock()
+
+	if am.token() != staleToken {
+		return nil
+	}
+
+	amSessionsCounter.WithLabelValues("renewed").Inc()
+	glog.Infof("AM session for %s at %s was rejected, logging in again", am.User, am.BaseURL)
+	return am.Authenticate()
+}
+
+// withToken returns a copy of the request with the current token in place of the one it was created with
+func (am *AMConnection) withToken(request *http.Request) (*http.Request, error) {
+	retry := new(http.Request)
+	*retry = *request
+	retry.Header = http.Header{}
+	for key, values := range request.Header {
+		retry.Header[key] = append([]string{}, values...)
+	}
+
+	if request.GetBody != nil {
+		body, err := request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		retry.Body = body
+	}
+
+	if len(retry.Header.Get("nav-isso")) > 0 {
+		retry.Header.Set("nav-isso", am.token())
+	}
+	if _, err := request.Cookie("iPlanetDirectoryPro"); err == nil {
+		retry.Header.Del("Cookie")
+		retry.AddCookie(&http.Cookie{Name: "iPlanetDirectoryPro", Value: am.token()})
+	}
+	return retry, nil
+}
+
 // FormatAmHeaderString used to format user and password for OpenAM (ref RFC2047)
 func FormatAmHeaderString(headerString string) string {
 	return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(headerString)) + "?="
 }
 
+// jsonPath returns the path of a REST endpoint in the realm of the connection
+func (am *AMConnection) jsonPath(path string) string {
+	return realmJSONPath(am.Realm, path)
+}
+
+// realmJSONPath returns the path of a REST endpoint in the realm, like /json/team/agents for the realm /team
+func realmJSONPath(realm, path string) string {
+	return "/json" + normalizeRealm(realm) + path
+}
+
+// normalizeRealm returns the realm with a leading and no trailing slash, or empty for the root realm
+func normalizeRealm(realm string) string {
+	realm = strings.Trim(strings.TrimSpace(realm), "/")
+	if len(realm) == 0 {
+		return ""
+	}
+	return "/" + realm
+}
+
 func (am *AMConnection) getRequestURL(path string) string {
 	var strs []string
 	strs = append(strs, am.BaseURL)
@@ -102,7 +221,7 @@ func (am *AMConnection) createNewRequest(method, url string, body io.Reader) (*h
 		return request, fmt.Errorf("could not create new request, error: %v", err)
 	}
 
-	iPlanetCookie := http.Cookie{Name: "iPlanetDirectoryPro", Value: am.tokenID}
+	iPlanetCookie := http.Cookie{Name: "iPlanetDirectoryPro", Value: am.token()}
 	request.AddCookie(&iPlanetCookie)
 	request.Header.Set("Content-Type", "application/json")
 	return request, nil
@@ -110,16 +229,16 @@ func (am *AMConnection) createNewRequest(method, url string, body io.Reader) (*h
 
 // AgentExists verifies existence of am agent
 func (am *AMConnection) AgentExists(agentName string) bool {
-	agentURL := am.BaseURL + "/json/agents/" + agentName
-	headers := map[string]string{"nav-isso": am.tokenID}
+	agentURL := am.getRequestURL(am.jsonPath("/agents/" + agentName))
+	headers := map[string]string{"nav-isso": am.token()}
 
-	request, client, err := executeRequest(agentURL, http.MethodGet, headers, nil)
+	request, err := executeRequest(agentURL, http.MethodGet, headers, nil)
 	if err != nil {
 		glog.Errorf("Could not execute request: %s", err)
 		return false
 	}
 
-	response, err := client.Do(request)
+	response, err := am.do(request)
 	if err != nil {
 		glog.Errorf("Could not read response: %s", err)
 		return false
@@ -139,25 +258,96 @@ func (am *AMConnection) AgentExists(agentName string) bool {
 	return false
 }
 
+// Agent contains the attributes of an am agent as returned by the isso server
+type Agent map[string]interface{}
+
+// GetAgent reads am agent from isso server
+func (am *AMConnection) GetAgent(agentName string) (Agent, error) {
+	agentURL := am.getRequestURL(am.jsonPath("/agents/" + agentName))
+	headers := map[string]string{"nav-isso": am.token()}
+
+	request, err := executeRequest(agentURL, http.MethodGet, headers, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not execute request to read agent %s: %s", agentName, err)
+	}
+
+	response, err := am.do(request)
+	if err != nil {
+		glog.Errorf("Could not read response: %s", err)
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("%d Agent %s could not be read", response.StatusCode, agentName)
+	}
+
+	agent := Agent{}
+	if err := json.Unmarshal(body, &agent); err != nil {
+		return nil, fmt.Errorf("could not unmarshal agent %s: %s", agentName, err)
+	}
+
+	return agent, nil
+}
+
+// Values returns the values of an agent attribute, which AM returns either as a string or a list of strings
+func (agent Agent) Values(attribute string) []string {
+	switch value := agent[attribute].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return []string{}
+}
+
+// RedirectionUris returns the redirection uris of the agent without the [n]= index prefix
+func (agent Agent) RedirectionUris() []string {
+	uris := []string{}
+	for _, uri := range agent.Values(redirectionUrisAttribute) {
+		uris = append(uris, stripIndex(uri))
+	}
+	return uris
+}
+
+// stripIndex removes the [n]= prefix AM uses for list values
+func stripIndex(value string) string {
+	if strings.HasPrefix(value, "[") {
+		if i := strings.Index(value, "]="); i > 0 {
+			return value[i+2:]
+		}
+	}
+	return value
+}
+
 // CreateAgent creates am agent on isso server
 func (am *AMConnection) CreateAgent(agentName string, redirectionUris []string, issoResource *IssoResource,
 	namedConfigurationRequest *NamedConfigurationRequest) error {
-	agentURL := am.BaseURL + "/json/agents/?_action=create"
+	agentURL := am.getRequestURL(am.jsonPath("/agents/?_action=create"))
 	headers := map[string]string{
-		"nav-isso":     am.tokenID,
+		"nav-isso":     am.token(),
 		"Content-Type": "application/json"}
 
-	payload, err := json.Marshal(buildAgentPayload(agentName, issoResource.oidcAgentPassword, redirectionUris))
+	payload, err := json.Marshal(buildAgentPayload(agentName, issoResource.agentSecret, redirectionUris,
+		namedConfigurationRequest.OAuth2))
 	if err != nil {
 		return fmt.Errorf("could not marshal create request: %s", err)
 	}
 
-	request, client, err := executeRequest(agentURL, http.MethodPost, headers, bytes.NewReader(payload))
+	request, err := executeRequest(agentURL, http.MethodPost, headers, bytes.NewReader(payload))
 	if err != nil {
 		return fmt.Errorf("could not execute request to create agent: %s", err)
 	}
 
-	response, err := client.Do(request)
+	response, err := am.do(request)
 	if err != nil {
 		glog.Errorf("Could not read response: %s", err)
 		return err
@@ -177,17 +367,140 @@ func (am *AMConnection) CreateAgent(agentName string, redirectionUris []string,
 	return nil
 }
 
+// UpdateAgent updates am agent on isso server in place. The current agent is read, the redirection uris are
+// replaced by the desired ones, and the fields managed by named are overwritten. Other settings are kept.
+// The differences between the current and desired agent are returned, and nothing is written if there are none.
+func (am *AMConnection) UpdateAgent(agentName string, redirectionUris []string, issoResource *IssoResource,
+	namedConfigurationRequest *NamedConfigurationRequest) ([]FieldDiff, error) {
+	agent, err := am.GetAgent(agentName)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := buildAgentPayload(agentName, issoResource.agentSecret, redirectionUris,
+		namedConfigurationRequest.OAuth2)
+	diff := DiffAgent(agent, desired)
+	if issoResource.agentSecretChanged {
+		diff = append(diff, FieldDiff{Field: passwordAttribute, Current: []string{maskedSecret},
+			Desired: []string{maskedSecret}})
+	}
+	if len(diff) == 0 {
+		glog.Infof("Agent %s is up to date", agentName)
+		return diff, nil
+	}
+
+	for _, d := range diff {
+		glog.Infof("Agent %s %s: %v -> %v", agentName, d.Field, d.Current, d.Desired)
+	}
+
+	if err := am.putAgent(agentName, mergeAgent(agent, desired)); err != nil {
+		return nil, err
+	}
+
+	glog.Infof("Agent %s updated", agentName)
+	return diff, nil
+}
+
+// SetAgentSecret changes the password of am agent on isso server, keeping all other settings
+func (am *AMConnection) SetAgentSecret(agentName, secret string) error {
+	agent, err := am.GetAgent(agentName)
+	if err != nil {
+		return err
+	}
+
+	updated := Agent{}
+	for key, value := range agent {
+		if !strings.HasPrefix(key, "_") {
+			updated[key] = value
+		}
+	}
+	updated[passwordAttribute] = secret
+
+	if err := am.putAgent(agentName, updated); err != nil {
+		return err
+	}
+
+	glog.Infof("Secret of agent %s changed", agentName)
+	return nil
+}
+
+func (am *AMConnection) putAgent(agentName string, agent Agent) error {
+	payload, err := json.Marshal(agent)
+	if err != nil {
+		return fmt.Errorf("could not marshal update request: %s", err)
+	}
+
+	agentURL := am.getRequestURL(am.jsonPath("/agents/" + agentName))
+	headers := map[string]string{
+		"nav-isso":     am.token(),
+		"Content-Type": "application/json"}
+
+	request, err := executeRequest(agentURL, http.MethodPut, headers, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("could not execute request to update agent: %s", err)
+	}
+
+	response, err := am.do(request)
+	if err != nil {
+		glog.Errorf("Could not read response: %s", err)
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("%d Agent %s could not be updated: %s", response.StatusCode, agentName, body)
+	}
+
+	return nil
+}
+
+// mergeAgent returns the current agent with the managed fields from the payload, the redirection uris of the
+// payload, reindexed, and without the cleared fields
+func mergeAgent(current Agent, payload agentPayload) Agent {
+	var managed map[string]interface{}
+	jsn, _ := json.Marshal(payload)
+	json.Unmarshal(jsn, &managed)
+
+	merged := Agent{}
+	for key, value := range current {
+		if !strings.HasPrefix(key, "_") {
+			merged[key] = value
+		}
+	}
+	for key, value := range managed {
+		merged[key] = value
+	}
+
+	merged[redirectionUrisAttribute] = indexed(unindexedValues(payload.RedirectionUris))
+	for _, attribute := range payload.cleared {
+		merged[attribute] = []string{}
+	}
+
+	return merged
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // DeleteAgent deletes am agent on isso server
 func (am *AMConnection) DeleteAgent(agentName string) error {
-	agentURL := am.BaseURL + "/json/agents/" + agentName
-	headers := map[string]string{"nav-isso": am.tokenID}
+	agentURL := am.getRequestURL(am.jsonPath("/agents/" + agentName))
+	headers := map[string]string{"nav-isso": am.token()}
 
-	request, client, err := executeRequest(agentURL, http.MethodDelete, headers, nil)
+	request, err := executeRequest(agentURL, http.MethodDelete, headers, nil)
 	if err != nil {
 		return fmt.Errorf("could not execute request to delete agent %s: %s", agentName, err)
 	}
 
-	response, err := client.Do(request)
+	response, err := am.do(request)
 	if err != nil {
 		glog.Errorf("Could not read response: %s", err)
 		return err
@@ -205,34 +518,61 @@ func (am *AMConnection) DeleteAgent(agentName string) error {
 	return nil
 }
 
-func executeRequest(url, method string, headers map[string]string, body io.Reader) (*http.Request, *http.Client,
-	error) {
+func executeRequest(url, method string, headers map[string]string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		glog.Errorf("Could not create request: %s", err)
-		return nil, nil, err
+		return nil, err
 	}
 
 	for hKey, hValue := range headers {
 		req.Header.Add(hKey, hValue)
 	}
 
-	client := &http.Client{}
-
-	return req, client, nil
+	return req, nil
 }
 
-func buildAgentPayload(agentName, agentPassword string, uris []string) agentPayload {
+func buildAgentPayload(agentName, agentPassword string, uris []string, oauth2 *OAuth2Settings) agentPayload {
+	settings := oauth2.withDefaults()
+
 	agentPayload := agentPayload{
 		Username:        agentName,
 		Password:        agentPassword,
 		AgentType:       "OAuth2Client",
-		Algorithm:       "RS256",
-		Scope:           "[0]=openid",
-		ConsentImplied:  "true",
+		Algorithm:       settings.IDTokenSignedResponseAlg,
+		Scopes:          indexed(settings.Scopes),
+		ConsentImplied:  strconv.FormatBool(*settings.ConsentImplied),
+		ClientType:      settings.ClientType,
 		RedirectionUris: uris,
 	}
 
+	if settings.PostLogoutRedirectUris != nil {
+		if len(settings.PostLogoutRedirectUris) > 0 {
+			agentPayload.PostLogoutRedirectUris = indexed(settings.PostLogoutRedirectUris)
+		} else {
+			agentPayload.cleared = append(agentPayload.cleared, postLogoutRedirectUrisAttribute)
+		}
+	}
+
+	lifetimes := []struct {
+		attribute string
+		seconds   *int
+		value     *string
+	}{
+		{accessTokenLifetimeAttribute, settings.AccessTokenLifetime, &agentPayload.AccessTokenLifetime},
+		{refreshTokenLifetimeAttribute, settings.RefreshTokenLifetime, &agentPayload.RefreshTokenLifetime},
+	}
+	for _, lifetime := range lifetimes {
+		if lifetime.seconds == nil {
+			continue
+		}
+		if *lifetime.seconds > 0 {
+			*lifetime.value = strconv.Itoa(*lifetime.seconds)
+		} else {
+			agentPayload.cleared = append(agentPayload.cleared, lifetime.attribute)
+		}
+	}
+
 	return agentPayload
 }
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"net/http"
 	"testing"
 
 	"github.com/golang/glog"
@@ -47,7 +48,7 @@ func TestAgentExists(t *testing.T) {
 
 func TestCreateAgent(t *testing.T) {
 
-	payload, _ := json.Marshal(buildAgentPayload("testAgent", "", []string{}))
+	payload, _ := json.Marshal(buildAgentPayload("testAgent", "", []string{}, nil))
 
 	defer gock.Off()
 
@@ -62,6 +63,86 @@ func TestCreateAgent(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRealmPaths(t *testing.T) {
+	assert.Equal(t, "/json/agents/testAgent", amc.jsonPath("/agents/testAgent"))
+	assert.Equal(t, "/json/team/agents/testAgent", realmJSONPath("team", "/agents/testAgent"))
+	assert.Equal(t, "/json/team/sub/policies", realmJSONPath("/team/sub/", "/policies"))
+	assert.Equal(t, "/json/policies", realmJSONPath("/", "/policies"))
+}
+
+func TestAgentInRealm(t *testing.T) {
+	am := AMConnection{BaseURL: baseURL, User: "user", Password: "pass", Realm: "/team"}
+
+	defer gock.Off()
+
+	gock.New(baseURL).
+		Get("/json/team/agents/testAgent").
+		Reply(200)
+
+	gock.New(baseURL).
+		Delete("/json/team/agents/testAgent").
+		Reply(200)
+
+	assert.True(t, am.AgentExists("testAgent"))
+	assert.NoError(t, am.DeleteAgent("testAgent"))
+	assert.True(t, gock.IsDone())
+}
+
+func TestGetAgent(t *testing.T) {
+
+	defer gock.Off()
+
+	gock.New(baseURL).
+		Get("/json/agents/testAgent").
+		MatchHeader("nav-isso", amc.tokenID).
+		Reply(200).
+		BodyString(`{"com.forgerock.openam.oauth2provider.redirectionURIs": ["[0]=https://testapp.domain/a", "[1]=https://testapp.domain/b"], "agenttype": "OAuth2Client"}`)
+
+	gock.New(baseURL).
+		Get("/json/agents/noTestAgent").
+		MatchHeader("nav-isso", amc.tokenID).
+		Reply(404)
+
+	agent, err := amc.GetAgent("testAgent")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://testapp.domain/a", "https://testapp.domain/b"}, agent.RedirectionUris())
+	assert.Equal(t, []string{"OAuth2Client"}, agent.Values("agenttype"))
+
+	_, err = amc.GetAgent("noTestAgent")
+	assert.Error(t, err)
+}
+
+func TestUpdateAgent(t *testing.T) {
+
+	defer gock.Off()
+
+	gock.New(baseURL).
+		Get("/json/agents/testAgent").
+		Reply(200).
+		BodyString(`{"_rev": "1", "com.forgerock.openam.oauth2provider.redirectionURIs": ["[0]=https://manual.domain/a"], "com.forgerock.openam.oauth2provider.name": ["manual"]}`)
+
+	var updated map[string]interface{}
+	gock.New(baseURL).
+		Put("/json/agents/testAgent").
+		MatchHeader("nav-isso", amc.tokenID).
+		AddMatcher(func(req *http.Request, _ *gock.Request) (bool, error) {
+			return true, json.NewDecoder(req.Body).Decode(&updated)
+		}).
+		Reply(200)
+
+	diff, err := amc.UpdateAgent("testAgent", []string{"[0]=https://testapp.domain/a", "[1]=https://testapp.domain/b"},
+		&IssoResource{agentSecret: "secret"}, &NamedConfigurationRequest{})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, diff)
+	assert.True(t, gock.IsDone())
+
+	assert.NotContains(t, updated, "_rev")
+	assert.Equal(t, []interface{}{"manual"}, updated["com.forgerock.openam.oauth2provider.name"])
+	assert.Equal(t, "secret", updated["userpassword"])
+	assert.Equal(t, []interface{}{"[0]=https://testapp.domain/a", "[1]=https://testapp.domain/b"},
+		updated[redirectionUrisAttribute])
+}
+
 func TestDeleteAgent(t *testing.T) {
 
 	defer gock.Off()
@@ -1,17 +1,21 @@
 package api
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/golang/glog"
 	"github.com/h2non/filetype"
-	"golang.org/x/crypto/ssh"
+	"github.com/nais/named/api/policyfile"
+	"github.com/pkg/sftp"
 )
 
 // ValidationErrors contains all validation errors
@@ -19,143 +23,232 @@ type ValidationErrors struct {
 	Errors []ValidationError
 }
 
-// ValidationError contains error and fields of destruction
+// ValidationError contains error and where in which file it was found. Line and Column are 0 for problems with the
+// whole file, and RuleID is only set for lint findings.
 type ValidationError struct {
-	ErrorMessage string
-	Fields       map[string]string
+	ErrorMessage string              `json:"message"`
+	File         string              `json:"file"`
+	Line         int                 `json:"line,omitempty"`
+	Column       int                 `json:"column,omitempty"`
+	RuleID       string              `json:"ruleId,omitempty"`
+	Severity     policyfile.Severity `json:"severity"`
 }
 
-// GenerateAmFiles returns array of validated and downloaded policy files
-func GenerateAmFiles(request *NamedConfigurationRequest) ([]string, error) {
-	policyFiles, err := downloadPolicies(request)
+// GenerateAmFiles returns a new workspace with the validated policy files, uploaded with the request or downloaded, and
+// the digests of the files. Callers must remove the workspace when done.
+func GenerateAmFiles(request *NamedConfigurationRequest) (*Workspace, []PolicyDigest, error) {
+	fetch := downloadPolicies
+	if len(request.PolicyFiles) > 0 {
+		fetch = uploadedPolicies
+	}
+
+	files, digests, err := fetch(request)
 	if err != nil {
-		return []string{}, err
+		return nil, nil, err
 	}
 
-	validationErrors := ValidatePolicyFiles(policyFiles)
-	if len(validationErrors.Errors) != 0 {
-		return []string{}, validationErrors
+	workspace, err := newWorkspace(request.Application)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return policyFiles, nil
-}
+	if err := writePolicyFiles(workspace, files); err != nil {
+		workspace.Remove()
+		return nil, nil, err
+	}
 
-func downloadPolicies(request *NamedConfigurationRequest) ([]string, error) {
-	urls := createPolicyFileUrls(request.Application, request.Version)
-	files, err := fetchPolicyFiles(urls, request.Application)
-	if err != nil {
-		return []string{}, err
+	validationErrors := ValidatePolicyFiles(workspace.Files, nil)
+	for _, warning := range validationErrors.Warnings() {
+		glog.Warningf("%s: %s (%s)", warning.File, warning.ErrorMessage, warning.RuleID)
+	}
+	if validationErrors.HasErrors() {
+		workspace.Remove()
+		return nil, nil, validationErrors
 	}
 
-	return files, nil
+	return workspace, digests, nil
 }
 
-func createPolicyFileUrls(application, version string) []string {
-	var urls = []string{}
-	baseURL := "https://repo.adeo.no/repository/raw/nais"
-	urls = append(urls, fmt.Sprintf("%s/%s/%s/am/app-policies.xml", baseURL, application, version))
-	urls = append(urls, fmt.Sprintf("%s/%s/%s/am/not-enforced-urls.txt", baseURL, application, version))
-	return urls
+// downloadPolicies fetches the policy files of the application version from the policy source
+func downloadPolicies(request *NamedConfigurationRequest) (map[string][]byte, []PolicyDigest, error) {
+	files := map[string][]byte{}
+	var digests []PolicyDigest
+	for _, name := range []string{policyFileName, notEnforcedFileName} {
+		glog.Infof("Fetching %s for %s %s from %s", name, request.Application, request.Version, policySource)
+
+		content, digest, err := policySource.Fetch(request.Application, request.Version, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		glog.Infof("Fetched %s with sha256 %s, verified by %s", digest.Source, digest.SHA256, digest.Verified)
+
+		files[name] = content
+		digests = append(digests, digest)
+	}
+
+	return files, digests, nil
 }
 
-func fetchPolicyFiles(urls []string, application string) ([]string, error) {
-	var fileNames = []string{}
-	for _, url := range urls {
-		glog.Infof("Fetching file from URL %s\n", url)
+// uploadedPolicies returns the policy files uploaded with the request, which have nothing to be verified against
+func uploadedPolicies(request *NamedConfigurationRequest) (map[string][]byte, []PolicyDigest, error) {
+	return request.PolicyFiles, uploadedPolicyDigests(request), nil
+}
 
-		_, fileName := filepath.Split(url)
+// uploadedPolicyDigests returns the digests of the policy files uploaded with the request
+func uploadedPolicyDigests(request *NamedConfigurationRequest) []PolicyDigest {
+	var digests []PolicyDigest
+	for _, name := range []string{policyFileName, notEnforcedFileName} {
+		if content, ok := request.PolicyFiles[name]; ok {
+			digests = append(digests, newPolicyDigest(name, policyUploadSource, content))
+		}
+	}
+	return digests
+}
 
-		if _, err := os.Stat("/tmp/" + application); os.IsNotExist(err) {
-			os.Mkdir("/tmp/"+application, os.ModePerm)
+// writePolicyFiles writes the policy files to the workspace, app-policies.xml first
+func writePolicyFiles(workspace *Workspace, files map[string][]byte) error {
+	for _, name := range []string{policyFileName, notEnforcedFileName} {
+		content, ok := files[name]
+		if !ok {
+			continue
 		}
 
-		out, err := os.Create("/tmp/" + application + "/" + fileName)
-		if err != nil {
-			return []string{}, fmt.Errorf("Could not create file %s " + fileName)
+		fileName := filepath.Join(workspace.Dir, name)
+		if err := ioutil.WriteFile(fileName, content, 0644); err != nil {
+			return fmt.Errorf("could not write policy file %s: %s", name, err)
 		}
+		workspace.Files = append(workspace.Files, fileName)
+	}
 
-		defer out.Close()
+	return nil
+}
 
-		response, err := http.Get(url)
-		if err != nil {
-			return []string{}, fmt.Errorf("HTTP GET failed for url: %s. %s", url, err)
-		}
+const (
+	// policyFileMode is set on the policy files on the AM host, which are read by the policy script running as root
+	policyFileMode = 0644
+	// uploadSuffix is added to the name of a policy file while it is uploaded
+	uploadSuffix = ".uploading"
+)
 
-		defer response.Body.Close()
+// CopyFilesToAmServer sftps the policy files of the workspace to its directory on the AM host
+func CopyFilesToAmServer(sftpClient *sftp.Client, workspace *Workspace) error {
+	sweepRemoteWorkspaces(sftpClient)
 
-		if response.StatusCode > 299 {
-			return []string{}, fmt.Errorf("got HTTP status code %d fetching manifest from URL: %s", response.StatusCode,
-				url)
-		}
+	if err := sftpClient.Mkdir(workspace.RemoteDir()); err != nil {
+		return fmt.Errorf("could not create remote workspace %s: %s", workspace.RemoteDir(), err)
+	}
 
-		_, err = io.Copy(out, response.Body)
-		if err != nil {
-			return []string{}, fmt.Errorf("Could not write to %s ", fileName)
+	dirInfo, err := sftpClient.Stat(workspace.RemoteDir())
+	if err != nil {
+		return fmt.Errorf("could not stat remote workspace %s: %s", workspace.RemoteDir(), err)
+	}
+	owner, ok := dirInfo.Sys().(*sftp.FileStat)
+	if !ok {
+		return fmt.Errorf("AM host did not give the owner of %s", workspace.RemoteDir())
+	}
+
+	for _, policyFile := range workspace.Files {
+		remoteFile := path.Join(workspace.RemoteDir(), filepath.Base(policyFile))
+		if err := uploadPolicyFile(sftpClient, policyFile, remoteFile, owner); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
 
-		fileNames = append(fileNames, out.Name())
+// uploadPolicyFile streams the file to a temp name next to the remote file, sets its mode and owner, verifies its size
+// and sha256, and renames it, so the policy script never sees a half-written file
+func uploadPolicyFile(sftpClient *sftp.Client, localFile, remoteFile string, owner *sftp.FileStat) error {
+	tempFile := path.Join(path.Dir(remoteFile), "."+path.Base(remoteFile)+uploadSuffix)
+
+	size, sum, err := writeRemoteFile(sftpClient, localFile, tempFile)
+	if err == nil {
+		err = finishRemoteFile(sftpClient, tempFile, owner, size, sum)
+	}
+	if err == nil {
+		if err = sftpClient.Rename(tempFile, remoteFile); err != nil {
+			err = fmt.Errorf("could not rename %s to %s: %s", tempFile, remoteFile, err)
+		}
 	}
 
-	return fileNames, nil
+	if err != nil {
+		sftpClient.Remove(tempFile)
+		return err
+	}
+	return nil
 }
 
-// CopyFilesToAmServer sftps policy files to desired AM host
-func CopyFilesToAmServer(sshClient *ssh.Client, policyFiles []string, application string) error {
-	sftpClient, err := SftpConnect(sshClient)
+// writeRemoteFile copies the local file to the remote file, returning the size and sha256 of what was sent
+func writeRemoteFile(sftpClient *sftp.Client, localFile, remoteFile string) (int64, []byte, error) {
+	src, err := os.Open(localFile)
 	if err != nil {
-		return fmt.Errorf("could not transfer files to AM server: %s", err)
+		return 0, nil, fmt.Errorf("could not open file %s: %s", localFile, err)
 	}
+	defer src.Close()
 
-	for _, policyFile := range policyFiles {
-		srcFile, err := os.Open(policyFile)
-		if err != nil {
-			return fmt.Errorf("could not openAdminConnection file %s: %s", policyFile, err)
-		}
+	dest, err := sftpClient.OpenFile(remoteFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not create am file %s: %s", remoteFile, err)
+	}
 
-		srcFileInfo, err := srcFile.Stat()
-		if err != nil {
-			return fmt.Errorf("could not stat file %s: %s", policyFile, err)
-		}
+	hash := sha256.New()
+	size, err := io.Copy(dest, io.TeeReader(src, hash))
+	if err != nil {
+		dest.Close()
+		return 0, nil, fmt.Errorf("could not write am file %s: %s", remoteFile, err)
+	}
+	if err := dest.Close(); err != nil {
+		return 0, nil, fmt.Errorf("could not write am file %s: %s", remoteFile, err)
+	}
 
-		defer srcFile.Close()
+	return size, hash.Sum(nil), nil
+}
 
-		_ = sftpClient.Mkdir("/tmp/" + application)
-		destFile, err := sftpClient.Create(policyFile)
-		if err != nil {
-			return fmt.Errorf("could not create am file %s: %s", policyFile, err)
-		}
-		defer destFile.Close()
+// finishRemoteFile sets the mode and owner of the remote file, and checks that it has the size and sha256 sent
+func finishRemoteFile(sftpClient *sftp.Client, remoteFile string, owner *sftp.FileStat, size int64, sum []byte) error {
+	if err := sftpClient.Chmod(remoteFile, policyFileMode); err != nil {
+		return fmt.Errorf("could not set mode of am file %s: %s", remoteFile, err)
+	}
+	if err := sftpClient.Chown(remoteFile, int(owner.UID), int(owner.GID)); err != nil {
+		return fmt.Errorf("could not set owner of am file %s: %s", remoteFile, err)
+	}
 
-		buf := make([]byte, srcFileInfo.Size())
-		for {
-			n, _ := srcFile.Read(buf)
-			if n == 0 {
-				break
-			}
-		}
-		destFile.Write(buf)
+	info, err := sftpClient.Stat(remoteFile)
+	if err != nil {
+		return fmt.Errorf("could not stat am file %s: %s", remoteFile, err)
+	}
+	if info.Size() != size {
+		return fmt.Errorf("am file %s has %d bytes, but %d were sent", remoteFile, info.Size(), size)
+	}
+
+	remote, err := sftpClient.Open(remoteFile)
+	if err != nil {
+		return fmt.Errorf("could not read back am file %s: %s", remoteFile, err)
 	}
+	defer remote.Close()
 
-	cleanupLocalFiles(policyFiles)
+	hash := sha256.New()
+	if _, err := io.Copy(hash, remote); err != nil {
+		return fmt.Errorf("could not read back am file %s: %s", remoteFile, err)
+	}
+	if !bytes.Equal(hash.Sum(nil), sum) {
+		return fmt.Errorf("am file %s does not have the sha256 of %s sent", remoteFile, hex.EncodeToString(sum))
+	}
 	return nil
 }
 
 // UpdatePolicyFiles replaces ${DomainName} with correct site name in policy files
 func UpdatePolicyFiles(policyFiles []string, environment string) error {
-	siteName := "tjenester.nav.no"
-	if strings.ToLower(environment[:1]) != "p" {
-		siteName = "tjenester-" + environment + ".nav.no"
-	}
-
 	for _, policyFile := range policyFiles {
 		read, err := ioutil.ReadFile(policyFile)
 		if err != nil {
 			return fmt.Errorf("could not read file %s", policyFile)
 		}
 
-		newContents := strings.Replace(string(read), "${DomainName}", siteName, -1)
+		newContents := RenderPolicyFile(read, environment)
 
-		err = ioutil.WriteFile(policyFile, []byte(newContents), 0)
+		err = ioutil.WriteFile(policyFile, newContents, 0)
 		if err != nil {
 			return fmt.Errorf("could not write file %s", policyFile)
 		}
@@ -165,19 +258,87 @@ func UpdatePolicyFiles(policyFiles []string, environment string) error {
 	return nil
 }
 
-func cleanupLocalFiles(policyFiles []string) error {
-	for _, fileName := range policyFiles {
-		err := os.Remove(fileName)
+// SiteName returns the host the applications of the environment are served on
+func SiteName(environment string) string {
+	if strings.ToLower(environment[:1]) != "p" {
+		return "tjenester-" + environment + ".nav.no"
+	}
+	return "tjenester.nav.no"
+}
+
+// RenderPolicyFile returns the policy file as it is shipped to AM for the environment
+func RenderPolicyFile(content []byte, environment string) []byte {
+	return []byte(strings.Replace(string(content), "${DomainName}", SiteName(environment), -1))
+}
+
+// placeholderRules check the ${DomainName} placeholder, so they only make sense before the files are rendered
+var placeholderRules = []string{policyfile.RuleMissingDomainName, policyfile.RuleHardcodedHost}
+
+// ValidateRenderedPolicyFiles validates the policy files as they are shipped to the environment, with ${DomainName}
+// replaced. The placeholder rules are run on the files as given, and all problems are reported for the given files.
+func ValidateRenderedPolicyFiles(fileNames []string, environment string, disabledRules []string) (ValidationErrors,
+	error) {
+	dir, err := ioutil.TempDir("", "named-validate")
+	if err != nil {
+		return ValidationErrors{}, fmt.Errorf("could not create directory for rendered files: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sources := map[string]string{}
+	var renderedFiles []string
+	for _, fileName := range fileNames {
+		content, err := ioutil.ReadFile(fileName)
 		if err != nil {
-			return fmt.Errorf("could not remove file: %s", fileName)
+			return ValidationErrors{}, fmt.Errorf("could not read file %s: %s", fileName, err)
+		}
+
+		renderedFile := filepath.Join(dir, filepath.Base(fileName))
+		if err := ioutil.WriteFile(renderedFile, RenderPolicyFile(content, environment), 0600); err != nil {
+			return ValidationErrors{}, fmt.Errorf("could not write rendered file %s: %s", renderedFile, err)
 		}
+		sources[renderedFile] = fileName
+		renderedFiles = append(renderedFiles, renderedFile)
 	}
-	return nil
+
+	var validationErrors ValidationErrors
+	for _, validationError := range ValidatePolicyFiles(fileNames, disabledRules).Errors {
+		for _, rule := range placeholderRules {
+			if validationError.RuleID == rule {
+				validationErrors.Errors = append(validationErrors.Errors, validationError)
+			}
+		}
+	}
+
+	rendered := ValidatePolicyFiles(renderedFiles, append(append([]string{}, disabledRules...), placeholderRules...))
+	for _, validationError := range rendered.Errors {
+		validationError.File = sources[validationError.File]
+		validationErrors.Errors = append(validationErrors.Errors, validationError)
+	}
+	return validationErrors, nil
 }
 
-// ValidatePolicyFiles validates the policy xml files, checking the file type
-func ValidatePolicyFiles(fileNames []string) ValidationErrors {
+// PolicyFilesInDir returns app-policies.xml and, when there is one, not-enforced-urls.txt in the directory
+func PolicyFilesInDir(dir string) ([]string, error) {
+	policyFile := filepath.Join(dir, policyFileName)
+	if _, err := os.Stat(policyFile); err != nil {
+		return nil, fmt.Errorf("could not find %s in %s", policyFileName, dir)
+	}
+
+	files := []string{policyFile}
+	notEnforcedFile := filepath.Join(dir, notEnforcedFileName)
+	if _, err := os.Stat(notEnforcedFile); err == nil {
+		files = append(files, notEnforcedFile)
+	}
+	return files, nil
+}
+
+// ValidatePolicyFiles validates app-policies.xml and not-enforced-urls.txt, checking the file type and running the lint
+// rules that are not disabled. When both files are given, they are also checked against each other.
+func ValidatePolicyFiles(fileNames []string, disabledRules []string) ValidationErrors {
 	var validationErrors ValidationErrors
+	var policies *policyfile.Policies
+	var urls *policyfile.NotEnforcedURLs
+	var urlsFile string
 
 	for _, fileName := range fileNames {
 		validations := []func(string) *ValidationError{
@@ -190,6 +351,22 @@ func ValidatePolicyFiles(fileNames []string) ValidationErrors {
 			}
 		}
 
+		var fileErrors []ValidationError
+		if strings.HasSuffix(fileName, ".xml") {
+			policies, fileErrors = validatePolicyXML(fileName, disabledRules)
+		}
+
+		if strings.HasSuffix(fileName, ".txt") {
+			urls, fileErrors = validateNotEnforcedURLs(fileName, disabledRules)
+			urlsFile = fileName
+		}
+		validationErrors.Errors = append(validationErrors.Errors, fileErrors...)
+
+	}
+
+	if policies != nil && urls != nil {
+		validationErrors.Errors = append(validationErrors.Errors,
+			lintValidationErrors(urlsFile, policyfile.CrossCheck(policies, urls, disabledRules))...)
 	}
 	return validationErrors
 }
@@ -205,21 +382,116 @@ func validateContent(fileName string) *ValidationError {
 
 	if kind.Extension == "unknown" {
 		return &ValidationError{
-			"Unknown file type",
-			map[string]string{"File": fileName},
+			ErrorMessage: "Unknown file type",
+			File:         fileName,
+			Severity:     policyfile.SeverityError,
 		}
 	}
 
 	return nil
 }
 
-func (errors ValidationErrors) Error() (s string) {
+// validatePolicyXML parses and lints the policy file, returning an error for each problem with its position in the
+// file. Lint findings also have the rule and its severity. The policies are only returned when the file parses.
+func validatePolicyXML(fileName string, disabledRules []string) (*policyfile.Policies, []ValidationError) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, []ValidationError{{ErrorMessage: "Could not read file", File: fileName,
+			Severity: policyfile.SeverityError}}
+	}
+
+	policies, err := policyfile.Parse(content)
+	if err != nil {
+		return nil, parseValidationErrors(fileName, err)
+	}
+
+	return policies, lintValidationErrors(fileName, policyfile.Lint(policies, disabledRules))
+}
+
+// validateNotEnforcedURLs parses and lints not-enforced-urls.txt, like validatePolicyXML
+func validateNotEnforcedURLs(fileName string, disabledRules []string) (*policyfile.NotEnforcedURLs, []ValidationError) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, []ValidationError{{ErrorMessage: "Could not read file", File: fileName,
+			Severity: policyfile.SeverityError}}
+	}
+
+	urls, err := policyfile.ParseNotEnforcedURLs(content)
+	if err != nil {
+		return nil, parseValidationErrors(fileName, err)
+	}
+
+	return urls, lintValidationErrors(fileName, policyfile.LintNotEnforcedURLs(urls, disabledRules))
+}
+
+func parseValidationErrors(fileName string, err error) []ValidationError {
+	var validationErrors []ValidationError
+	for _, parseError := range err.(policyfile.Errors) {
+		validationErrors = append(validationErrors, ValidationError{
+			ErrorMessage: parseError.Message,
+			File:         fileName,
+			Line:         parseError.Line,
+			Column:       parseError.Column,
+			Severity:     policyfile.SeverityError,
+		})
+	}
+	return validationErrors
+}
+
+func lintValidationErrors(fileName string, findings []policyfile.Finding) []ValidationError {
+	var validationErrors []ValidationError
+	for _, finding := range findings {
+		validationErrors = append(validationErrors, ValidationError{
+			ErrorMessage: finding.Message,
+			File:         fileName,
+			Line:         finding.Line,
+			Column:       finding.Column,
+			RuleID:       finding.RuleID,
+			Severity:     finding.Severity,
+		})
+	}
+	return validationErrors
+}
+
+// HasErrors tells whether any of the validation errors are more than warnings
+func (errors ValidationErrors) HasErrors() bool {
 	for _, validationError := range errors.Errors {
-		s += validationError.ErrorMessage + "\n"
-		for k, v := range validationError.Fields {
-			s += " - " + k + ": " + v + ".\n"
+		if validationError.Severity != policyfile.SeverityWarning {
+			return true
 		}
 	}
+	return false
+}
+
+// Warnings returns the validation errors that are only warnings
+func (errors ValidationErrors) Warnings() []ValidationError {
+	var warnings []ValidationError
+	for _, validationError := range errors.Errors {
+		if validationError.Severity == policyfile.SeverityWarning {
+			warnings = append(warnings, validationError)
+		}
+	}
+	return warnings
+}
+
+func (errors ValidationErrors) Error() (s string) {
+	for _, validationError := range errors.Errors {
+		s += validationError.String() + "\n"
+	}
+	return s
+}
+
+// String formats the error as file:line:column: severity: message [rule]
+func (validationError ValidationError) String() string {
+	location := validationError.File
+	if validationError.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", validationError.File, validationError.Line, validationError.Column)
+	}
+
+	s := fmt.Sprintf("%s: %s: %s", location, validationError.Severity, validationError.ErrorMessage)
+	if len(validationError.RuleID) > 0 {
+		s += " [" + validationError.RuleID + "]"
+	}
 	return s
 }
 
@@ -2,11 +2,14 @@ package api
 
 import (
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/h2non/gock"
+	"github.com/pkg/sftp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,13 +21,21 @@ func TestGetAmFiles(t *testing.T) {
 	defer gock.Off()
 
 	gock.New(policypath).Reply(200).File("testdata/app-policies.xml")
+	gock.New(policypath + ".sha256").Reply(404)
+	gock.New(policypath + ".sha1").Reply(200).BodyString("ea51893eefa196a24fc4b2233a0abde516d090d3")
 	gock.New(notenforcedpath).Reply(200).File("testdata/not-enforced-urls.txt")
-	files, err := GenerateAmFiles(&NamedConfigurationRequest{Application: "testapp", Version: "2.0"})
+	gock.New(notenforcedpath + ".sha256").Reply(404)
+	gock.New(notenforcedpath + ".sha1").Reply(200).BodyString("ee42b83bc156bc891db2cc02c47c7adf4fa4203e")
+	workspace, digests, err := GenerateAmFiles(&NamedConfigurationRequest{Application: "testapp", Version: "2.0"})
 
 	assert.NoError(t, err)
-	assert.Equal(t, 2, len(files))
-	assert.Equal(t, "/tmp/testapp/app-policies.xml", files[0])
-	assert.Equal(t, "/tmp/testapp/not-enforced-urls.txt", files[1])
+	defer workspace.Remove()
+	assert.Equal(t, 2, len(workspace.Files))
+	assert.Equal(t, filepath.Join(workspace.Dir, "app-policies.xml"), workspace.Files[0])
+	assert.Equal(t, filepath.Join(workspace.Dir, "not-enforced-urls.txt"), workspace.Files[1])
+	assert.Len(t, digests, 2)
+	assert.Equal(t, DigestSHA1, digests[0].Verified)
+	assert.Equal(t, policypath, digests[0].Source)
 }
 
 func TestUpdatePolicyFiles(t *testing.T) {
@@ -55,25 +66,160 @@ func TestInvalidFileGivesError(t *testing.T) {
 	assert.Equal(t, "Unknown file type", err.ErrorMessage)
 }
 
-func TestCleanupNonExistingFilesGivesError(t *testing.T) {
-	policyFiles := []string{"testdata/app-policy-does-not-exist.xml"}
-	err := cleanupLocalFiles(policyFiles)
-	assert.Equal(t, "could not remove file: testdata/app-policy-does-not-exist.xml", err.Error())
-}
-
 func TestFetchNonExistingFilesShouldReturnError(t *testing.T) {
 	app := "testapp"
 	version := "2.0"
-	urls := createPolicyFileUrls(app, version)
 
 	assert.Equal(t, "https://repo.adeo.no/repository/raw/nais/testapp/2"+
-		".0/am/app-policies.xml", urls[0])
+		".0/am/app-policies.xml", expandTemplate(DefaultPolicyURLTemplate, app, version, "app-policies.xml"))
 	assert.Equal(t, "https://repo.adeo.no/repository/raw/nais/testapp/2"+
-		".0/am/not-enforced-urls.txt", urls[1])
+		".0/am/not-enforced-urls.txt", expandTemplate(DefaultPolicyURLTemplate, app, version, "not-enforced-urls.txt"))
+
+	defer gock.Off()
+	gock.New("https://repo.adeo.no").Get("/repository/raw/nais/testapp/2.0/am/app-policies.xml").Reply(404)
 
-	_, err := fetchPolicyFiles(urls, app)
+	_, _, err := downloadPolicies(&NamedConfigurationRequest{Application: app, Version: version})
 	assert.NotNil(t, err)
+}
+
+func TestPolicyXMLErrorsHavePosition(t *testing.T) {
+	_, validationErrors := validatePolicyXML("testdata/app-policies-error.xml", nil)
+	assert.Len(t, validationErrors, 1)
+	assert.Equal(t, "testdata/app-policies-error.xml", validationErrors[0].File)
+	assert.Equal(t, 64, validationErrors[0].Line)
+}
+
+func TestLintWarningsDoNotFailValidation(t *testing.T) {
+	validationErrors := ValidatePolicyFiles([]string{"testdata/app-policies.xml", "testdata/not-enforced-urls.txt"}, nil)
+
+	assert.False(t, validationErrors.HasErrors())
+	assert.Len(t, validationErrors.Warnings(), 10)
+	assert.Equal(t, "testdata/not-enforced-urls.txt", validationErrors.Errors[9].File)
+	assert.Equal(t, "hardcoded-host", validationErrors.Errors[1].RuleID)
+	assert.Equal(t, 11, validationErrors.Errors[1].Line)
+
+	validationErrors = ValidatePolicyFiles([]string{"testdata/app-policies.xml"}, []string{"hardcoded-host",
+		"missing-domain-name"})
+	assert.Empty(t, validationErrors.Errors)
+}
+
+func TestPolicyFilesInDir(t *testing.T) {
+	files, err := PolicyFilesInDir("testdata")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testdata/app-policies.xml", "testdata/not-enforced-urls.txt"}, files)
+
+	_, err = PolicyFilesInDir("testdata/am")
+	assert.EqualError(t, err, "could not find app-policies.xml in testdata/am")
+}
+
+func TestRenderPolicyFile(t *testing.T) {
+	content := []byte("https://${DomainName}/app/*")
+
+	assert.Equal(t, "https://tjenester-t1.nav.no/app/*", string(RenderPolicyFile(content, "t1")))
+	assert.Equal(t, "https://tjenester.nav.no/app/*", string(RenderPolicyFile(content, "p")))
+}
+
+func TestValidateRenderedPolicyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rendered")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	policies := filepath.Join(dir, policyFileName)
+	urls := filepath.Join(dir, notEnforcedFileName)
+	assert.NoError(t, ioutil.WriteFile(policies, []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Policies>
+	<Policy name="Testapp_001" active="true">
+		<Rule name="rule_Testapp_001_01">
+			<ServiceName name="iPlanetAMWebAgentService" />
+			<ResourceName name="https://${DomainName}/testapp/*" />
+		</Rule>
+		<Subjects>
+			<Subject name="subject_Testapp_001_01" type="AuthenticatedUsers" includeType="inclusive" />
+		</Subjects>
+	</Policy>
+</Policies>`), 0644))
+	assert.NoError(t, ioutil.WriteFile(urls, []byte("https://tjenester-t1.nav.no/testapp/*\n"), 0644))
+
+	validationErrors := ValidatePolicyFiles([]string{policies, urls}, []string{"missing-domain-name"})
+	assert.Len(t, validationErrors.Errors, 1)
+	assert.Equal(t, "hardcoded-host", validationErrors.Errors[0].RuleID)
+
+	validationErrors, err = ValidateRenderedPolicyFiles([]string{policies, urls}, "t1",
+		[]string{"missing-domain-name"})
+	assert.NoError(t, err)
+	assert.Len(t, validationErrors.Errors, 2)
+	assert.Equal(t, "hardcoded-host", validationErrors.Errors[0].RuleID)
+	assert.Equal(t, "protected-not-enforced", validationErrors.Errors[1].RuleID)
+	assert.Equal(t, urls, validationErrors.Errors[1].File)
+
+	validationErrors, err = ValidateRenderedPolicyFiles([]string{policies, urls}, "t2",
+		[]string{"missing-domain-name", "hardcoded-host"})
+	assert.NoError(t, err)
+	assert.Empty(t, validationErrors.Errors)
+}
+
+func TestUploadedPolicyFilesAreUsed(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/app-policies.xml")
+	assert.NoError(t, err)
+
+	request := &NamedConfigurationRequest{Application: "uploadapp", PolicyFiles: map[string][]byte{
+		"app-policies.xml":      content,
+		"not-enforced-urls.txt": []byte("https://${DomainName}/*\n"),
+	}}
+
+	_, _, err = GenerateAmFiles(request)
+	assert.Contains(t, err.Error(), "turns off enforcement for the whole site")
+
+	request.PolicyFiles["not-enforced-urls.txt"] = []byte("https://${DomainName}/uploadapp/login*\n")
+	workspace, digests, err := GenerateAmFiles(request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(workspace.Dir, "app-policies.xml"),
+		filepath.Join(workspace.Dir, "not-enforced-urls.txt")}, workspace.Files)
+	assert.Equal(t, policyUploadSource, digests[0].Source)
+	assert.Equal(t, "e4f71613a3420b73b27c0eb0564ec9c611d77e9ed9465836f7c4f0d7458a198b", digests[0].SHA256)
+	workspace.Remove()
+}
+
+func TestCopyFilesToAmServer(t *testing.T) {
+	local, remote := net.Pipe()
+	server, err := sftp.NewServer(remote)
+	assert.NoError(t, err)
+	go server.Serve()
+	defer server.Close()
+
+	sftpClient, err := sftp.NewClientPipe(local, local)
+	assert.NoError(t, err)
+	defer sftpClient.Close()
+
+	files, err := newWorkspace("testapp")
+	assert.NoError(t, err)
+	defer files.Remove()
+	assert.NoError(t, writePolicyFiles(files, map[string][]byte{
+		"app-policies.xml":      []byte("<Policies/>"),
+		"not-enforced-urls.txt": []byte("https://tjenester.nav.no/testapp/login*\n"),
+	}))
+
+	// the AM host is the local machine here, so the remote workspace needs another name than the local one
+	workspace := &Workspace{Name: files.Name + "-remote", Files: files.Files}
+	defer workspace.RemoveRemote(sftpClient)
+
+	assert.NoError(t, CopyFilesToAmServer(sftpClient, workspace))
+
+	entries, err := ioutil.ReadDir(workspace.RemoteDir())
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, os.FileMode(policyFileMode), entry.Mode().Perm())
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(workspace.RemoteDir(), "not-enforced-urls.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "https://tjenester.nav.no/testapp/login*\n", string(content))
+
+	err = uploadPolicyFile(sftpClient, filepath.Join(files.Dir, "does-not-exist.xml"),
+		workspace.RemoteDir()+"/does-not-exist.xml", &sftp.FileStat{})
+	assert.Contains(t, err.Error(), "could not open file")
 
-	_, fileErr := os.Stat("/tmp/" + app)
-	assert.Nil(t, fileErr)
+	entries, _ = ioutil.ReadDir(workspace.RemoteDir())
+	assert.Len(t, entries, 2, "no temp file is left behind")
 }
@@ -6,8 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/http/httputil"
 	"os"
+	"strings"
 
 	"github.com/forgerock/frconfig/crest"
 	"github.com/ghodss/yaml"
@@ -41,38 +41,52 @@ type PolicyResultList struct {
 
 // ListPolicy lists all OpenAM policies for a realm
 func ListPolicy(am *AMConnection) ([]Policy, error) {
-
-	client := &http.Client{}
-	req, err := am.createNewRequest("GET", "/json/policies?_queryFilter=true", nil)
+	req, err := am.createNewRequest("GET", am.jsonPath("/policies?_queryFilter=true"), nil)
 	if err != nil {
-		glog.Errorf("Could not create request: %s", err)
+		return nil, fmt.Errorf("could not create request: %s", err)
 	}
 
-	dump, _ := httputil.DumpRequestOut(req, true)
-	glog.Infof("dump req is %s", dump)
-
-	//debug(httputil.DumpResponse(response, true))
-
-	resp, err := client.Do(req)
+	resp, err := am.do(req)
 	if err != nil {
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
-	body, _ := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policies: %s", err)
+	}
 
-	//fmt.Println("response Body:", string(body))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%d policies could not be listed: %s", resp.StatusCode, body)
+	}
 
 	var result PolicyResultList
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("could not unmarshal policies: %s", err)
+	}
 
-	err = json.Unmarshal(body, &result)
+	return result.Result, nil
+}
 
-	if err != nil {
-		glog.Errorf("Could not get result type: %s", err)
+// ApplicationPolicies returns the policies belonging to the application, which are the policies named after the
+// application following the naming convention of the policy files, like <app>_001 or <app>-<rule>
+func ApplicationPolicies(policies []Policy, application string) []Policy {
+	var applicationPolicies []Policy
+	for _, policy := range policies {
+		if belongsToApplication(policy, application) {
+			applicationPolicies = append(applicationPolicies, policy)
+		}
 	}
+	return applicationPolicies
+}
 
-	return result.Result, err
+// belongsToApplication matches the application name up to the separator, so the policies of testapp2 or another
+// team protecting resources below /testapp/ are never claimed by testapp
+func belongsToApplication(policy Policy, application string) bool {
+	name, prefix := strings.ToLower(policy.Name), strings.ToLower(application)
+	return strings.HasPrefix(name, prefix+"_") || strings.HasPrefix(name, prefix+"-")
 }
 
 func policytoYAML(policies []Policy) {
@@ -123,7 +137,7 @@ func (am *AMConnection) ExportXacmlPolicies() (string, error) {
 
 // ExportPolicies exports all the policies as a JSON or YAML policy set string
 func (am *AMConnection) ExportPolicies(format, realm string) (out string, err error) {
-	url := fmt.Sprintf("/json/policies?realm=%s&_queryFilter=true", realm)
+	url := am.jsonPath(fmt.Sprintf("/policies?realm=%s&_queryFilter=true", realm))
 	req, err := am.createNewRequest("GET", url, nil)
 
 	result, err := crest.GetCRESTResult(req)
@@ -210,23 +224,40 @@ func (am *AMConnection) CreatePolicy(p map[string]interface{}, overWrite bool, r
 	}
 	jsn, err := json.Marshal(p)
 	r := bytes.NewReader(jsn)
-	url := fmt.Sprintf("/json%s/policies?_action=create", realm)
+	url := am.policyRealmPath(realm, "/policies?_action=create")
 	req, err := am.createNewRequest("POST", url, r)
 	if err != nil {
 		glog.Errorf("Could not create request: %s", err)
+		return err
 	}
 
-	_, err = crest.GetCRESTResult(req)
+	resp, err := am.do(req)
 	if err != nil {
 		return err
 	}
 
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%d policy %v could not be created: %s", resp.StatusCode, p["name"], body)
+	}
+
 	return
 }
 
+// policyRealmPath returns the path of a policy endpoint in the given realm, or in the realm of the connection if
+// no realm is given
+func (am *AMConnection) policyRealmPath(realm, path string) string {
+	if len(realm) == 0 {
+		return am.jsonPath(path)
+	}
+	return realmJSONPath(realm, path)
+}
+
 // DeletePolicy erases the named policy. If the policy does exist, we do not return an error code
 func (am *AMConnection) DeletePolicy(name, realm string) (err error) {
-	url := fmt.Sprintf("/json%s/policies/%s", realm, name)
+	url := am.policyRealmPath(realm, "/policies/"+name)
 
 	req, err := am.createNewRequest("DELETE", url, nil)
 	if err != nil {
@@ -235,9 +266,7 @@ func (am *AMConnection) DeletePolicy(name, realm string) (err error) {
 
 	//glog.Infof("Delete request %s\n", url)
 
-	client := &http.Client{}
-
-	resp, err := client.Do(req)
+	resp, err := am.do(req)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/nais/named/api/policyfile"
+)
+
+// Ways of importing SBS policy files into AM, selected per cluster
+const (
+	// PolicyImportSSH copies the policy files to the AM host and runs openam_policy.py there
+	PolicyImportSSH = "ssh"
+	// PolicyImportREST converts the policy files to AM JSON policies and creates them through /json/policies
+	PolicyImportREST = "rest"
+)
+
+const (
+	policyFileName           = "app-policies.xml"
+	notEnforcedFileName      = "not-enforced-urls.txt"
+	urlResourceType          = "URL"
+	authenticatedUsers       = "AuthenticatedUsers"
+	authLevelCondition       = "AuthLevelCondition"
+	authLevelAttribute       = "AuthLevel"
+	exclusiveSubject         = "exclusive"
+	allowedActionValue       = "allow"
+	deniedActionValue        = "deny"
+	policyDescriptionPattern = "Imported by named from %s rule %s"
+)
+
+// importPolicies converts the policy files to AM JSON policies and creates them in the realm, replacing existing
+// policies with the same name. Policies of the application no longer in the files are deleted afterwards. The names
+// of the created and deleted policies are returned.
+func importPolicies(am *AMConnection, files []string, application, realm string) (created, deleted []string,
+	err error) {
+	var policyFile string
+	for _, file := range files {
+		switch filepath.Base(file) {
+		case policyFileName:
+			policyFile = file
+		case notEnforcedFileName:
+			if err := checkNotEnforcedURLs(file); err != nil {
+				return nil, nil, err
+			}
+		default:
+			glog.Warningf("Skipping %s, only %s is imported through REST", file, policyFileName)
+		}
+	}
+	if len(policyFile) == 0 {
+		return nil, nil, fmt.Errorf("%s is missing, refusing to import policies", policyFileName)
+	}
+
+	content, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read policy file %s: %s", policyFile, err)
+	}
+
+	resourceTypeUUID, err := am.resourceTypeUUID(urlResourceType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policies, err := ConvertPolicies(content, resourceTypeUUID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not convert policy file %s: %s", policyFile, err)
+	}
+
+	imported := map[string]bool{}
+	for _, policy := range policies {
+		if err := am.CreatePolicy(policy, true, realm); err != nil {
+			return created, nil, fmt.Errorf("could not create policy %s: %s", policy["name"], err)
+		}
+		name := policy["name"].(string)
+		created = append(created, name)
+		imported[name] = true
+	}
+
+	existing, err := ListPolicy(am)
+	if err != nil {
+		return created, nil, fmt.Errorf("could not list policies: %s", err)
+	}
+
+	for _, policy := range ApplicationPolicies(existing, application) {
+		if imported[policy.Name] {
+			continue
+		}
+		if err := am.DeletePolicy(policy.Name, realm); err != nil {
+			return created, deleted, fmt.Errorf("could not delete policy %s: %s", policy.Name, err)
+		}
+		deleted = append(deleted, policy.Name)
+	}
+
+	return created, deleted, nil
+}
+
+// checkNotEnforcedURLs fails if not-enforced-urls.txt lists any URLs. They belong to the agent configuration, which is
+// only updated by openam_policy.py, so importing the policies alone would silently drop them.
+func checkNotEnforcedURLs(file string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %s", file, err)
+	}
+
+	urls, err := policyfile.ParseNotEnforcedURLs(content)
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %s", file, err)
+	}
+
+	if len(urls.Patterns) > 0 {
+		return fmt.Errorf("%s lists %d URLs, which can't be applied through REST import, use the %s policy import "+
+			"or remove the file", notEnforcedFileName, len(urls.Patterns), PolicyImportSSH)
+	}
+	return nil
+}
+
+// resourceTypeUUID returns the uuid of the AM resource type with the given name
+func (am *AMConnection) resourceTypeUUID(name string) (string, error) {
+	resourceTypes, err := am.ListResourceTypes()
+	if err != nil {
+		return "", fmt.Errorf("could not list resource types: %s", err)
+	}
+
+	for _, resourceType := range resourceTypes {
+		if resourceType.Name == name {
+			return resourceType.UUID, nil
+		}
+	}
+
+	return "", fmt.Errorf("resource type %s not found in AM", name)
+}
+
+// ConvertPolicies converts a legacy OpenSSO policy file to AM JSON policies, one for each rule of each policy. The
+// subjects and conditions of a policy apply to all its rules.
+func ConvertPolicies(content []byte, resourceTypeUUID string) ([]map[string]interface{}, error) {
+	policies, err := policyfile.Parse(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var converted []map[string]interface{}
+	for _, policy := range policies.Policies {
+		subject, err := convertSubjects(policy)
+		if err != nil {
+			return nil, err
+		}
+
+		condition, err := convertConditions(policy)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rule := range policy.Rules {
+			actions, err := convertActions(policy, rule)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(rule.ResourceNames) == 0 {
+				return nil, fmt.Errorf("rule %s of policy %s has no ResourceName", rule.Name, policy.Name)
+			}
+
+			resources := []string{}
+			for _, resourceName := range rule.ResourceNames {
+				resources = append(resources, resourceName.Name)
+			}
+
+			amPolicy := map[string]interface{}{
+				"name":             fmt.Sprintf("%s-%s", policy.Name, rule.Name),
+				"active":           policy.Active != "false",
+				"description":      fmt.Sprintf(policyDescriptionPattern, policy.Name, rule.Name),
+				"applicationName":  rule.ServiceName.Name,
+				"resourceTypeUuid": resourceTypeUUID,
+				"resources":        resources,
+				"actionValues":     actions,
+				"subject":          subject,
+			}
+			if condition != nil {
+				amPolicy["condition"] = condition
+			}
+
+			converted = append(converted, amPolicy)
+		}
+	}
+
+	return converted, nil
+}
+
+func convertActions(policy policyfile.Policy, rule policyfile.Rule) (map[string]bool, error) {
+	actions := map[string]bool{}
+	for _, pair := range rule.AttributeValuePairs {
+		if len(pair.Values) != 1 {
+			return nil, fmt.Errorf("action %s of rule %s in policy %s must have one value", pair.Attribute,
+				rule.Name, policy.Name)
+		}
+
+		switch pair.Values[0] {
+		case allowedActionValue:
+			actions[pair.Attribute] = true
+		case deniedActionValue:
+			actions[pair.Attribute] = false
+		default:
+			return nil, fmt.Errorf("action %s of rule %s in policy %s must be allow or deny, not %s",
+				pair.Attribute, rule.Name, policy.Name, pair.Values[0])
+		}
+	}
+	return actions, nil
+}
+
+func convertSubjects(policy policyfile.Policy) (map[string]interface{}, error) {
+	var subjects []interface{}
+	if policy.Subjects != nil {
+		for _, s := range policy.Subjects.Subjects {
+			if s.Type != authenticatedUsers {
+				return nil, fmt.Errorf("subject type %s in policy %s is not supported", s.Type, policy.Name)
+			}
+
+			var subject interface{} = map[string]interface{}{"type": authenticatedUsers}
+			if s.IncludeType == exclusiveSubject {
+				subject = map[string]interface{}{"type": "NOT", "subject": subject}
+			}
+			subjects = append(subjects, subject)
+		}
+	}
+
+	switch len(subjects) {
+	case 0:
+		return nil, fmt.Errorf("policy %s has no subjects", policy.Name)
+	case 1:
+		return subjects[0].(map[string]interface{}), nil
+	default:
+		return map[string]interface{}{"type": "OR", "subjects": subjects}, nil
+	}
+}
+
+func convertConditions(policy policyfile.Policy) (map[string]interface{}, error) {
+	var conditions []interface{}
+	if policy.Conditions != nil {
+		for _, c := range policy.Conditions.Conditions {
+			if c.Type != authLevelCondition {
+				return nil, fmt.Errorf("condition type %s in policy %s is not supported", c.Type, policy.Name)
+			}
+
+			for _, pair := range c.AttributeValuePairs {
+				if pair.Attribute != authLevelAttribute || len(pair.Values) != 1 {
+					return nil, fmt.Errorf("condition %s in policy %s must have a single AuthLevel", c.Name,
+						policy.Name)
+				}
+
+				level, err := strconv.Atoi(pair.Values[0])
+				if err != nil {
+					return nil, fmt.Errorf("condition %s in policy %s has invalid AuthLevel %s", c.Name, policy.Name,
+						pair.Values[0])
+				}
+				conditions = append(conditions, map[string]interface{}{"type": "AuthLevel", "authLevel": level})
+			}
+		}
+	}
+
+	switch len(conditions) {
+	case 0:
+		return nil, nil
+	case 1:
+		return conditions[0].(map[string]interface{}), nil
+	default:
+		return map[string]interface{}{"type": "AND", "conditions": conditions}, nil
+	}
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertPolicies(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/app-policies.xml")
+	assert.NoError(t, err)
+
+	policies, err := ConvertPolicies(content, "url-uuid")
+	assert.NoError(t, err)
+	assert.Len(t, policies, 4)
+
+	policy := policies[0]
+	assert.Equal(t, "Draco_001-rule_Draco_001_01", policy["name"])
+	assert.Equal(t, true, policy["active"])
+	assert.Equal(t, "iPlanetAMWebAgentService", policy["applicationName"])
+	assert.Equal(t, "url-uuid", policy["resourceTypeUuid"])
+	assert.Equal(t, []string{"https://tjenester-u653.nav.no/draco/*"}, policy["resources"])
+	assert.Equal(t, map[string]bool{"GET": true, "POST": true}, policy["actionValues"])
+	assert.Equal(t, map[string]interface{}{"type": "AuthenticatedUsers"}, policy["subject"])
+	assert.Equal(t, map[string]interface{}{"type": "AuthLevel", "authLevel": 3}, policy["condition"])
+}
+
+func TestConvertPoliciesWithUnsupportedCondition(t *testing.T) {
+	content := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Policies>
+	<Policy name="Testapp_001" active="true">
+		<Rule name="rule_Testapp_001_01">
+			<ServiceName name="iPlanetAMWebAgentService" />
+			<ResourceName name="https://tjenester.nav.no/testapp/*" />
+		</Rule>
+		<Subjects>
+			<Subject name="subject_Testapp_001_01" type="AuthenticatedUsers" includeType="inclusive" />
+		</Subjects>
+		<Conditions>
+			<Condition name="condition_Testapp_001_01" type="IPCondition" />
+		</Conditions>
+	</Policy>
+</Policies>`)
+
+	_, err := ConvertPolicies(content, "url-uuid")
+	assert.EqualError(t, err, "condition type IPCondition in policy Testapp_001 is not supported")
+}
+
+func TestResourceTypeUUID(t *testing.T) {
+	defer gock.Off()
+
+	gock.New(baseURL).
+		Get("/json/resourcetypes").
+		Times(2).
+		Reply(200).
+		File("testdata/amResourceTypes.json")
+
+	uuid, err := amc.resourceTypeUUID("OAuth2")
+	assert.NoError(t, err)
+	assert.Equal(t, "bbf6879e-b0ee-4e5f-9878-3333942e1438", uuid)
+
+	_, err = amc.resourceTypeUUID(urlResourceType)
+	assert.EqualError(t, err, "resource type URL not found in AM")
+}
+
+func TestImportPolicies(t *testing.T) {
+	defer gock.Off()
+
+	am := &AMConnection{BaseURL: baseURL, Realm: "/team", tokenID: "token"}
+
+	gock.New(baseURL).
+		Get("/json/team/resourcetypes").
+		Reply(200).
+		BodyString(`{"result": [{"uuid": "url-uuid", "name": "URL"}]}`)
+
+	gock.New(baseURL).
+		Delete("/json/team/policies/Draco_001-rule_Draco_001_0[1-4]").
+		Times(4).
+		Reply(404)
+
+	gock.New(baseURL).
+		Post("/json/team/policies").
+		MatchParam("_action", "create").
+		Times(4).
+		Reply(201)
+
+	gock.New(baseURL).
+		Get("/json/team/policies").
+		MatchParam("_queryFilter", "true").
+		Reply(200).
+		BodyString(`{"result": [{"name": "Draco_001-rule_Draco_001_01"}, {"name": "Draco_002-rule_Draco_002_01"},
+			{"name": "Dracoen_001-rule_Dracoen_001_01"}, {"name": "OAuth2ProviderPolicy"}], "resultCount": 4}`)
+
+	gock.New(baseURL).
+		Delete("/json/team/policies/Draco_002-rule_Draco_002_01").
+		Reply(200)
+
+	created, deleted, err := importPolicies(am, []string{"testdata/app-policies.xml"}, "draco", "/team")
+	assert.NoError(t, err)
+	assert.Len(t, created, 4)
+	assert.Equal(t, []string{"Draco_002-rule_Draco_002_01"}, deleted)
+	assert.True(t, gock.IsDone())
+}
+
+func TestImportPoliciesFailsWhenListingIsRejected(t *testing.T) {
+	defer gock.Off()
+
+	am := &AMConnection{BaseURL: baseURL, Realm: "/team", tokenID: "token"}
+
+	gock.New(baseURL).
+		Get("/json/team/resourcetypes").
+		Reply(200).
+		BodyString(`{"result": [{"uuid": "url-uuid", "name": "URL"}]}`)
+
+	gock.New(baseURL).
+		Delete("/json/team/policies/Draco_001-rule_Draco_001_0[1-4]").
+		Times(4).
+		Reply(404)
+
+	gock.New(baseURL).
+		Post("/json/team/policies").
+		MatchParam("_action", "create").
+		Times(4).
+		Reply(201)
+
+	gock.New(baseURL).
+		Get("/json/team/policies").
+		MatchParam("_queryFilter", "true").
+		Times(2).
+		Reply(401).
+		BodyString(`{"code": 401, "reason": "Unauthorized"}`)
+
+	gock.New(baseURL).
+		Post("/json/team/authenticate").
+		Reply(200).
+		BodyString(`{"tokenId": "newtoken"}`)
+
+	_, deleted, err := importPolicies(am, []string{"testdata/app-policies.xml"}, "draco", "/team")
+	assert.EqualError(t, err,
+		`could not list policies: 401 policies could not be listed: {"code": 401, "reason": "Unauthorized"}`)
+	assert.Empty(t, deleted)
+	assert.True(t, gock.IsDone())
+}
+
+func TestImportPoliciesRejectsNotEnforcedURLs(t *testing.T) {
+	defer gock.Off()
+
+	am := &AMConnection{BaseURL: baseURL, tokenID: "token"}
+
+	_, _, err := importPolicies(am, []string{"testdata/app-policies.xml", "testdata/not-enforced-urls.txt"}, "draco",
+		"")
+	assert.EqualError(t, err, "not-enforced-urls.txt lists 1 URLs, which can't be applied through REST import, "+
+		"use the ssh policy import or remove the file")
+}
+
+func TestImportSBSOpenam(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\", \"realm\": \"/fasit\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"importer\"}}")
+
+	gock.New(baseURL).
+		Post("/json/import/authenticate").
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/import/resourcetypes").
+		Reply(200).
+		BodyString(`{"result": [{"uuid": "url-uuid", "name": "URL"}]}`)
+
+	gock.New(baseURL).
+		Delete("/json/import/policies/Testapp_001-rule_Testapp_001_01").
+		Reply(404)
+
+	gock.New(baseURL).
+		Post("/json/import/policies").
+		MatchParam("_action", "create").
+		Reply(201)
+
+	gock.New(baseURL).
+		Get("/json/import/policies").
+		MatchParam("_queryFilter", "true").
+		Reply(200).
+		BodyString(`{"result": [{"name": "Testapp_001-rule_Testapp_001_01"}], "resultCount": 1}`)
+
+	request := &NamedConfigurationRequest{Application: "testapp", Environment: "t0", Realm: "/import",
+		PolicyFiles: map[string][]byte{policyFileName: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Policies>
+	<Policy name="Testapp_001" active="true">
+		<Rule name="rule_Testapp_001_01">
+			<ServiceName name="iPlanetAMWebAgentService" />
+			<ResourceName name="https://${DomainName}/testapp/*" />
+		</Rule>
+		<Subjects>
+			<Subject name="subject_Testapp_001_01" type="AuthenticatedUsers" includeType="inclusive" />
+		</Subjects>
+	</Policy>
+</Policies>`)}}
+
+	appErr := importSBSOpenam(nil, &FasitClient{"https://fasit.local", "user", "pass"}, request, ZoneSbs)
+	assert.Nil(t, appErr)
+	assert.True(t, gock.IsDone())
+}
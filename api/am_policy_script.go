@@ -0,0 +1,209 @@
+package api
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxScriptOutput is how much of stdout and stderr of the policy script is kept, the end being kept as that is
+	// where errors are
+	maxScriptOutput = 32 << 10
+	// exitStatusUnknown is reported when the script did not run or the AM host did not send an exit status
+	exitStatusUnknown = -1
+)
+
+// ScriptResult is what the policy script on the AM host printed, how it exited, and the known failures found in its
+// output
+type ScriptResult struct {
+	Command    string          `json:"command"`
+	ExitStatus int             `json:"exitStatus"`
+	Stdout     string          `json:"stdout"`
+	Stderr     string          `json:"stderr,omitempty"`
+	Truncated  bool            `json:"truncated,omitempty"`
+	Failures   []ScriptFailure `json:"failures,omitempty"`
+}
+
+// ScriptFailure is a known failure of openam_policy.py, with a hint on how to fix it
+type ScriptFailure struct {
+	Code    string `json:"code"`
+	Line    string `json:"line"`
+	Hint    string `json:"hint"`
+	pattern *regexp.Regexp
+}
+
+// Codes of the known failures of openam_policy.py
+const (
+	ScriptFailureMissingFile     = "policy-file-missing"
+	ScriptFailureInvalidXML      = "invalid-policy-xml"
+	ScriptFailurePolicyExists    = "policy-exists"
+	ScriptFailureUnknownRealm    = "unknown-realm"
+	ScriptFailureAuthentication  = "am-authentication-failed"
+	ScriptFailureAMUnreachable   = "am-unreachable"
+	ScriptFailureSudo            = "sudo-denied"
+	ScriptFailureScriptException = "script-exception"
+)
+
+// scriptFailures are matched against every line of the output, in this order
+var scriptFailures = []ScriptFailure{
+	{
+		Code:    ScriptFailureMissingFile,
+		Hint:    "the policy files did not reach the AM host, try again or ask the platform team",
+		pattern: regexp.MustCompile(`(?i)(no such file or directory|cannot open|not found).*(app-policies\.xml|not-enforced-urls\.txt)`),
+	},
+	{
+		Code:    ScriptFailureInvalidXML,
+		Hint:    "app-policies.xml is not accepted by AM, check it with named validate",
+		pattern: regexp.MustCompile(`(?i)(ParseError|not well-formed|XML.*(error|invalid)|invalid.*XML)`),
+	},
+	{
+		Code:    ScriptFailurePolicyExists,
+		Hint:    "a policy or rule with the same name exists for another application, rename yours",
+		pattern: regexp.MustCompile(`(?i)(policy|rule).*already exists`),
+	},
+	{
+		Code:    ScriptFailureUnknownRealm,
+		Hint:    "the realm does not exist in AM, check --realm or the realm of the OpenIdConnect resource in Fasit",
+		pattern: regexp.MustCompile(`(?i)(realm.*(not found|does not exist|invalid)|(unknown|invalid) realm)`),
+	},
+	{
+		Code:    ScriptFailureAuthentication,
+		Hint:    "the script could not log in to AM, ask the platform team to check the AM admin user",
+		pattern: regexp.MustCompile(`(?i)(authentication failed|invalid credentials|401 unauthorized)`),
+	},
+	{
+		Code:    ScriptFailureAMUnreachable,
+		Hint:    "the script could not reach AM, try again later",
+		pattern: regexp.MustCompile(`(?i)(connection refused|connection timed out|name or service not known)`),
+	},
+	{
+		Code:    ScriptFailureSudo,
+		Hint:    "the AM host user is not allowed to run the script, ask the platform team",
+		pattern: regexp.MustCompile(`(?i)^sudo:`),
+	},
+	{
+		Code:    ScriptFailureScriptException,
+		Hint:    "the script crashed, ask the platform team with the output",
+		pattern: regexp.MustCompile(`^[A-Za-z_.]*(Error|Exception): `),
+	},
+}
+
+// tailBuffer keeps the last bytes written to it
+type tailBuffer struct {
+	limit     int
+	data      []byte
+	truncated bool
+	mutex     sync.Mutex
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = append([]byte{}, b.data[len(b.data)-b.limit:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return string(b.data)
+}
+
+// Error describes how the script failed, with the codes of the known failures
+func (r *ScriptResult) Error() string {
+	message := fmt.Sprintf("%s exited with status %d", r.Command, r.ExitStatus)
+	if len(r.Failures) > 0 {
+		var codes []string
+		for _, failure := range r.Failures {
+			codes = append(codes, failure.Code)
+		}
+		message += " (" + strings.Join(codes, ", ") + ")"
+	}
+	return message
+}
+
+// amPolicyScriptCommand runs the policy script on the policy files in the workspace, named relative to /tmp
+func amPolicyScriptCommand(application string, workspace *Workspace) string {
+	return fmt.Sprintf("sudo python /opt/openam/scripts/openam_policy.py %s %s", application, workspace.Name)
+}
+
+// runAmPolicyScript runs the policy script and returns its result, which is also the error if the script failed
+func runAmPolicyScript(request *NamedConfigurationRequest, workspace *Workspace, sshSession *ssh.Session) (*ScriptResult,
+	error) {
+	cmd := amPolicyScriptCommand(request.Application, workspace)
+
+	modes := ssh.TerminalModes{
+		ssh.ECHO: 0, // Disable echoing
+	}
+
+	// with a pty, which sudo may require, stderr of the script is sent on stdout
+	if err := sshSession.RequestPty("xterm", 80, 40, modes); err != nil {
+		glog.Infof("Could not set pty")
+	}
+
+	stdout := &tailBuffer{limit: maxScriptOutput}
+	stderr := &tailBuffer{limit: maxScriptOutput}
+	sshSession.Stdout = stdout
+	sshSession.Stderr = stderr
+
+	glog.Infof("Running command %s", cmd)
+	err := sshSession.Run(cmd)
+
+	result := &ScriptResult{
+		Command:    cmd,
+		ExitStatus: 0,
+		Stdout:     stdout.String(),
+		Stderr:     stderr.String(),
+		Truncated:  stdout.truncated || stderr.truncated,
+	}
+	result.Failures = parseScriptFailures(result.Stdout + "\n" + result.Stderr)
+
+	if err != nil {
+		result.ExitStatus = exitStatusUnknown
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			result.ExitStatus = exitErr.ExitStatus()
+		}
+		glog.Errorf("Command %s failed: %s\nstdout:\n%s\nstderr:\n%s", cmd, err, result.Stdout, result.Stderr)
+
+		if result.ExitStatus == exitStatusUnknown {
+			return result, fmt.Errorf("could not run command %s %s", cmd, err)
+		}
+		return result, result
+	}
+
+	glog.Infof("AM policy updated for %s in environment %s, output:\n%s", request.Application,
+		request.Environment, result.Stdout)
+	return result, nil
+}
+
+// parseScriptFailures finds the known failures in the output, each code once, at the first line it matches
+func parseScriptFailures(output string) []ScriptFailure {
+	var failures []ScriptFailure
+	found := map[string]bool{}
+
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		for _, failure := range scriptFailures {
+			if found[failure.Code] || !failure.pattern.MatchString(line) {
+				continue
+			}
+
+			found[failure.Code] = true
+			failures = append(failures, ScriptFailure{Code: failure.Code, Line: line, Hint: failure.Hint})
+			break
+		}
+	}
+
+	return failures
+}
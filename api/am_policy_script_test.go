@@ -0,0 +1,79 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScriptFailures(t *testing.T) {
+	output := `Importing policies for testapp
+Traceback (most recent call last):
+  File "/opt/openam/scripts/openam_policy.py", line 42, in <module>
+xml.etree.ElementTree.ParseError: not well-formed (invalid token): line 12, column 4
+Policy testapp-policy already exists`
+
+	failures := parseScriptFailures(output)
+	assert.Len(t, failures, 2)
+	assert.Equal(t, ScriptFailureInvalidXML, failures[0].Code)
+	assert.Equal(t, "xml.etree.ElementTree.ParseError: not well-formed (invalid token): line 12, column 4",
+		failures[0].Line)
+	assert.Equal(t, ScriptFailurePolicyExists, failures[1].Code)
+	assert.Equal(t, ScriptFailureScriptException, parseScriptFailures("KeyError: 'realm'")[0].Code)
+	assert.Empty(t, parseScriptFailures("Policies imported"))
+}
+
+func TestTailBuffer(t *testing.T) {
+	buffer := &tailBuffer{limit: 5}
+	fmt.Fprint(buffer, "abc")
+	assert.False(t, buffer.truncated)
+
+	fmt.Fprint(buffer, "defg")
+	assert.True(t, buffer.truncated)
+	assert.Equal(t, "cdefg", buffer.String())
+}
+
+func TestRunAmPolicyScript(t *testing.T) {
+	_, port, listener := startSSHServer(t, func(command string, stdout, stderr io.Writer) uint32 {
+		if strings.Contains(command, "failingapp") {
+			fmt.Fprintln(stdout, "Importing policies for failingapp")
+			fmt.Fprintln(stderr, "ERROR: realm /failing does not exist")
+			return 2
+		}
+		fmt.Fprintln(stdout, strings.Repeat("x", maxScriptOutput)+"\nPolicies imported")
+		return 0
+	})
+	defer listener.Close()
+	defer SetSSHSettings(sshSettings)
+	SetSSHSettings(SSHSettings{InsecureIgnoreHostKey: true, DialTimeout: time.Second, HandshakeTimeout: time.Second})
+
+	resource := &OpenAmResource{Hostname: "127.0.0.1", Username: "user", Password: "pass"}
+	workspace := &Workspace{Name: "named-testapp-123"}
+
+	client, session, err := SSHConnect(resource, port)
+	assert.NoError(t, err)
+	result, err := runAmPolicyScript(&NamedConfigurationRequest{Application: "testapp"}, workspace, session)
+	client.Close()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ExitStatus)
+	assert.True(t, result.Truncated)
+	assert.Len(t, result.Stdout, maxScriptOutput)
+	assert.True(t, strings.HasSuffix(result.Stdout, "Policies imported\n"))
+
+	client, session, err = SSHConnect(resource, port)
+	assert.NoError(t, err)
+	result, err = runAmPolicyScript(&NamedConfigurationRequest{Application: "failingapp"}, workspace, session)
+	client.Close()
+
+	assert.EqualError(t, err, "sudo python /opt/openam/scripts/openam_policy.py failingapp named-testapp-123 exited "+
+		"with status 2 (unknown-realm)")
+	assert.Equal(t, 2, result.ExitStatus)
+	assert.Equal(t, "Importing policies for failingapp\n", result.Stdout)
+	assert.Equal(t, "ERROR: realm /failing does not exist\n", result.Stderr)
+	assert.Equal(t, ScriptFailureUnknownRealm, result.Failures[0].Code)
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 
 	"github.com/forgerock/frconfig/crest"
 	"github.com/golang/glog"
@@ -43,6 +42,7 @@ func createObjects(obj *crest.FRObject, overwrite, continueOnError bool) (err er
 	if err != nil {
 		return err
 	}
+	defer am.Release()
 
 	switch obj.Kind {
 	case POLICY:
@@ -56,14 +56,13 @@ func createObjects(obj *crest.FRObject, overwrite, continueOnError bool) (err er
 
 // ListResourceTypes returns the available resource types from the AM server
 func (am *AMConnection) ListResourceTypes() ([]ResourceType, error) {
-	client := &http.Client{}
-	request, err := am.createNewRequest("GET", "/json/resourcetypes?_queryFilter=true", nil)
+	request, err := am.createNewRequest("GET", am.jsonPath("/resourcetypes?_queryFilter=true"), nil)
 	//dump, err := httputil.DumpRequestOut(request, true)
 	if err != nil {
 		glog.Errorf("Failed to create request: %s", err)
 	}
 
-	response, err := client.Do(request)
+	response, err := am.do(request)
 	if err != nil {
 		glog.Errorf("Could not execute request: %s", err)
 	}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const defaultAMSessionIdle = 10 * time.Minute
+
+var (
+	amSessionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "am_sessions", Help: "AM admin sessions pr event"}, []string{"event"},
+	)
+	amSessions = NewAMSessions(defaultAMSessionIdle)
+)
+
+func init() {
+	prometheus.MustRegister(amSessionsCounter)
+}
+
+// AMSessions caches authenticated AM admin connections by AM base url, realm and admin user, so the same session is reused
+// instead of leaving a new one behind on every call. Sessions are counted while jobs use them, and are only logged out
+// once no job uses them any more.
+type AMSessions struct {
+	sessions map[string]*amSession
+	maxIdle  time.Duration
+	mutex    sync.Mutex
+}
+
+type amSession struct {
+	cache      *AMSessions
+	connection *AMConnection
+	lastUsed   time.Time
+	// users is the number of callers holding the connection, until they release it
+	users int
+	// retired sessions are no longer cached, and are logged out when their last user releases them
+	retired bool
+}
+
+// NewAMSessions creates a session cache where sessions unused for maxIdle are logged out
+func NewAMSessions(maxIdle time.Duration) *AMSessions {
+	return &AMSessions{
+		sessions: map[string]*amSession{},
+		maxIdle:  maxIdle,
+	}
+}
+
+// StartAMSessions sets how long unused AM sessions are kept, and starts logging out the ones unused for longer
+func StartAMSessions(maxIdle time.Duration) {
+	amSessions.mutex.Lock()
+	amSessions.maxIdle = maxIdle
+	amSessions.mutex.Unlock()
+
+	go func() {
+		for range time.Tick(maxIdle / 2) {
+			amSessions.evictIdle()
+		}
+	}()
+}
+
+// CloseAMSessions logs out all cached AM sessions
+func CloseAMSessions() {
+	amSessions.Close()
+}
+
+// Get returns a valid session for the AM server, realm and admin user, authenticating when there is no cached session or
+// the cached one is no longer valid. The connection has to be released when the caller is done with it. AM is only
+// called without holding the lock, so jobs using other sessions are never held up.
+func (sessions *AMSessions) Get(url, realm, username, password string) (*AMConnection, error) {
+	sessions.evictIdle()
+
+	key := url + "|" + normalizeRealm(realm) + "|" + username
+
+	sessions.mutex.Lock()
+	session, ok := sessions.sessions[key]
+	var stale *AMConnection
+	if ok && session.connection.Password != password {
+		stale = sessions.retire(key, session)
+		ok = false
+	}
+	if ok {
+		session.users++
+	}
+	sessions.mutex.Unlock()
+
+	if stale != nil {
+		stale.logout()
+	}
+
+	if ok {
+		valid, err := session.connection.validateSession()
+		if err == nil && valid {
+			amSessionsCounter.WithLabelValues("reused").Inc()
+			return session.connection, nil
+		}
+
+		if err != nil {
+			glog.Warningf("Could not validate AM session for %s at %s: %s", username, url, err)
+		} else {
+			amSessionsCounter.WithLabelValues("expired").Inc()
+		}
+
+		sessions.mutex.Lock()
+		sessions.retire(key, session)
+		sessions.mutex.Unlock()
+		session.connection.Release()
+	}
+
+	am, err := openAdminConnection(url, realm, username, password)
+	if err != nil {
+		return am, err
+	}
+	amSessionsCounter.WithLabelValues("created").Inc()
+
+	created := &amSession{cache: sessions, connection: am, lastUsed: time.Now(), users: 1}
+	am.session = created
+
+	sessions.mutex.Lock()
+	// another caller may have logged in concurrently, its session is replaced
+	if current, ok := sessions.sessions[key]; ok {
+		stale = sessions.retire(key, current)
+	}
+	sessions.sessions[key] = created
+	sessions.mutex.Unlock()
+
+	if stale != nil {
+		stale.logout()
+	}
+
+	return am, nil
+}
+
+// release is called when a user of the session is done with it
+func (sessions *AMSessions) release(session *amSession) {
+	sessions.mutex.Lock()
+	session.users--
+	session.lastUsed = time.Now()
+	logout := session.retired && session.users == 0
+	sessions.mutex.Unlock()
+
+	if logout {
+		session.connection.logout()
+	}
+}
+
+// retire removes the session from the cache, and returns its connection if it is unused and can be logged out.
+// Callers must hold the lock.
+func (sessions *AMSessions) retire(key string, session *amSession) *AMConnection {
+	if sessions.sessions[key] == session {
+		delete(sessions.sessions, key)
+	}
+	session.retired = true
+
+	if session.users > 0 {
+		return nil
+	}
+	return session.connection
+}
+
+// Close logs out all cached sessions. Sessions in use are logged out when they are released.
+func (sessions *AMSessions) Close() {
+	sessions.mutex.Lock()
+	var unused []*AMConnection
+	for key, session := range sessions.sessions {
+		if connection := sessions.retire(key, session); connection != nil {
+			unused = append(unused, connection)
+		}
+	}
+	sessions.mutex.Unlock()
+
+	for _, connection := range unused {
+		connection.logout()
+	}
+}
+
+// evictIdle logs out the sessions not in use and unused for longer than maxIdle
+func (sessions *AMSessions) evictIdle() {
+	sessions.mutex.Lock()
+	var idle []*AMConnection
+	for key, session := range sessions.sessions {
+		if session.users == 0 && time.Since(session.lastUsed) > sessions.maxIdle {
+			amSessionsCounter.WithLabelValues("evicted").Inc()
+			idle = append(idle, sessions.retire(key, session))
+		}
+	}
+	sessions.mutex.Unlock()
+
+	for _, connection := range idle {
+		connection.logout()
+	}
+}
+
+// Release tells the session cache that the caller is done with the connection
+func (am *AMConnection) Release() {
+	if am == nil || am.session == nil {
+		return
+	}
+	am.session.cache.release(am.session)
+}
+
+// validateSession asks AM whether the token of the connection is still valid
+func (am *AMConnection) validateSession() (bool, error) {
+	payload, err := json.Marshal(map[string]string{"tokenId": am.token()})
+	if err != nil {
+		return false, err
+	}
+
+	request, err := am.createNewRequest(http.MethodPost, am.jsonPath("/sessions?_action=validate"),
+		bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return false, fmt.Errorf("could not execute request: %s", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return false, nil
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%d session could not be validated: %s", response.StatusCode, body)
+	}
+
+	var validation struct {
+		Valid bool `json:"valid"`
+	}
+	if err := json.Unmarshal(body, &validation); err != nil {
+		return false, fmt.Errorf("could not unmarshal session validation: %s", err)
+	}
+
+	return validation.Valid, nil
+}
+
+// logout invalidates the session of the connection in AM. Failures are only logged, as the session expires in AM
+// anyway.
+func (am *AMConnection) logout() {
+	request, err := am.createNewRequest(http.MethodPost, am.jsonPath("/sessions/?_action=logout"), nil)
+	if err != nil {
+		glog.Warningf("Could not log out of AM session for %s: %s", am.User, err)
+		return
+	}
+	request.Header.Set("iPlanetDirectoryPro", am.token())
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		glog.Warningf("Could not log out of AM session for %s: %s", am.User, err)
+		return
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusUnauthorized {
+		glog.Warningf("Could not log out of AM session for %s: %s", am.User, response.Status)
+		return
+	}
+
+	amSessionsCounter.WithLabelValues("logged_out").Inc()
+}
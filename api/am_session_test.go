@@ -0,0 +1,187 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+const sessionURL = "https://sessions.domain.com"
+
+func TestSessionIsReused(t *testing.T) {
+	sessions := NewAMSessions(time.Minute)
+
+	defer gock.Off()
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Times(1).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(sessionURL).
+		Post("/json/sessions").
+		MatchParam("_action", "validate").
+		BodyString("{\"tokenId\":\"token\"}").
+		Reply(200).BodyString("{\"valid\": true}")
+
+	first, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+	first.Release()
+	second, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+	second.Release()
+
+	assert.True(t, first == second)
+	assert.True(t, gock.IsDone())
+}
+
+func TestInvalidSessionIsReplaced(t *testing.T) {
+	sessions := NewAMSessions(time.Minute)
+
+	defer gock.Off()
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(sessionURL).
+		Post("/json/sessions").
+		MatchParam("_action", "validate").
+		Reply(401)
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"newtoken\"}")
+
+	first, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+	first.Release()
+	am, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+	am.Release()
+
+	assert.Equal(t, "newtoken", am.tokenID)
+	assert.True(t, gock.IsDone())
+}
+
+func TestIdleSessionsAreLoggedOut(t *testing.T) {
+	sessions := NewAMSessions(time.Minute)
+
+	defer gock.Off()
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(sessionURL).
+		Post("/json/sessions/").
+		MatchParam("_action", "logout").
+		MatchHeader("iPlanetDirectoryPro", "token").
+		Reply(200)
+
+	am, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+
+	sessions.sessions[sessionURL+"||admin"].lastUsed = time.Now().Add(-2 * time.Minute)
+	sessions.evictIdle()
+	assert.Len(t, sessions.sessions, 1, "sessions in use are kept")
+
+	am.Release()
+	sessions.sessions[sessionURL+"||admin"].lastUsed = time.Now().Add(-2 * time.Minute)
+	sessions.evictIdle()
+
+	assert.Empty(t, sessions.sessions)
+	assert.True(t, gock.IsDone())
+}
+
+func TestCloseLogsOutSessions(t *testing.T) {
+	sessions := NewAMSessions(time.Minute)
+
+	defer gock.Off()
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(sessionURL).
+		Post("/json/sessions/").
+		MatchParam("_action", "logout").
+		Reply(200)
+
+	am, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+
+	sessions.Close()
+	assert.Empty(t, sessions.sessions)
+	assert.False(t, gock.IsDone(), "sessions in use are logged out when released")
+
+	am.Release()
+	assert.True(t, gock.IsDone())
+}
+
+func TestUnauthorizedRequestLogsInAgain(t *testing.T) {
+	sessions := NewAMSessions(time.Minute)
+
+	defer gock.Off()
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(sessionURL).
+		Get("/json/agents/testAgent").
+		MatchHeader("nav-isso", "^token$").
+		Reply(401)
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"newtoken\"}")
+
+	gock.New(sessionURL).
+		Get("/json/agents/testAgent").
+		MatchHeader("nav-isso", "^newtoken$").
+		Reply(200).BodyString("{\"agenttype\": \"OAuth2Client\"}")
+
+	am, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+	defer am.Release()
+
+	agent, err := am.GetAgent("testAgent")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"OAuth2Client"}, agent.Values("agenttype"))
+	assert.Equal(t, "newtoken", am.token())
+	assert.True(t, gock.IsDone())
+}
+
+func TestUnauthorizedRequestWithBodyIsRetried(t *testing.T) {
+	sessions := NewAMSessions(time.Minute)
+
+	defer gock.Off()
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(sessionURL).
+		Put("/json/agents/testAgent").
+		Reply(401)
+
+	gock.New(sessionURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"newtoken\"}")
+
+	gock.New(sessionURL).
+		Put("/json/agents/testAgent").
+		MatchHeader("nav-isso", "^newtoken$").
+		BodyString(`{"agenttype":"OAuth2Client"}`).
+		Reply(200)
+
+	am, err := sessions.Get(sessionURL, "", "admin", "pass")
+	assert.NoError(t, err)
+	defer am.Release()
+
+	assert.NoError(t, am.putAgent("testAgent", Agent{"agenttype": "OAuth2Client"}))
+	assert.True(t, gock.IsDone())
+}
@@ -1,13 +1,16 @@
 package api
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
@@ -16,24 +19,30 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"goji.io"
 	"goji.io/pat"
-	"golang.org/x/crypto/ssh"
 	//"github.com/forgerock/frconfig/amconfig"
 )
 
 // API contains fasit instance and cluster to fetch AM information from
 type API struct {
-	FasitURL    string
-	ClusterName string
+	FasitURL        string
+	ClusterName     string
+	Jobs            *JobPool
+	SBSPolicyImport string
 }
 
-// NamedConfigurationRequest contains the information of the application to configure in AM
+// NamedConfigurationRequest contains the information of the application to configure in AM. PolicyFiles are SBS
+// policy files uploaded with the request by file name, base64 encoded in JSON, used instead of the raw repository.
 type NamedConfigurationRequest struct {
-	Application     string   `json:"application"`
-	Version         string   `json:"version"`
-	Environment     string   `json:"environment"`
-	Username        string   `json:"username"`
-	Password        string   `json:"password"`
-	ContextRoots    []string `json:"contextroots"`
+	Application     string            `json:"application"`
+	Version         string            `json:"version"`
+	Environment     string            `json:"environment"`
+	Username        string            `json:"username"`
+	Password        string            `json:"password"`
+	ContextRoots    []string          `json:"contextroots"`
+	Recreate        bool              `json:"recreate,omitempty"`
+	OAuth2          *OAuth2Settings   `json:"oauth2,omitempty"`
+	Realm           string            `json:"realm,omitempty"`
+	PolicyFiles     map[string][]byte `json:"policyFiles,omitempty"`
 	RedirectionUris []string
 }
 
@@ -56,14 +65,33 @@ const (
 	clusterProdFss    = "prod-fss"
 )
 
-// NewAPI initializes fasit instance information
-func NewAPI(fasitURL, clusterName string) *API {
+const (
+	// maxUploadSize limits the size of configuration requests, JSON or multipart
+	maxUploadSize = 10 << 20
+	// policyFilesField is the multipart field carrying uploaded policy files
+	policyFilesField = "policyFiles"
+	// requestField is the multipart field carrying the configuration request as JSON
+	requestField = "request"
+)
+
+var validRealm = regexp.MustCompile(`^/?[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*/?$`)
+
+// NewAPI initializes fasit instance information, the pool running configuration jobs and how SBS policies are
+// imported
+func NewAPI(fasitURL, clusterName string, jobs *JobPool, sbsPolicyImport string) *API {
 	return &API{
-		FasitURL:    fasitURL,
-		ClusterName: clusterName,
+		FasitURL:        fasitURL,
+		ClusterName:     clusterName,
+		Jobs:            jobs,
+		SBSPolicyImport: sbsPolicyImport,
 	}
 }
 
+// Close logs out of the AM sessions kept by named
+func (api *API) Close() {
+	CloseAMSessions()
+}
+
 // Code returns status code of AppError
 func (e AppError) Code() int {
 	return e.StatusCode
@@ -78,6 +106,37 @@ func (e AppError) Error() string {
 
 }
 
+type appErrorJSON struct {
+	Message    string `json:"message"`
+	Error      string `json:"error,omitempty"`
+	StatusCode int    `json:"statusCode"`
+}
+
+// MarshalJSON encodes AppError with the original error as a string
+func (e AppError) MarshalJSON() ([]byte, error) {
+	a := appErrorJSON{Message: e.Message, StatusCode: e.StatusCode}
+	if e.OriginalError != nil {
+		a.Error = e.OriginalError.Error()
+	}
+	return json.Marshal(a)
+}
+
+// UnmarshalJSON decodes AppError as encoded by MarshalJSON
+func (e *AppError) UnmarshalJSON(data []byte) error {
+	var a appErrorJSON
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+
+	e.Message = a.Message
+	e.StatusCode = a.StatusCode
+	e.OriginalError = nil
+	if len(a.Error) > 0 {
+		e.OriginalError = errors.New(a.Error)
+	}
+	return nil
+}
+
 type appHandler func(w http.ResponseWriter, r *http.Request) *AppError
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -107,6 +166,10 @@ func (api *API) MakeHandler() http.Handler {
 	mux.Handle(pat.Get("/metrics"), promhttp.Handler())
 	mux.Handle(pat.Get("/version"), appHandler(api.version))
 	mux.Handle(pat.Post("/configure"), appHandler(api.configure))
+	mux.Handle(pat.Get("/jobs/:id"), appHandler(api.job))
+	mux.Handle(pat.Delete("/configure/:application/:environment"), appHandler(api.deconfigure))
+	mux.Handle(pat.Get("/status/:application/:environment"), appHandler(api.status))
+	mux.Handle(pat.Post("/rotate/:application/:environment"), appHandler(api.rotate))
 	return mux
 }
 
@@ -129,7 +192,7 @@ func (api *API) version(w http.ResponseWriter, _ *http.Request) *AppError {
 func (api *API) configure(w http.ResponseWriter, r *http.Request) *AppError {
 	requests.With(prometheus.Labels{"path": "configure"}).Inc()
 
-	namedConfigurationRequest, err := unmarshalConfigurationRequest(r.Body)
+	namedConfigurationRequest, err := readConfigurationRequest(w, r)
 	if err != nil {
 		return &AppError{err, "Unable to unmarshal configuration namedConfigurationRequest", http.StatusBadRequest}
 	}
@@ -150,37 +213,92 @@ func (api *API) configure(w http.ResponseWriter, r *http.Request) *AppError {
 		return &AppError{nil, errorString, http.StatusBadRequest}
 	}
 
-	if ZoneSbs == zone {
-		w.Write([]byte("Configuring AM policies in SBS\n"))
+	if ZoneSbs != zone && ZoneFss != zone {
+		return &AppError{errors.New("no AM configurations available for this zone"), "Zone has to be fss or sbs, not " + zone, http.StatusBadRequest}
+	}
+
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun")); dryRun {
+		return planConfiguration(w, &fasitClient, &namedConfigurationRequest, zone, api.SBSPolicyImport)
+	}
 
-		appError := configureSBSOpenam(&fasitClient, &namedConfigurationRequest, zone)
-		if appError != nil {
-			return appError
+	job, err := NewJob(api, &fasitClient, namedConfigurationRequest, zone)
+	if err != nil {
+		return &AppError{err, "Unable to create configuration job", http.StatusInternalServerError}
+	}
+
+	if lockMode == LockReject {
+		if holder, appErr := job.lockConfiguration(); appErr != nil {
+			lockHolderLocation(w, holder)
+			return appErr
 		}
+	}
+
+	if appErr := api.Jobs.Submit(job); appErr != nil {
+		job.unlockConfiguration()
+		return appErr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		glog.Errorf("Unable to encode job %s: %s", job.ID, err)
+	}
+
+	return nil
+}
+
+func (api *API) job(w http.ResponseWriter, r *http.Request) *AppError {
+	requests.With(prometheus.Labels{"path": "jobs"}).Inc()
+
+	id := pat.Param(r, "id")
+	job, exists := api.Jobs.Get(id)
+	if !exists {
+		return &AppError{nil, "Job " + id + " not found", http.StatusNotFound}
+	}
 
-		w.Write([]byte("AM policy configured for " + namedConfigurationRequest.Application + " in " +
-			namedConfigurationRequest.Environment))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		return &AppError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+// runConfiguration performs the AM configuration for the job in its zone
+func (api *API) runConfiguration(job *Job) *AppError {
+	request := &job.request
 
-	} else if ZoneFss == zone {
-		w.Write([]byte("Configuring ISSO agent in FSS\n"))
+	if ZoneSbs == job.Zone {
+		configure := configureSBSOpenam
+		if api.SBSPolicyImport == PolicyImportREST {
+			configure = importSBSOpenam
+		}
 
-		appError := configureFSSOpenam(&fasitClient, &namedConfigurationRequest, zone)
-		if appError != nil {
+		if appError := configure(job, job.fasit, request, job.Zone); appError != nil {
 			return appError
 		}
 
-		w.Write([]byte("OIDC configured for " + namedConfigurationRequest.Application + " in " +
-			namedConfigurationRequest.Environment + "\nAgentName: " + namedConfigurationRequest.Application + "-" +
-			namedConfigurationRequest.Environment + "\nRedirection URIs:\n\t" + strings.Join(namedConfigurationRequest.RedirectionUris,
-			"\n\t")))
-	} else {
-		return &AppError{errors.New("no AM configurations available for this zone"), "Zone has to be fss or sbs, not " + zone, http.StatusBadRequest}
+		job.result("AM policy configured for " + request.Application + " in " + request.Environment)
+		return nil
+	}
+
+	if appError := configureFSSOpenam(job, job.fasit, request, job.Zone); appError != nil {
+		return appError
 	}
 
+	job.result("OIDC configured for " + request.Application + " in " +
+		request.Environment + "\nAgentName: " + request.Application + "-" +
+		request.Environment + "\nRedirection URIs:\n\t" + strings.Join(request.RedirectionUris,
+		"\n\t"))
 	return nil
 }
 
-func configureSBSOpenam(fasit *FasitClient, request *NamedConfigurationRequest, zone string) *AppError {
+func configureSBSOpenam(job *Job, fasit *FasitClient, request *NamedConfigurationRequest, zone string) *AppError {
+	if appErr := job.stage(StageFasitLookup); appErr != nil {
+		return appErr
+	}
+
 	openamResource, apErr := fasit.GetOpenAmResource(ResourceRequest{"OpenAM", "OpenAM"},
 		request.Environment, request.Application, zone)
 	if apErr != nil {
@@ -188,36 +306,61 @@ func configureSBSOpenam(fasit *FasitClient, request *NamedConfigurationRequest,
 		return apErr
 	}
 
-	files, err := GenerateAmFiles(request)
+	if appErr := job.stage(StagePolicyDownload); appErr != nil {
+		return appErr
+	}
+
+	workspace, digests, err := GenerateAmFiles(request)
 	if err != nil {
 		glog.Errorf("Could not download am policy files: %s", err)
 		return &AppError{err, "Policy files not found", http.StatusNotFound}
 	}
+	job.policyDigests(digests)
+
+	defer workspace.Remove()
+
+	if appErr := job.stage(StageSftpCopy); appErr != nil {
+		return appErr
+	}
 
 	sshClient, sshSession, err := SSHConnect(&openamResource, sshPort)
 	if err != nil {
 		glog.Errorf("Could not get ssh session on %s %s", openamResource.Hostname, err)
-		return &AppError{err, "SSH session failed", http.StatusServiceUnavailable}
+		return SSHAppError(err, openamResource.Hostname)
 	}
 
 	defer sshSession.Close()
 	defer sshClient.Close()
 
-	err = UpdatePolicyFiles(files, request.Environment)
+	err = UpdatePolicyFiles(workspace.Files, request.Environment)
 	if err != nil {
 		glog.Errorf("Could not update policy files with correct site name %s", err)
 		return &AppError{err, "AM policy files could not be updated", http.StatusBadRequest}
 	}
 
-	err = CopyFilesToAmServer(sshClient, files, request.Application)
+	sftpClient, err := SftpConnect(sshClient)
+	if err != nil {
+		glog.Errorf("Could not get sftp session on %s %s", openamResource.Hostname, err)
+		return &AppError{err, "AM policy files transfer failed", http.StatusServiceUnavailable}
+	}
+
+	defer sftpClient.Close()
+	defer workspace.RemoveRemote(sftpClient)
+
+	err = CopyFilesToAmServer(sftpClient, workspace)
 	if err != nil {
 		glog.Errorf("Could not to copy files to AM server; %s", err)
 		return &AppError{err, "AM policy files transfer failed", http.StatusBadRequest}
 	}
 
 	configurations.With(prometheus.Labels{"named_app": request.Application}).Inc()
-	//JobQueue <- Job{API: api}
-	if err := runAmPolicyScript(request, sshSession); err != nil {
+	if appErr := job.stage(StageScriptRun); appErr != nil {
+		return appErr
+	}
+
+	result, err := runAmPolicyScript(request, workspace, sshSession)
+	job.scriptResult(result)
+	if err != nil {
 		glog.Errorf("Failed to run script; %s", err)
 		return &AppError{err, "AM policy script failed", http.StatusBadRequest}
 	}
@@ -225,34 +368,122 @@ func configureSBSOpenam(fasit *FasitClient, request *NamedConfigurationRequest,
 	return nil
 }
 
-func configureFSSOpenam(fasit *FasitClient, request *NamedConfigurationRequest, zone string) *AppError {
+// importSBSOpenam imports the policy files through the AM REST API, without SSH access to the AM host
+func importSBSOpenam(job *Job, fasit *FasitClient, request *NamedConfigurationRequest, zone string) *AppError {
+	if appErr := job.stage(StageFasitLookup); appErr != nil {
+		return appErr
+	}
+
+	adminResource, appErr := fasit.GetAmAdminResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	if appErr := job.stage(StagePolicyDownload); appErr != nil {
+		return appErr
+	}
+
+	workspace, digests, err := GenerateAmFiles(request)
+	if err != nil {
+		glog.Errorf("Could not download am policy files: %s", err)
+		return &AppError{err, "Policy files not found", http.StatusNotFound}
+	}
+	job.policyDigests(digests)
+
+	defer workspace.Remove()
+
+	if err := UpdatePolicyFiles(workspace.Files, request.Environment); err != nil {
+		glog.Errorf("Could not update policy files with correct site name %s", err)
+		return &AppError{err, "AM policy files could not be updated", http.StatusBadRequest}
+	}
+
+	if appErr := job.stage(StagePolicyImport); appErr != nil {
+		return appErr
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	configurations.With(prometheus.Labels{"named_app": request.Application}).Inc()
+	created, deleted, err := importPolicies(am, workspace.Files, request.Application, adminResource.realm)
+	if err != nil {
+		glog.Errorf("Failed to import AM policies: %s", err)
+		return &AppError{err, "AM policy import failed", http.StatusBadRequest}
+	}
+
+	glog.Infof("Imported AM policies for %s: %s", request.Application, strings.Join(created, ", "))
+	if len(deleted) > 0 {
+		glog.Infof("Deleted AM policies of %s no longer in %s: %s", request.Application, policyFileName,
+			strings.Join(deleted, ", "))
+	}
+	return nil
+}
+
+func configureFSSOpenam(job *Job, fasit *FasitClient, request *NamedConfigurationRequest, zone string) *AppError {
 	agentName := fmt.Sprintf("%s-%s", request.Application, request.Environment)
 
+	if appErr := job.stage(StageFasitLookup); appErr != nil {
+		return appErr
+	}
+
 	issoResource, appErr := fasit.GetIssoResource(request, zone)
 	if appErr != nil {
 		glog.Errorf("Could not get OIDC resource: %s", appErr)
 		return appErr
 	}
 
+	if appErr := fasit.resolveAgentSecret(&issoResource, request, zone); appErr != nil {
+		glog.Errorf("Could not get agent secret: %s", appErr)
+		return appErr
+	}
+
+	if appErr := job.stage(StageAgentCreation); appErr != nil {
+		return appErr
+	}
+
 	am, err := GetAmConnection(&issoResource)
 	if err != nil {
 		glog.Errorf("Failed to connect to AM server: %s", err)
 		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
 	}
+	defer am.Release()
 
 	request.RedirectionUris = CreateRedirectionUris(&issoResource, request)
 
 	configurations.With(prometheus.Labels{"named_app": request.Application}).Inc()
-	if am.AgentExists(agentName) {
-		glog.Infof("Deleting agent %s before re-creating it", agentName)
-		am.DeleteAgent(agentName)
+	exists := am.AgentExists(agentName)
+	if exists && !request.Recreate {
+		glog.Infof("Updating agent %s", agentName)
+		diff, agentErr := am.UpdateAgent(agentName, request.RedirectionUris, &issoResource, request)
+		if agentErr != nil {
+			glog.Errorf("Failed to update AM agent %s: %s", agentName, agentErr)
+			return &AppError{agentErr, "AM agent update failed", http.StatusBadRequest}
+		}
+		job.agentDiff(diff)
+	} else {
+		if exists {
+			glog.Infof("Deleting agent %s before re-creating it", agentName)
+			if err := am.DeleteAgent(agentName); err != nil {
+				glog.Errorf("Failed to delete AM agent %s: %s", agentName, err)
+				return &AppError{err, "AM agent deletion failed", http.StatusBadGateway}
+			}
+		}
+
+		glog.Infof("Creating agent %s", agentName)
+		agentErr := am.CreateAgent(agentName, request.RedirectionUris, &issoResource, request)
+		if agentErr != nil {
+			glog.Errorf("Failed to create AM agent %s: %s", agentName, agentErr)
+			return &AppError{agentErr, "AM agent creation failed", http.StatusBadRequest}
+		}
 	}
 
-	glog.Infof("Creating agent %s", agentName)
-	agentErr := am.CreateAgent(agentName, request.RedirectionUris, &issoResource, request)
-	if agentErr != nil {
-		glog.Errorf("Failed to create AM agent %s: %s", agentName, agentErr)
-		return &AppError{agentErr, "AM agent creation failed", http.StatusBadRequest}
+	if appErr := job.stage(StageFasitUpsert); appErr != nil {
+		return appErr
 	}
 
 	glog.Info("Creating and POST'ing payload for OpenIDConnect")
@@ -282,31 +513,6 @@ func configureFSSOpenam(fasit *FasitClient, request *NamedConfigurationRequest,
 	return nil
 }
 
-func runAmPolicyScript(request *NamedConfigurationRequest, sshSession *ssh.Session) error {
-	cmd := fmt.Sprintf("sudo python /opt/openam/scripts/openam_policy.py %s %s", request.Application, request.Application)
-
-	modes := ssh.TerminalModes{
-		ssh.ECHO: 0, // Disable echoing
-	}
-
-	if err := sshSession.RequestPty("xterm", 80, 40, modes); err != nil {
-		glog.Infof("Could not set pty")
-	}
-
-	var stdoutBuf bytes.Buffer
-
-	sshSession.Stdout = &stdoutBuf
-
-	glog.Infof("Running command %s", cmd)
-	err := sshSession.Run(cmd)
-	if err != nil {
-		return fmt.Errorf("could not run command %s %s", cmd, err)
-	}
-	glog.Infof("AM policy updated for %s in environment %s", request.Application,
-		request.Environment)
-	return nil
-}
-
 // Validate performs validation of NamedConfigurationRequest
 func (r NamedConfigurationRequest) Validate(zone string) []error {
 	required := map[string]*string{
@@ -330,9 +536,75 @@ func (r NamedConfigurationRequest) Validate(zone string) []error {
 		}
 	}
 
+	if r.OAuth2 != nil {
+		errs = append(errs, r.OAuth2.Validate()...)
+	}
+
+	if len(r.Realm) > 0 && !validRealm.MatchString(r.Realm) {
+		errs = append(errs, fmt.Errorf("realm must be a realm path like /team, not '%s'", r.Realm))
+	}
+
+	if len(r.PolicyFiles) > 0 {
+		if zone != ZoneSbs {
+			errs = append(errs, fmt.Errorf("policyFiles are only used in %s", ZoneSbs))
+		}
+		if _, ok := r.PolicyFiles[policyFileName]; !ok {
+			errs = append(errs, fmt.Errorf("policyFiles must contain %s", policyFileName))
+		}
+		for name, content := range r.PolicyFiles {
+			if name != policyFileName && name != notEnforcedFileName {
+				errs = append(errs, fmt.Errorf("policyFiles can only be %s and %s, not '%s'", policyFileName,
+					notEnforcedFileName, name))
+			}
+			if len(content) > maxPolicyFileSize {
+				errs = append(errs, fmt.Errorf("policy file %s is larger than %d bytes", name, maxPolicyFileSize))
+			}
+		}
+	}
+
 	return errs
 }
 
+// readConfigurationRequest reads the configuration request as JSON, or as multipart/form-data with the JSON in the
+// request field and policy files in the policyFiles field
+func readConfigurationRequest(w http.ResponseWriter, r *http.Request) (NamedConfigurationRequest, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return unmarshalConfigurationRequest(r.Body)
+	}
+
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		return NamedConfigurationRequest{}, fmt.Errorf("could not read multipart configuration request %s", err)
+	}
+
+	request, err := unmarshalConfigurationRequest(ioutil.NopCloser(strings.NewReader(r.FormValue(requestField))))
+	if err != nil {
+		return NamedConfigurationRequest{}, err
+	}
+
+	for _, header := range r.MultipartForm.File[policyFilesField] {
+		file, err := header.Open()
+		if err != nil {
+			return NamedConfigurationRequest{}, fmt.Errorf("could not open uploaded file %s %s", header.Filename, err)
+		}
+
+		content, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return NamedConfigurationRequest{}, fmt.Errorf("could not read uploaded file %s %s", header.Filename, err)
+		}
+
+		if request.PolicyFiles == nil {
+			request.PolicyFiles = map[string][]byte{}
+		}
+		request.PolicyFiles[filepath.Base(header.Filename)] = content
+	}
+
+	return request, nil
+}
+
 func unmarshalConfigurationRequest(body io.ReadCloser) (NamedConfigurationRequest, error) {
 	requestBody, err := ioutil.ReadAll(body)
 	if err != nil {
@@ -1,8 +1,10 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -28,7 +30,7 @@ func TestAnIncorrectPayloadGivesError(t *testing.T) {
 }
 
 func TestInvalidFasit(t *testing.T) {
-	api := API{"https://fasit.local", "testCluster"}
+	api := API{FasitURL: "https://fasit.local", ClusterName: "testCluster"}
 	jsn, _ := json.Marshal(CreateConfigurationRequest("appname", "123", "env", "test", "test", []string{"/test"}))
 
 	body := strings.NewReader(string(jsn))
@@ -67,6 +69,79 @@ func TestValidateDeploymentRequest(t *testing.T) {
 	})
 }
 
+func TestValidateRealm(t *testing.T) {
+	request := CreateConfigurationRequest("app", "1", "t0", "user", "pass", []string{"/app"})
+
+	request.Realm = "/team/sub"
+	assert.Empty(t, request.Validate("fss"))
+
+	request.Realm = "/team?x=y"
+	assert.Contains(t, request.Validate("fss"), errors.New("realm must be a realm path like /team, not '/team?x=y'"))
+}
+
+func TestValidatePolicyFiles(t *testing.T) {
+	request := CreateConfigurationRequest("app", "1", "t0", "user", "pass", []string{})
+
+	request.PolicyFiles = map[string][]byte{"app-policies.xml": {}, "not-enforced-urls.txt": {}}
+	assert.Empty(t, request.Validate("sbs"))
+	assert.Contains(t, request.Validate("fss"), errors.New("policyFiles are only used in sbs"))
+
+	request.PolicyFiles = map[string][]byte{"policies.xml": {}}
+	assert.Equal(t, []error{
+		errors.New("policyFiles must contain app-policies.xml"),
+		errors.New("policyFiles can only be app-policies.xml and not-enforced-urls.txt, not 'policies.xml'"),
+	}, request.Validate("sbs"))
+
+	request.PolicyFiles = map[string][]byte{"app-policies.xml": make([]byte, maxPolicyFileSize+1)}
+	assert.Equal(t, []error{
+		errors.New("policy file app-policies.xml is larger than 1048576 bytes"),
+	}, request.Validate("sbs"))
+}
+
+func TestLargeJSONConfigurationRequestIsRejected(t *testing.T) {
+	body := `{"application": "app", "policyFiles": {"app-policies.xml": "` + strings.Repeat("A", maxUploadSize) + `"}}`
+
+	req := httptest.NewRequest("POST", "/configure", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	_, err := readConfigurationRequest(httptest.NewRecorder(), req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not read configuration request body")
+}
+
+func TestJSONPolicyFilesAreBase64(t *testing.T) {
+	body := `{"application": "app", "policyFiles": {"app-policies.xml": "PFBvbGljaWVzLz4="}}`
+
+	req := httptest.NewRequest("POST", "/configure", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	request, err := readConfigurationRequest(httptest.NewRecorder(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "<Policies/>", string(request.PolicyFiles["app-policies.xml"]))
+}
+
+func TestMultipartConfigurationRequest(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("request", `{"application": "app", "environment": "t0"}`)
+	part, _ := writer.CreateFormFile("policyFiles", "am/app-policies.xml")
+	part.Write([]byte("<Policies/>"))
+	part, _ = writer.CreateFormFile("policyFiles", "am/not-enforced-urls.txt")
+	part.Write([]byte("https://${DomainName}/app/login*"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/configure", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	request, err := readConfigurationRequest(httptest.NewRecorder(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", request.Application)
+	assert.Equal(t, map[string][]byte{
+		"app-policies.xml":      []byte("<Policies/>"),
+		"not-enforced-urls.txt": []byte("https://${DomainName}/app/login*"),
+	}, request.PolicyFiles)
+}
+
 func CreateConfigurationRequest(appName, version, env, username, password string, urls []string) NamedConfigurationRequest {
 	return NamedConfigurationRequest{
 		Application:  appName,
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// AuditEvent is a line of the audit log, written for every configuration job that has finished
+type AuditEvent struct {
+	Time          time.Time      `json:"time"`
+	Action        string         `json:"action"`
+	JobID         string         `json:"jobId"`
+	User          string         `json:"user"`
+	Application   string         `json:"application"`
+	Version       string         `json:"version,omitempty"`
+	Environment   string         `json:"environment"`
+	Zone          string         `json:"zone"`
+	Status        JobStatus      `json:"status"`
+	PolicyDigests []PolicyDigest `json:"policyDigests,omitempty"`
+	Error         string         `json:"error,omitempty"`
+}
+
+const auditPrefix = "AUDIT "
+
+// audit writes the event as a JSON line prefixed with AUDIT, so it can be picked out of the log
+func audit(event AuditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		glog.Errorf("Could not write audit event for job %s: %s", event.JobID, err)
+		return
+	}
+	glog.Info(auditPrefix + string(line))
+}
+
+// auditJob records who configured what, and which policy files were applied. Callers must hold the lock of the job.
+func auditJob(job *Job) {
+	event := AuditEvent{
+		Time:          time.Now(),
+		Action:        "configure",
+		JobID:         job.ID,
+		User:          job.request.Username,
+		Application:   job.Application,
+		Version:       job.request.Version,
+		Environment:   job.Environment,
+		Zone:          job.Zone,
+		Status:        job.Status,
+		PolicyDigests: job.PolicyDigests,
+	}
+	if job.Error != nil {
+		event.Error = job.Error.Error()
+	}
+	audit(event)
+}
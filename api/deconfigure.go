@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"goji.io/pat"
+)
+
+// Kinds of AM and Fasit configuration removed when deconfiguring an application
+const (
+	RemovedAgent         = "agent"
+	RemovedFasitResource = "fasitResource"
+	RemovedPolicy        = "policy"
+)
+
+// RemovedResource describes a single piece of configuration removed by named
+type RemovedResource struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	ID   int    `json:"id,omitempty"`
+}
+
+// DeconfigurationResult lists what was removed for the application, and the error if removal stopped early
+type DeconfigurationResult struct {
+	Application string            `json:"application"`
+	Environment string            `json:"environment"`
+	Removed     []RemovedResource `json:"removed"`
+	Error       *AppError         `json:"error,omitempty"`
+}
+
+func (api *API) deconfigure(w http.ResponseWriter, r *http.Request) *AppError {
+	requests.With(prometheus.Labels{"path": "deconfigure"}).Inc()
+
+	request, appErr := requestFromPath(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	fasitClient := FasitClient{api.FasitURL, request.Username, request.Password}
+	if fasitErr := validateFasitRequirements(&fasitClient, &request); fasitErr != nil {
+		return fasitErr
+	}
+
+	holder, lock, appErr := lockRequest(r.Context(), "deconfigure", request.Application, request.Environment)
+	if appErr != nil {
+		lockHolderLocation(w, holder)
+		return appErr
+	}
+	defer lock.unlock()
+
+	result := DeconfigurationResult{
+		Application: request.Application,
+		Environment: request.Environment,
+		Removed:     []RemovedResource{},
+	}
+
+	zone := GetZone(api.ClusterName)
+	switch zone {
+	case ZoneFss:
+		result.Error = deconfigureFSSOpenam(&fasitClient, &request, zone, lock, &result)
+	case ZoneSbs:
+		result.Error = deconfigureSBSOpenam(&fasitClient, &request, zone, lock, &result)
+	default:
+		return &AppError{nil, "Zone has to be fss or sbs, not " + zone, http.StatusBadRequest}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if result.Error != nil {
+		w.WriteHeader(result.Error.StatusCode)
+	}
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		glog.Errorf("Unable to encode deconfiguration result: %s", err)
+	}
+
+	return nil
+}
+
+// requestFromPath creates a request for the application and environment in the path, using basic auth
+// credentials for Fasit and the optional realm query parameter
+func requestFromPath(r *http.Request) (NamedConfigurationRequest, *AppError) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return NamedConfigurationRequest{}, &AppError{nil, "Fasit credentials are required as basic auth", http.StatusUnauthorized}
+	}
+
+	realm := r.URL.Query().Get("realm")
+	if len(realm) > 0 && !validRealm.MatchString(realm) {
+		return NamedConfigurationRequest{}, &AppError{nil, fmt.Sprintf("realm must be a realm path like /team, not '%s'",
+			realm), http.StatusBadRequest}
+	}
+
+	return NamedConfigurationRequest{
+		Application: pat.Param(r, "application"),
+		Environment: pat.Param(r, "environment"),
+		Username:    username,
+		Password:    password,
+		Realm:       realm,
+	}, nil
+}
+
+func deconfigureFSSOpenam(fasit *FasitClient, request *NamedConfigurationRequest, zone string, lock *requestLock,
+	result *DeconfigurationResult) *AppError {
+	agentName := fmt.Sprintf("%s-%s", request.Application, request.Environment)
+
+	adminResource, appErr := fasit.GetAmAdminResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	if am.AgentExists(agentName) {
+		if appErr := lock.check(); appErr != nil {
+			return appErr
+		}
+		glog.Infof("Deleting agent %s", agentName)
+		if err := am.DeleteAgent(agentName); err != nil {
+			glog.Errorf("Failed to delete AM agent %s: %s", agentName, err)
+			return &AppError{err, "AM agent deletion failed", http.StatusBadGateway}
+		}
+		result.Removed = append(result.Removed, RemovedResource{Kind: RemovedAgent, Name: agentName})
+	}
+
+	alias := fmt.Sprintf("%s-oidc", request.Application)
+	resource, fasitErr := getFasitResource(*fasit, ResourceRequest{alias, ResourceTypeOIDC}, request.Environment,
+		request.Application, zone)
+	if fasitErr != nil {
+		if fasitErr.StatusCode == http.StatusNotFound {
+			glog.Infof("OpenIDConnect resource %s doesn't exist in Fasit", alias)
+			return nil
+		}
+		return fasitErr
+	}
+
+	if appErr := lock.check(); appErr != nil {
+		return appErr
+	}
+	glog.Infof("Deleting OpenIDConnect resource %s (%d) from Fasit", alias, resource.ID)
+	if appErr := fasit.DeleteFasitResource(resource.ID, request); appErr != nil {
+		glog.Errorf("Failed to delete OpenIDConnect resource from Fasit: %s", appErr)
+		return appErr
+	}
+	result.Removed = append(result.Removed, RemovedResource{Kind: RemovedFasitResource, Name: alias, ID: resource.ID})
+
+	return nil
+}
+
+func deconfigureSBSOpenam(fasit *FasitClient, request *NamedConfigurationRequest, zone string, lock *requestLock,
+	result *DeconfigurationResult) *AppError {
+	adminResource, appErr := fasit.GetAmAdminResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	policies, err := ListPolicy(am)
+	if err != nil {
+		glog.Errorf("Failed to list AM policies: %s", err)
+		return &AppError{err, "Could not list AM policies", http.StatusBadGateway}
+	}
+
+	for _, policy := range ApplicationPolicies(policies, request.Application) {
+		if appErr := lock.check(); appErr != nil {
+			return appErr
+		}
+		glog.Infof("Deleting policy %s", policy.Name)
+		if err := am.DeletePolicy(policy.Name, ""); err != nil {
+			glog.Errorf("Failed to delete AM policy %s: %s", policy.Name, err)
+			return &AppError{err, "AM policy deletion failed", http.StatusBadGateway}
+		}
+		result.Removed = append(result.Removed, RemovedResource{Kind: RemovedPolicy, Name: policy.Name})
+	}
+
+	return nil
+}
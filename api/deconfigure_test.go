@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeconfigureRequiresCredentials(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	req, _ := http.NewRequest("DELETE", "/configure/testapp/t0", nil)
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
+
+func TestPathRequestsRejectInvalidRealm(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	for _, request := range []struct{ method, path string }{
+		{"DELETE", "/configure/testapp/t0"},
+		{"GET", "/status/testapp/t0"},
+		{"POST", "/rotate/testapp/t0"},
+	} {
+		req, _ := http.NewRequest(request.method, request.path+"?realm=%2Fteam%2F..%2F..%2Fagents", nil)
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		api.MakeHandler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code, request.path)
+		assert.Contains(t, rr.Body.String(), "realm must be a realm path", request.path)
+	}
+}
+
+func TestDeconfigureFSS(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"admin\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/agents/testapp-t0").
+		Reply(200)
+
+	gock.New(baseURL).
+		Delete("/json/agents/testapp-t0").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", "testapp-oidc").
+		MatchParam("type", ResourceTypeOIDC).
+		Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+
+	gock.New("https://fasit.local").
+		Delete("/api/v2/resources/256").
+		Reply(204)
+
+	req, _ := http.NewRequest("DELETE", "/configure/testapp/t0", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var result DeconfigurationResult
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+	assert.Nil(t, result.Error)
+	assert.Equal(t, []RemovedResource{
+		{Kind: RemovedAgent, Name: "testapp-t0"},
+		{Kind: RemovedFasitResource, Name: "testapp-oidc", ID: 256},
+	}, result.Removed)
+	assert.True(t, gock.IsDone())
+}
+
+func TestApplicationPolicies(t *testing.T) {
+	policies := []Policy{
+		{Name: "Testapp_001"},
+		{Name: "testapp-rule_Testapp_001_01"},
+		{Name: "Testapp2_001"},
+		{Name: "Testappen_001"},
+		{Name: "Other_001", Resources: []string{"https://tjenester.nav.no/testapp/*"}},
+	}
+
+	applicationPolicies := ApplicationPolicies(policies, "testapp")
+
+	assert.Len(t, applicationPolicies, 2)
+	assert.Equal(t, "Testapp_001", applicationPolicies[0].Name)
+	assert.Equal(t, "testapp-rule_Testapp_001_01", applicationPolicies[1].Name)
+
+	applicationPolicies = ApplicationPolicies(policies, "testapp2")
+
+	assert.Len(t, applicationPolicies, 1)
+	assert.Equal(t, "Testapp2_001", applicationPolicies[0].Name)
+}
@@ -65,21 +65,27 @@ type OpenAmResource struct {
 	Hostname string
 	Username string
 	Password string
+	// HostKey is the public SSH host key of the AM host in authorized_keys format, if set in Fasit
+	HostKey string
 }
 
 // IssoResource contains information about the OIDC server as set in fasit
 type IssoResource struct {
-	oidcURL           string
-	oidcUsername      string
-	oidcPassword      string
-	oidcAgentPassword string
-	IssoIssuerURL     string
-	IssoJwksURL       string
-	loadbalancerURL   string
-	ingressURLs       []string
-	contextRoots      []string
-	nodes             []string
-	createLocalhost   bool
+	oidcURL            string
+	realm              string
+	oidcUsername       string
+	oidcPassword       string
+	oidcAgentPassword  string
+	agentSecret        string
+	agentSecretChanged bool
+	nextAgentSecret    string
+	IssoIssuerURL      string
+	IssoJwksURL        string
+	loadbalancerURL    string
+	ingressURLs        []string
+	contextRoots       []string
+	nodes              []string
+	createLocalhost    bool
 }
 
 const (
@@ -111,11 +117,7 @@ func (fasit FasitClient) CreateFasitResourceForOpenIDConnect(issoResource IssoRe
 			"issuerUrl": issoResource.IssoIssuerURL,
 			"jwksUrl":   issoResource.IssoJwksURL,
 		},
-		Secrets: map[string]map[string]string{
-			"password": {
-				"value": issoResource.oidcAgentPassword,
-			},
-		},
+		Secrets: agentSecrets(issoResource.agentSecret, issoResource.nextAgentSecret),
 	}
 
 	return resource, nil
@@ -192,10 +194,53 @@ func (fasit FasitClient) GetIssoResource(request *NamedConfigurationRequest, zon
 	if appErr != nil {
 		return IssoResource{}, appErr
 	}
+	resource.realm = amRealm(oidcURLResource, request)
+
+	return resource, nil
+}
+
+// GetAmAdminResource fetches the OIDC server url and admin credentials from fasit, enough to connect to AM
+func (fasit FasitClient) GetAmAdminResource(request *NamedConfigurationRequest, zone string) (IssoResource, *AppError) {
+	oidcURLResource, fasitErr := getFasitResource(fasit, ResourceRequest{openidconnectalias, "BaseUrl"},
+		request.Environment, request.Application, zone)
+	if fasitErr != nil {
+		return IssoResource{}, fasitErr
+	}
+
+	oidcUserResource, fasitErr := getFasitResource(fasit, ResourceRequest{openidconnectalias, "Credential"},
+		request.Environment, request.Application, zone)
+	if fasitErr != nil {
+		return IssoResource{}, fasitErr
+	}
+
+	resource := IssoResource{
+		oidcURL:      oidcURLResource.Properties["url"],
+		realm:        amRealm(oidcURLResource, request),
+		oidcUsername: oidcUserResource.Properties["username"],
+	}
+
+	if len(oidcUserResource.Secrets) > 0 {
+		secret, err := resolveSecret(oidcUserResource.Secrets, fasit.Username, fasit.Password)
+		if err != nil {
+			errorCounter.WithLabelValues("resolve_secret").Inc()
+			return IssoResource{}, err
+		}
+
+		resource.oidcPassword = secret["password"]
+	}
 
 	return resource, nil
 }
 
+// amRealm returns the AM realm of the application, from the request or else from the realm property of the OIDC
+// server resource. Empty means the root realm.
+func amRealm(oidcURLResource FasitResource, request *NamedConfigurationRequest) string {
+	if len(request.Realm) > 0 {
+		return request.Realm
+	}
+	return oidcURLResource.Properties["realm"]
+}
+
 // GetOpenAmResource fetches necessary OpenAM resources from fasit
 func (fasit FasitClient) GetOpenAmResource(resourcesRequest ResourceRequest, fasitEnvironment, application, zone string) (OpenAmResource, *AppError) {
 	fasitResource, fasitErr := getFasitResource(fasit, resourcesRequest, fasitEnvironment, application, zone)
@@ -279,6 +324,7 @@ func (fasit FasitClient) mapToIssoResource(oidcURLResource FasitResource, oidcUs
 func (fasit FasitClient) mapToOpenAmResource(fasitResource FasitResource) (resource OpenAmResource, appErr *AppError) {
 	resource.Hostname = fasitResource.Properties["hostname"]
 	resource.Username = fasitResource.Properties["username"]
+	resource.HostKey = fasitResource.Properties["hostKey"]
 
 	if len(fasitResource.Secrets) > 0 {
 		secret, err := resolveSecret(fasitResource.Secrets, fasit.Username, fasit.Password)
@@ -334,7 +380,12 @@ func (fasit FasitClient) GetFasitEnvironment(environmentName string) (string, *A
 }
 
 func resolveSecret(secrets map[string]map[string]string, username string, password string) (map[string]string, *AppError) {
-	req, err := http.NewRequest("GET", secrets[getFirstKey(secrets)]["ref"], nil)
+	return resolveNamedSecret(secrets, getFirstKey(secrets), username, password)
+}
+
+// resolveNamedSecret resolves a single secret of a resource with more than one
+func resolveNamedSecret(secrets map[string]map[string]string, name, username, password string) (map[string]string, *AppError) {
+	req, err := http.NewRequest("GET", secrets[name]["ref"], nil)
 	if err != nil {
 		return map[string]string{}, &AppError{err, "Could not create request to resolve secret", http.StatusBadRequest}
 	}
@@ -413,6 +464,21 @@ func (fasit FasitClient) PostFasitResource(resource FasitResource, request *Name
 	return nil
 }
 
+// DeleteFasitResource deletes the resource with the given id from fasit
+func (fasit FasitClient) DeleteFasitResource(id int, request *NamedConfigurationRequest) *AppError {
+	req, err := fasit.buildRequestWithPayload("DELETE", fmt.Sprintf("/api/v2/resources/%d", id), nil, request)
+	if err != nil {
+		return &AppError{err, "Error when building request", 500}
+	}
+
+	_, appErr := fasit.doRequest(req)
+	if appErr != nil {
+		return appErr
+	}
+
+	return nil
+}
+
 func (fasit FasitClient) buildRequestWithQueryParams(method, path string, queryParams map[string]string) (*http.Request, error) {
 	req, err := http.NewRequest(method, fasit.FasitURL+path, nil)
 
@@ -37,6 +37,7 @@ func TestGettingResource(t *testing.T) {
 		assert.Nil(t, err)
 		assert.Equal(t, hostname, resource.Hostname)
 		assert.Equal(t, username, resource.Username)
+		assert.Contains(t, resource.HostKey, "ssh-ed25519 ")
 	})
 }
 
@@ -155,11 +156,11 @@ func TestGetDomainFromZoneAndEnvironmentClass(t *testing.T) {
 func TestPostFasitResources(t *testing.T) {
 	fasit := FasitClient{"https://fasit.local", "", ""}
 	issoResource := IssoResource{
-		oidcURL:           "oidcURL",
-		IssoIssuerURL:     "issoIssuerURL",
-		IssoJwksURL:       "issoJwksURL",
-		oidcUsername:      "oidcUsername",
-		oidcAgentPassword: "oicdAgentPassword",
+		oidcURL:       "oidcURL",
+		IssoIssuerURL: "issoIssuerURL",
+		IssoJwksURL:   "issoJwksURL",
+		oidcUsername:  "oidcUsername",
+		agentSecret:   "agentSecret",
 	}
 	namedRequest := NamedConfigurationRequest{
 		Application: "appName",
@@ -184,7 +185,7 @@ func TestPostFasitResources(t *testing.T) {
 		assert.Equal(t, "{\"ID\":0,\"alias\":\"appName-oidc\",\"type\":\"OpenIdConnect\","+
 			"\"scope\":{\"environmentclass\":\"t\",\"environment\":\"cd-u1\",\"zone\":\"fss\","+
 			"\"application\":\"appName\"},\"properties\":{\"agentName\":\"appName-cd-u1\",\"hostUrl\":\"oidcURL\","+
-			"\"issuerUrl\":\"issoIssuerURL\",\"jwksUrl\":\"issoJwksURL\"},\"secrets\":{\"password\":{\"value\":\"oicdAgentPassword\"}}}", string(asJSON))
+			"\"issuerUrl\":\"issoIssuerURL\",\"jwksUrl\":\"issoJwksURL\"},\"secrets\":{\"password\":{\"value\":\"agentSecret\"}}}", string(asJSON))
 	})
 
 	t.Run("POSTing openIDConnect resource", func(t *testing.T) {
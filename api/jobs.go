@@ -0,0 +1,511 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// JobStatus describes where a configuration job or one of its stages is in its lifecycle
+type JobStatus string
+
+const (
+	// JobQueued is set when the job is waiting for a worker
+	JobQueued JobStatus = "queued"
+	// JobRunning is set while the job or stage is being processed
+	JobRunning JobStatus = "running"
+	// JobSucceeded is set when the job or stage finished without errors
+	JobSucceeded JobStatus = "succeeded"
+	// JobFailed is set when the job or stage finished with an error
+	JobFailed JobStatus = "failed"
+)
+
+// Stages reported while configuring an application
+const (
+	StageFasitLookup    = "fasit-lookup"
+	StagePolicyDownload = "policy-download"
+	StageSftpCopy       = "sftp-copy"
+	StageScriptRun      = "script-run"
+	StagePolicyImport   = "policy-import"
+	StageAgentCreation  = "agent-creation"
+	StageFasitUpsert    = "fasit-resource-upsert"
+)
+
+// Stage contains state and timings for a single step of a configuration job
+type Stage struct {
+	Name       string     `json:"name"`
+	Status     JobStatus  `json:"status"`
+	Started    time.Time  `json:"started"`
+	Finished   *time.Time `json:"finished,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// Job is a configuration request waiting for, or processed by, the JobPool
+type Job struct {
+	ID            string         `json:"id"`
+	Application   string         `json:"application"`
+	Environment   string         `json:"environment"`
+	Zone          string         `json:"zone"`
+	Status        JobStatus      `json:"status"`
+	Stages        []Stage        `json:"stages"`
+	Created       time.Time      `json:"created"`
+	Started       *time.Time     `json:"started,omitempty"`
+	Finished      *time.Time     `json:"finished,omitempty"`
+	Message       string         `json:"message,omitempty"`
+	AgentDiff     []FieldDiff    `json:"agentDiff,omitempty"`
+	PolicyDigests []PolicyDigest `json:"policyDigests,omitempty"`
+	Script        *ScriptResult  `json:"script,omitempty"`
+	Error         *AppError      `json:"error,omitempty"`
+
+	API     *API `json:"-"`
+	fasit   *FasitClient
+	request NamedConfigurationRequest
+	unlock  func()
+	lockErr *AppError
+	mutex   sync.RWMutex
+}
+
+// JobPool processes jobs on a fixed number of workers, and keeps a bounded history of jobs. Jobs waiting for the lock
+// of their application and environment are parked outside the queue, so they don't hold a worker.
+type JobPool struct {
+	queue   chan *Job
+	jobs    map[string]*Job
+	order   []string
+	maxJobs int
+	closed  bool
+	workers sync.WaitGroup
+	parked  sync.WaitGroup
+	mutex   sync.RWMutex
+}
+
+var (
+	jobsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "jobs", Help: "configuration jobs pr status"}, []string{"status"},
+	)
+	jobQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{Name: "job_queue_length", Help: "configuration jobs waiting for a worker"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobsCounter)
+	prometheus.MustRegister(jobQueueLength)
+}
+
+// NewJobPool starts workers processing jobs from a queue holding at most queueSize jobs.
+// At most maxJobs jobs are kept for status lookups, oldest finished jobs are evicted first.
+func NewJobPool(workers, queueSize, maxJobs int) *JobPool {
+	pool := &JobPool{
+		queue:   make(chan *Job, queueSize),
+		jobs:    make(map[string]*Job),
+		maxJobs: maxJobs,
+	}
+
+	pool.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	return pool
+}
+
+// NewJob creates a queued job for the configuration request
+func NewJob(api *API, fasit *FasitClient, request NamedConfigurationRequest, zone string) (*Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{
+		ID:          id,
+		Application: request.Application,
+		Environment: request.Environment,
+		Zone:        zone,
+		Status:      JobQueued,
+		Stages:      []Stage{},
+		Created:     time.Now(),
+		API:         api,
+		fasit:       fasit,
+		request:     request,
+	}
+	// uploaded policy files are dropped when the job is done, so their digests are kept from the start, even if the
+	// job fails before applying them
+	job.PolicyDigests = uploadedPolicyDigests(&request)
+	return job, nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate job id: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Submit puts the job on the queue, or fails if the queue is full
+func (pool *JobPool) Submit(job *Job) *AppError {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.closed {
+		jobsCounter.With(prometheus.Labels{"status": "rejected"}).Inc()
+		return &AppError{nil, "Named is shutting down, try again later", http.StatusServiceUnavailable}
+	}
+
+	select {
+	case pool.queue <- job:
+	default:
+		jobsCounter.With(prometheus.Labels{"status": "rejected"}).Inc()
+		return &AppError{nil, "Job queue is full, try again later", http.StatusServiceUnavailable}
+	}
+
+	pool.jobs[job.ID] = job
+	pool.order = append(pool.order, job.ID)
+	pool.evict()
+
+	jobsCounter.With(prometheus.Labels{"status": string(JobQueued)}).Inc()
+	jobQueueLength.Set(float64(len(pool.queue)))
+	return nil
+}
+
+// Get returns the job with the given id, if it is still kept by the pool
+func (pool *JobPool) Get(id string) (*Job, bool) {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	job, exists := pool.jobs[id]
+	return job, exists
+}
+
+// evict removes the oldest finished jobs until the history is within bounds. Callers must hold the lock.
+func (pool *JobPool) evict() {
+	for i := 0; len(pool.jobs) > pool.maxJobs && i < len(pool.order); {
+		job := pool.jobs[pool.order[i]]
+		if !job.done() {
+			i++
+			continue
+		}
+
+		delete(pool.jobs, job.ID)
+		pool.order = append(pool.order[:i], pool.order[i+1:]...)
+	}
+}
+
+// Drain stops accepting jobs and waits until the queued and running jobs have finished, or the timeout expires.
+// Parked jobs can't be queued again, and fail. It returns false if jobs were still running when it gave up.
+func (pool *JobPool) Drain(timeout time.Duration) bool {
+	pool.mutex.Lock()
+	if !pool.closed {
+		pool.closed = true
+		close(pool.queue)
+	}
+	pool.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		pool.workers.Wait()
+		pool.parked.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (pool *JobPool) work() {
+	defer pool.workers.Done()
+
+	for job := range pool.queue {
+		jobQueueLength.Set(float64(len(pool.queue)))
+		if lockMode == LockQueue && !pool.lock(job) {
+			continue
+		}
+		job.run()
+	}
+}
+
+// lock takes the lock of the job, parking the job while another job holds it. It returns false if the job can't
+// run now.
+func (pool *JobPool) lock(job *Job) bool {
+	holder, appErr := job.lockConfiguration()
+	if appErr == nil {
+		return true
+	}
+
+	if len(holder) > 0 && time.Now().Before(job.Created.Add(lockWaitTimeout)) {
+		job.waitingFor(holder)
+		pool.park(job)
+		return false
+	}
+
+	if len(holder) > 0 {
+		appErr = &AppError{nil, fmt.Sprintf("Timed out waiting for job %s configuring %s", holder,
+			configurationLockKey(job.Application, job.Environment)), http.StatusConflict}
+	}
+	job.start()
+	job.finish(appErr)
+	return false
+}
+
+// park queues the job again after a while
+func (pool *JobPool) park(job *Job) {
+	pool.parked.Add(1)
+	time.AfterFunc(lockRetryInterval, func() { pool.requeue(job) })
+}
+
+// requeue puts a parked job back on the queue, parks it again if the queue is full, or fails it if the pool is closed
+func (pool *JobPool) requeue(job *Job) {
+	pool.mutex.Lock()
+	closed := pool.closed
+	queued := false
+	if !closed {
+		select {
+		case pool.queue <- job:
+			queued = true
+			jobQueueLength.Set(float64(len(pool.queue)))
+		default:
+		}
+	}
+	pool.mutex.Unlock()
+
+	switch {
+	case closed:
+		defer pool.parked.Done()
+		job.start()
+		job.finish(&AppError{nil, "Named shut down while the job was waiting for the lock of " +
+			configurationLockKey(job.Application, job.Environment) + ", submit it again", http.StatusServiceUnavailable})
+	case queued:
+		pool.parked.Done()
+	default:
+		time.AfterFunc(lockRetryInterval, func() { pool.requeue(job) })
+	}
+}
+
+func (job *Job) run() {
+	defer job.unlockConfiguration()
+
+	job.start()
+
+	var appErr *AppError
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				glog.Errorf("Job %s panicked: %v", job.ID, r)
+				appErr = &AppError{fmt.Errorf("%v", r), "Configuration job failed unexpectedly", http.StatusInternalServerError}
+			}
+		}()
+		appErr = job.API.runConfiguration(job)
+	}()
+
+	if appErr == nil {
+		appErr = job.lockError()
+	}
+	job.finish(appErr)
+}
+
+func (job *Job) start() {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	now := time.Now()
+	job.Started = &now
+	job.Status = JobRunning
+	glog.Infof("Job %s started configuring %s in %s", job.ID, job.Application, job.Environment)
+}
+
+func (job *Job) finish(appErr *AppError) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	now := time.Now()
+	job.Finished = &now
+	job.endStage(appErr)
+
+	if appErr != nil {
+		job.Status = JobFailed
+		job.Error = appErr
+		glog.Errorf("Job %s failed: %s", job.ID, appErr)
+	} else {
+		job.Status = JobSucceeded
+		glog.Infof("Job %s succeeded in %v", job.ID, now.Sub(*job.Started))
+	}
+
+	jobsCounter.With(prometheus.Labels{"status": string(job.Status)}).Inc()
+	auditJob(job)
+
+	// the request and the Fasit client hold the credentials of the user and the uploaded policy files, which finished
+	// jobs kept in the history don't need
+	job.request = NamedConfigurationRequest{}
+	job.fasit = nil
+}
+
+// stage marks the running stage as succeeded and starts a new one. It fails instead if the job lost its lock, so the
+// job stops before changing anything else.
+func (job *Job) stage(name string) *AppError {
+	if job == nil {
+		return nil
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	if job.lockErr != nil {
+		return job.lockErr
+	}
+
+	job.endStage(nil)
+	job.Stages = append(job.Stages, Stage{Name: name, Status: JobRunning, Started: time.Now()})
+	return nil
+}
+
+// lockLost records that the lock of the job was lost, failing the job at its next stage
+func (job *Job) lockLost(appErr *AppError) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.lockErr = appErr
+}
+
+// lockError returns why the job lost its lock, if it did
+func (job *Job) lockError() *AppError {
+	job.mutex.RLock()
+	defer job.mutex.RUnlock()
+
+	return job.lockErr
+}
+
+// result sets the summary shown when the job has succeeded
+func (job *Job) result(message string) {
+	if job == nil {
+		return
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Message = message
+}
+
+// agentDiff records the differences found when updating the agent
+func (job *Job) agentDiff(diff []FieldDiff) {
+	if job == nil {
+		return
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.AgentDiff = diff
+}
+
+// scriptResult records the output of the policy script run by the job
+func (job *Job) scriptResult(result *ScriptResult) {
+	if job == nil {
+		return
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Script = result
+}
+
+// waitingFor tells that the job is queued behind the job holding the lock of its application and environment
+func (job *Job) waitingFor(holder string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.Message = "Waiting for job " + holder + " configuring " + configurationLockKey(job.Application, job.Environment)
+}
+
+// policyDigests records the digests of the policy files applied by the job
+func (job *Job) policyDigests(digests []PolicyDigest) {
+	if job == nil {
+		return
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.PolicyDigests = digests
+}
+
+// endStage finishes the running stage, if any. Callers must hold the lock.
+func (job *Job) endStage(appErr *AppError) {
+	if len(job.Stages) == 0 {
+		return
+	}
+
+	current := &job.Stages[len(job.Stages)-1]
+	if current.Status != JobRunning {
+		return
+	}
+
+	now := time.Now()
+	current.Finished = &now
+	current.DurationMs = now.Sub(current.Started).Nanoseconds() / int64(time.Millisecond)
+	current.Status = JobSucceeded
+	if appErr != nil {
+		current.Status = JobFailed
+		current.Error = appErr.Error()
+	}
+}
+
+func (job *Job) done() bool {
+	job.mutex.RLock()
+	defer job.mutex.RUnlock()
+
+	return job.Status == JobSucceeded || job.Status == JobFailed
+}
+
+// MarshalJSON encodes a consistent snapshot of the job
+func (job *Job) MarshalJSON() ([]byte, error) {
+	job.mutex.RLock()
+	defer job.mutex.RUnlock()
+
+	type jobSnapshot struct {
+		ID            string         `json:"id"`
+		Application   string         `json:"application"`
+		Environment   string         `json:"environment"`
+		Zone          string         `json:"zone"`
+		Status        JobStatus      `json:"status"`
+		Stages        []Stage        `json:"stages"`
+		Created       time.Time      `json:"created"`
+		Started       *time.Time     `json:"started,omitempty"`
+		Finished      *time.Time     `json:"finished,omitempty"`
+		Message       string         `json:"message,omitempty"`
+		AgentDiff     []FieldDiff    `json:"agentDiff,omitempty"`
+		PolicyDigests []PolicyDigest `json:"policyDigests,omitempty"`
+		Script        *ScriptResult  `json:"script,omitempty"`
+		Error         *AppError      `json:"error,omitempty"`
+	}
+
+	return json.Marshal(jobSnapshot{
+		ID:            job.ID,
+		Application:   job.Application,
+		Environment:   job.Environment,
+		Zone:          job.Zone,
+		Status:        job.Status,
+		Stages:        append([]Stage{}, job.Stages...),
+		Created:       job.Created,
+		Started:       job.Started,
+		Finished:      job.Finished,
+		Message:       job.Message,
+		AgentDiff:     job.AgentDiff,
+		PolicyDigests: job.PolicyDigests,
+		Script:        job.Script,
+		Error:         job.Error,
+	})
+}
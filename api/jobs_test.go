@@ -0,0 +1,264 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureQueuesJob(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss", Jobs: NewJobPool(0, 1, 10)}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	jsn, _ := json.Marshal(CreateConfigurationRequest("testapp", "1.0", "t0", "user", "pass", []string{"/test"}))
+	req, _ := http.NewRequest("POST", "/configure", strings.NewReader(string(jsn)))
+
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+
+	var job Job
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+	assert.Equal(t, JobQueued, job.Status)
+	assert.Equal(t, "/jobs/"+job.ID, rr.Header().Get("Location"))
+
+	req, _ = http.NewRequest("GET", "/jobs/"+job.ID, nil)
+	rr = httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), job.ID)
+}
+
+func TestUnknownJobGivesNotFound(t *testing.T) {
+	api := API{Jobs: NewJobPool(0, 1, 10)}
+
+	req, _ := http.NewRequest("GET", "/jobs/doesnotexist", nil)
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestFullQueueRejectsJob(t *testing.T) {
+	pool := NewJobPool(0, 1, 10)
+
+	first, _ := NewJob(nil, nil, NamedConfigurationRequest{}, ZoneFss)
+	second, _ := NewJob(nil, nil, NamedConfigurationRequest{}, ZoneFss)
+
+	assert.Nil(t, pool.Submit(first))
+	appErr := pool.Submit(second)
+	assert.NotNil(t, appErr)
+	assert.Equal(t, http.StatusServiceUnavailable, appErr.StatusCode)
+
+	_, exists := pool.Get(second.ID)
+	assert.False(t, exists)
+}
+
+func TestFinishedJobsAreEvicted(t *testing.T) {
+	pool := NewJobPool(0, 3, 2)
+
+	jobs := []*Job{}
+	for i := 0; i < 3; i++ {
+		job, _ := NewJob(nil, nil, NamedConfigurationRequest{}, ZoneFss)
+		jobs = append(jobs, job)
+	}
+
+	pool.Submit(jobs[0])
+	jobs[0].start()
+	jobs[0].finish(nil)
+	pool.Submit(jobs[1])
+	pool.Submit(jobs[2])
+
+	_, exists := pool.Get(jobs[0].ID)
+	assert.False(t, exists)
+	_, exists = pool.Get(jobs[1].ID)
+	assert.True(t, exists)
+	_, exists = pool.Get(jobs[2].ID)
+	assert.True(t, exists)
+}
+
+func TestDrainFinishesQueuedJobs(t *testing.T) {
+	fasit := newStubFasit()
+	defer fasit.Close()
+
+	pool := NewJobPool(1, 2, 10)
+
+	queued := newStubJob(fasit, "testapp")
+	assert.Nil(t, pool.Submit(queued))
+
+	assert.True(t, pool.Drain(5*time.Second))
+	assert.True(t, queued.done())
+	assertStubJobRan(t, queued)
+
+	late := newStubJob(fasit, "testapp")
+	appErr := pool.Submit(late)
+	assert.NotNil(t, appErr)
+	assert.Equal(t, http.StatusServiceUnavailable, appErr.StatusCode)
+}
+
+func TestWaitingJobDoesNotHoldWorker(t *testing.T) {
+	locker := NewMemoryLocker()
+	SetConfigurationLock(locker, LockQueue)
+	defer SetConfigurationLock(NewMemoryLocker(), LockQueue)
+	locker.TryLock(configurationLockKey("testapp", "t0"), "running")
+
+	fasit := newStubFasit()
+	defer fasit.Close()
+
+	pool := NewJobPool(1, 2, 10)
+	waiting := newStubJob(fasit, "testapp")
+	other := newStubJob(fasit, "otherapp")
+	assert.Nil(t, pool.Submit(waiting))
+	assert.Nil(t, pool.Submit(other))
+
+	assert.True(t, eventually(other.done), "a job for another application runs while the first one waits")
+	assertStubJobRan(t, other)
+	assert.False(t, waiting.done())
+	assert.Equal(t, "Waiting for job running configuring testapp/t0", waiting.Message)
+
+	locker.Unlock(configurationLockKey("testapp", "t0"), "running")
+	assert.True(t, eventually(waiting.done), "the waiting job runs when the lock is released")
+	assertStubJobRan(t, waiting)
+	assert.Empty(t, waiting.Message)
+}
+
+// newStubFasit starts a Fasit answering every lookup with 404, so a job fails at its first stage without reaching AM
+func newStubFasit() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+}
+
+// newStubJob creates an FSS job for the application in t0, looking up its resources in the stub Fasit
+func newStubJob(fasit *httptest.Server, application string) *Job {
+	api := &API{FasitURL: fasit.URL, ClusterName: "dev-fss"}
+	job, _ := NewJob(api, &FasitClient{fasit.URL, "user", "pass"},
+		NamedConfigurationRequest{Application: application, Environment: "t0"}, ZoneFss)
+	return job
+}
+
+// assertStubJobRan checks that the job ran until the stub Fasit rejected its lookup
+func assertStubJobRan(t *testing.T, job *Job) {
+	job.mutex.RLock()
+	defer job.mutex.RUnlock()
+
+	assert.Equal(t, JobFailed, job.Status)
+	assert.NotNil(t, job.Started)
+	if assert.NotNil(t, job.Error) {
+		assert.Equal(t, http.StatusNotFound, job.Error.StatusCode)
+		assert.Contains(t, job.Error.Message, "application="+job.Application)
+	}
+	if assert.Len(t, job.Stages, 1) {
+		assert.Equal(t, StageFasitLookup, job.Stages[0].Name)
+		assert.Equal(t, JobFailed, job.Stages[0].Status)
+	}
+}
+
+func TestDrainFailsParkedJobs(t *testing.T) {
+	locker := NewMemoryLocker()
+	SetConfigurationLock(locker, LockQueue)
+	defer SetConfigurationLock(NewMemoryLocker(), LockQueue)
+	locker.TryLock(configurationLockKey("testapp", "t0"), "running")
+
+	pool := NewJobPool(1, 2, 10)
+	waiting, _ := NewJob(nil, nil, NamedConfigurationRequest{Application: "testapp", Environment: "t0"}, ZoneFss)
+	assert.Nil(t, pool.Submit(waiting))
+	assert.True(t, eventually(func() bool {
+		waiting.mutex.RLock()
+		defer waiting.mutex.RUnlock()
+		return len(waiting.Message) > 0
+	}))
+
+	assert.True(t, pool.Drain(5*time.Second))
+	assert.Equal(t, JobFailed, waiting.Status)
+	assert.Equal(t, http.StatusServiceUnavailable, waiting.Error.StatusCode)
+}
+
+// eventually polls the condition until it holds, for at most a few retries of a parked job
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(3 * lockRetryInterval); time.Now().Before(deadline); {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func TestJobStages(t *testing.T) {
+	job, _ := NewJob(nil, nil, NamedConfigurationRequest{}, ZoneFss)
+
+	job.start()
+	job.stage(StageFasitLookup)
+	job.stage(StageAgentCreation)
+	job.finish(&AppError{errors.New("boom"), "AM agent creation failed", http.StatusBadRequest})
+
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Len(t, job.Stages, 2)
+	assert.Equal(t, JobSucceeded, job.Stages[0].Status)
+	assert.NotNil(t, job.Stages[0].Finished)
+	assert.Equal(t, JobFailed, job.Stages[1].Status)
+	assert.Contains(t, job.Stages[1].Error, "AM agent creation failed")
+
+	var decoded Job
+	jsn, _ := json.Marshal(job)
+	assert.NoError(t, json.Unmarshal(jsn, &decoded))
+	assert.Equal(t, "AM agent creation failed: boom (400)", decoded.Error.Error())
+}
+
+func TestFinishedJobForgetsCredentials(t *testing.T) {
+	job, _ := NewJob(nil, &FasitClient{"https://fasit.local", "user", "pass"},
+		NamedConfigurationRequest{Application: "testapp", Environment: "t0", Username: "user", Password: "pass"}, ZoneFss)
+
+	job.start()
+	job.finish(nil)
+
+	assert.Equal(t, NamedConfigurationRequest{}, job.request)
+	assert.Nil(t, job.fasit)
+	assert.Equal(t, "testapp", job.Application)
+}
+
+func TestFinishedJobDropsUploadedPolicyFiles(t *testing.T) {
+	fasit := newStubFasit()
+	defer fasit.Close()
+
+	content := []byte("<Policies />")
+	job, _ := NewJob(&API{FasitURL: fasit.URL, ClusterName: "dev-sbs"}, &FasitClient{fasit.URL, "user", "pass"},
+		NamedConfigurationRequest{Application: "testapp", Environment: "t0",
+			PolicyFiles: map[string][]byte{policyFileName: content}}, ZoneSbs)
+
+	job.run()
+
+	assert.Equal(t, JobFailed, job.Status)
+	assert.Nil(t, job.request.PolicyFiles)
+	assert.Equal(t, []PolicyDigest{newPolicyDigest(policyFileName, policyUploadSource, content)}, job.PolicyDigests)
+}
+
+func TestJobRecordsPolicyDigests(t *testing.T) {
+	job, _ := NewJob(nil, nil, NamedConfigurationRequest{Application: "testapp", Version: "1.0"}, ZoneFss)
+
+	job.start()
+	job.policyDigests([]PolicyDigest{{File: "app-policies.xml", Source: policyUploadSource, SHA256: "abc"}})
+	job.finish(nil)
+
+	jsn, _ := json.Marshal(job)
+	assert.Contains(t, string(jsn), `"policyDigests":[{"file":"app-policies.xml","source":"upload","sha256":"abc"}]`)
+}
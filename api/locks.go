@@ -0,0 +1,562 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// How a configuration request is handled while another one for the same application and environment is running,
+// selected with the lockMode flag
+const (
+	// LockQueue puts the job back on the queue until the running job is done
+	LockQueue = "queue"
+	// LockReject rejects the request with 409 Conflict
+	LockReject = "reject"
+)
+
+// Lock backends, selected with the lockBackend flag
+const (
+	// LockBackendMemory only coordinates the jobs of a single named
+	LockBackendMemory = "memory"
+	// LockBackendLease coordinates all replicas through Kubernetes leases in the namespace of named
+	LockBackendLease = "lease"
+)
+
+const (
+	// lockLeaseDuration is how long a lease is held without being renewed, so a lock held by a killed replica is
+	// released after a while
+	lockLeaseDuration = time.Minute
+	lockRenewInterval = lockLeaseDuration / 3
+	// lockRetryInterval is how long a job waiting for a lock is parked before it is queued again
+	lockRetryInterval = 2 * time.Second
+	// requestLockWaitTimeout is how long a request handled outside the job pool waits for a lock, as its client
+	// waits for the response
+	requestLockWaitTimeout = 30 * time.Second
+	// lockWaitTimeout is how long a queued job waits for a lock before failing
+	lockWaitTimeout     = 10 * time.Minute
+	serviceAccountDir   = "/var/run/secrets/kubernetes.io/serviceaccount"
+	leaseTimeFormat     = "2006-01-02T15:04:05.000000Z07:00"
+	leaseAPIPath        = "/apis/coordination.k8s.io/v1/namespaces/%s/leases"
+	maxLeaseNameLength  = 63
+	leaseHashLength     = 8
+	leaseNamePrefix     = "named-"
+	leaseRequestTimeout = 10 * time.Second
+)
+
+// Locker holds locks on keys for jobs. Taking a lock again with the same job renews it.
+type Locker interface {
+	// TryLock takes the lock of the key for the job, or returns the ID of the job holding it
+	TryLock(key, jobID string) (bool, string, error)
+	// Unlock releases the lock of the key if the job holds it
+	Unlock(key, jobID string) error
+	// String describes the backend for logging
+	String() string
+}
+
+// MemoryLocker keeps locks in memory
+type MemoryLocker struct {
+	holders map[string]string
+	mutex   sync.Mutex
+}
+
+// LeaseLocker keeps locks as coordination.k8s.io leases, named after the key. The holder identity of a lease is the
+// job ID, and a lease not renewed within its duration may be taken by another job.
+type LeaseLocker struct {
+	URL       string
+	Namespace string
+	token     string
+	client    *http.Client
+}
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+}
+
+var (
+	configurationLocker Locker = NewMemoryLocker()
+	lockMode                   = LockQueue
+	invalidLeaseName           = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// SetConfigurationLock sets the backend of the locks taken per application and environment, and whether requests
+// wait for or are rejected by a running job
+func SetConfigurationLock(locker Locker, mode string) {
+	configurationLocker = locker
+	lockMode = mode
+}
+
+// NewLocker creates a locker for the backend. The namespace of the leases defaults to the one named runs in.
+func NewLocker(backend, namespace string) (Locker, error) {
+	switch backend {
+	case LockBackendMemory:
+		return NewMemoryLocker(), nil
+	case LockBackendLease:
+		return NewInClusterLeaseLocker(namespace)
+	}
+
+	return nil, fmt.Errorf("lock backend has to be %s or %s, not %s", LockBackendMemory, LockBackendLease, backend)
+}
+
+// NewMemoryLocker creates an empty in-memory locker
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{holders: map[string]string{}}
+}
+
+// TryLock takes the lock if no other job holds it
+func (l *MemoryLocker) TryLock(key, jobID string) (bool, string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if holder, ok := l.holders[key]; ok && holder != jobID {
+		return false, holder, nil
+	}
+	l.holders[key] = jobID
+	return true, jobID, nil
+}
+
+// Unlock releases the lock if the job holds it
+func (l *MemoryLocker) Unlock(key, jobID string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.holders[key] == jobID {
+		delete(l.holders, key)
+	}
+	return nil
+}
+
+func (l *MemoryLocker) String() string {
+	return "memory"
+}
+
+// NewLeaseLocker creates a locker keeping leases in the namespace of the Kubernetes API at the URL
+func NewLeaseLocker(url, namespace, token string, client *http.Client) *LeaseLocker {
+	return &LeaseLocker{URL: strings.TrimRight(url, "/"), Namespace: namespace, token: token, client: client}
+}
+
+// NewInClusterLeaseLocker creates a lease locker with the service account of the pod
+func NewInClusterLeaseLocker(namespace string) (*LeaseLocker, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("lease locks only work in Kubernetes, KUBERNETES_SERVICE_HOST is not set")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in service account CA")
+	}
+
+	if len(namespace) == 0 {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("could not read namespace of service account: %s", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	client := &http.Client{
+		Timeout:   leaseRequestTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	return NewLeaseLocker("https://"+host+":"+port, namespace, strings.TrimSpace(string(token)), client), nil
+}
+
+// TryLock creates the lease, or takes it over when it is free or expired. Conflicting writes by other replicas are
+// detected through the resource version of the lease.
+func (l *LeaseLocker) TryLock(key, jobID string) (bool, string, error) {
+	name := leaseName(key)
+	now := time.Now()
+
+	current, status, err := l.get(name)
+	if err != nil {
+		return false, "", err
+	}
+
+	if status == http.StatusNotFound {
+		created := newLease(name, jobID, now)
+		status, err = l.send(http.MethodPost, fmt.Sprintf(leaseAPIPath, l.Namespace), created)
+		if err != nil {
+			return false, "", err
+		}
+		if status == http.StatusConflict {
+			return l.holder(name)
+		}
+		return true, jobID, nil
+	}
+
+	holder := current.Spec.HolderIdentity
+	if len(holder) > 0 && holder != jobID && !current.expired(now) {
+		return false, holder, nil
+	}
+
+	if holder != jobID {
+		current.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+	}
+	current.Spec.HolderIdentity = jobID
+	current.Spec.LeaseDurationSeconds = int(lockLeaseDuration.Seconds())
+	current.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+
+	// the resource version in the metadata makes the update fail if another replica got there first
+	status, err = l.send(http.MethodPut, fmt.Sprintf(leaseAPIPath+"/%s", l.Namespace, name), current)
+	if err != nil {
+		return false, "", err
+	}
+	if status == http.StatusConflict {
+		return l.holder(name)
+	}
+	return true, jobID, nil
+}
+
+// Unlock clears the holder of the lease if the job holds it
+func (l *LeaseLocker) Unlock(key, jobID string) error {
+	name := leaseName(key)
+
+	current, status, err := l.get(name)
+	if err != nil || status == http.StatusNotFound || current.Spec.HolderIdentity != jobID {
+		return err
+	}
+
+	current.Spec.HolderIdentity = ""
+	current.Spec.AcquireTime = ""
+	current.Spec.RenewTime = ""
+	if _, err := l.send(http.MethodPut, fmt.Sprintf(leaseAPIPath+"/%s", l.Namespace, name), current); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l *LeaseLocker) String() string {
+	return "leases in namespace " + l.Namespace
+}
+
+// holder returns the job holding the lease after losing a race for it
+func (l *LeaseLocker) holder(name string) (bool, string, error) {
+	current, _, err := l.get(name)
+	if err != nil || current == nil {
+		return false, "", err
+	}
+	return false, current.Spec.HolderIdentity, nil
+}
+
+func (l *LeaseLocker) get(name string) (*lease, int, error) {
+	req, err := http.NewRequest(http.MethodGet, l.URL+fmt.Sprintf(leaseAPIPath+"/%s", l.Namespace, name), nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not create lease request: %s", err)
+	}
+
+	body, status, err := l.do(req)
+	if err != nil || status == http.StatusNotFound {
+		return nil, status, err
+	}
+
+	var current lease
+	if err := json.Unmarshal(body, &current); err != nil {
+		return nil, 0, fmt.Errorf("could not read lease %s: %s", name, err)
+	}
+	return &current, status, nil
+}
+
+// send writes the lease, returning the status code when the write was refused with 409 Conflict
+func (l *LeaseLocker) send(method, path string, payload *lease) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("could not marshal lease: %s", err)
+	}
+
+	req, err := http.NewRequest(method, l.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("could not create lease request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	_, status, err := l.do(req)
+	return status, err
+}
+
+// do sends the request, treating every status but 404 Not Found and 409 Conflict above 299 as an error
+func (l *LeaseLocker) do(req *http.Request) ([]byte, int, error) {
+	if len(l.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s %s failed: %s", req.Method, req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not read response from %s: %s", req.URL, err)
+	}
+
+	if resp.StatusCode > 299 && resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusConflict {
+		return nil, resp.StatusCode, fmt.Errorf("got HTTP status code %d from %s %s: %s", resp.StatusCode,
+			req.Method, req.URL, string(body))
+	}
+	return body, resp.StatusCode, nil
+}
+
+func newLease(name, jobID string, now time.Time) *lease {
+	return &lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: name},
+		Spec: leaseSpec{
+			HolderIdentity:       jobID,
+			LeaseDurationSeconds: int(lockLeaseDuration.Seconds()),
+			AcquireTime:          now.UTC().Format(leaseTimeFormat),
+			RenewTime:            now.UTC().Format(leaseTimeFormat),
+		},
+	}
+}
+
+// expired tells whether the holder stopped renewing the lease
+func (l *lease) expired(now time.Time) bool {
+	renewed, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// leaseName turns the key into a valid name for a Kubernetes object. Replacing invalid characters and truncating may
+// give different keys the same name, so the name ends with a hash of the key.
+func leaseName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	suffix := "-" + hex.EncodeToString(hash[:leaseHashLength/2])
+
+	name := leaseNamePrefix + strings.Trim(invalidLeaseName.ReplaceAllString(strings.ToLower(key), "-"), "-")
+	if len(name) > maxLeaseNameLength-len(suffix) {
+		name = strings.TrimRight(name[:maxLeaseNameLength-len(suffix)], "-")
+	}
+	return name + suffix
+}
+
+// configurationLockKey is the key of the lock taken while configuring the application in the environment. The names
+// are escaped, so the / between them can't be part of either name.
+func configurationLockKey(application, environment string) string {
+	return url.PathEscape(application) + "/" + url.PathEscape(environment)
+}
+
+// lockConfiguration takes the lock of the application and environment of the job. It returns the ID of the job
+// holding the lock when it could not be taken.
+func (job *Job) lockConfiguration() (string, *AppError) {
+	key := configurationLockKey(job.Application, job.Environment)
+	locker := configurationLocker
+
+	acquired, holder, err := locker.TryLock(key, job.ID)
+	if err != nil {
+		glog.Errorf("Could not lock %s for job %s: %s", key, job.ID, err)
+		return "", &AppError{err, "Could not lock the configuration of " + key, http.StatusServiceUnavailable}
+	}
+	if !acquired {
+		return holder, lockHeldError(holder, key)
+	}
+
+	stop := make(chan struct{})
+	job.mutex.Lock()
+	job.unlock = func() {
+		close(stop)
+		if err := locker.Unlock(key, job.ID); err != nil {
+			glog.Errorf("Could not unlock %s for job %s: %s", key, job.ID, err)
+		}
+	}
+	job.Message = ""
+	job.mutex.Unlock()
+
+	go renewLock(locker, key, job.ID, stop, job.lockLost)
+	return "", nil
+}
+
+// requestLock is the lock of the application and environment taken by a request handled outside the job pool
+type requestLock struct {
+	stop    chan struct{}
+	release func()
+	lockErr *AppError
+	mutex   sync.Mutex
+}
+
+// lockRequest takes the lock of the application and environment for a request handled outside the job pool, like
+// deconfigure and rotate. The request waits for the holder in queue mode until requestLockWaitTimeout, or until the
+// client goes away, and is rejected in reject mode. It returns the ID of the job holding the lock when it could not
+// be taken.
+func lockRequest(ctx context.Context, operation, application, environment string) (string, *requestLock, *AppError) {
+	id, err := newJobID()
+	if err != nil {
+		return "", nil, &AppError{err, "Unable to create lock id", http.StatusInternalServerError}
+	}
+	id = operation + "-" + id
+
+	key := configurationLockKey(application, environment)
+	locker := configurationLocker
+	deadline := time.Now().Add(requestLockWaitTimeout)
+
+	for {
+		acquired, holder, err := locker.TryLock(key, id)
+		if err != nil {
+			glog.Errorf("Could not lock %s for %s: %s", key, id, err)
+			return "", nil, &AppError{err, "Could not lock the configuration of " + key,
+				http.StatusServiceUnavailable}
+		}
+		if acquired {
+			break
+		}
+
+		if lockMode == LockReject || time.Now().After(deadline) {
+			return holder, nil, lockHeldError(holder, key)
+		}
+
+		select {
+		case <-ctx.Done():
+			return holder, nil, &AppError{ctx.Err(), "Request was cancelled while waiting for the lock of " + key,
+				http.StatusServiceUnavailable}
+		case <-time.After(lockRetryInterval):
+		}
+	}
+
+	lock := &requestLock{stop: make(chan struct{})}
+	lock.release = func() {
+		close(lock.stop)
+		if err := locker.Unlock(key, id); err != nil {
+			glog.Errorf("Could not unlock %s for %s: %s", key, id, err)
+		}
+	}
+
+	go renewLock(locker, key, id, lock.stop, lock.lost)
+	return "", lock, nil
+}
+
+// unlock releases the lock
+func (lock *requestLock) unlock() {
+	lock.release()
+}
+
+// lost records that the lock was lost, failing the request at its next check
+func (lock *requestLock) lost(appErr *AppError) {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	lock.lockErr = appErr
+}
+
+// check returns why the lock was lost, if it was. Requests check it before every change, like jobs do between
+// stages, so nothing is changed once another job may hold the lock.
+func (lock *requestLock) check() *AppError {
+	lock.mutex.Lock()
+	defer lock.mutex.Unlock()
+
+	return lock.lockErr
+}
+
+// lockHeldError tells that the lock of the key is held by another job or request
+func lockHeldError(holder, key string) *AppError {
+	if heldByRequest(holder) {
+		return &AppError{nil, fmt.Sprintf("Request %s is already changing %s", holder, key), http.StatusConflict}
+	}
+	return &AppError{nil, fmt.Sprintf("Job %s is already configuring %s", holder, key), http.StatusConflict}
+}
+
+// lockHolderLocation points the Location header to the job holding a lock, unless it is held by a request
+func lockHolderLocation(w http.ResponseWriter, holder string) {
+	if len(holder) > 0 && !heldByRequest(holder) {
+		w.Header().Set("Location", "/jobs/"+holder)
+	}
+}
+
+// heldByRequest tells whether the lock holder is a request taking the lock with lockRequest, as job IDs have no -
+func heldByRequest(holder string) bool {
+	return strings.Contains(holder, "-")
+}
+
+// unlockConfiguration releases the lock taken by lockConfiguration, if any
+func (job *Job) unlockConfiguration() {
+	job.mutex.Lock()
+	unlock := job.unlock
+	job.unlock = nil
+	job.mutex.Unlock()
+
+	if unlock != nil {
+		unlock()
+	}
+}
+
+// renewLock takes the lock again until stopped, so a lease does not expire while the job is running. The holder is
+// told through lost when the lock is lost.
+func renewLock(locker Locker, key, id string, stop chan struct{}, lost func(*AppError)) {
+	ticker := time.NewTicker(lockRenewInterval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			var appErr *AppError
+			if renewed, appErr = renew(locker, key, id, renewed); appErr != nil {
+				lost(appErr)
+				return
+			}
+		}
+	}
+}
+
+// renew takes the lock again, and returns when it was last renewed. The lock is lost when another job holds it, or
+// when it could expire before the next renewal.
+func renew(locker Locker, key, jobID string, renewed time.Time) (time.Time, *AppError) {
+	acquired, holder, err := locker.TryLock(key, jobID)
+	switch {
+	case err == nil && acquired:
+		return time.Now(), nil
+	case err == nil:
+		glog.Errorf("Job %s lost lock %s to job %s", jobID, key, holder)
+		return renewed, &AppError{nil, fmt.Sprintf("Lost the lock of %s to job %s", key, holder), http.StatusConflict}
+	case time.Since(renewed)+lockRenewInterval >= lockLeaseDuration:
+		glog.Errorf("Could not renew lock %s for job %s before it expires: %s", key, jobID, err)
+		return renewed, &AppError{err, "Could not renew the lock of " + key, http.StatusServiceUnavailable}
+	}
+
+	glog.Warningf("Could not renew lock %s for job %s, retrying: %s", key, jobID, err)
+	return renewed, nil
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLocker(t *testing.T) {
+	locker := NewMemoryLocker()
+
+	acquired, _, err := locker.TryLock("testapp-t0", "job1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, holder, _ := locker.TryLock("testapp-t0", "job2")
+	assert.False(t, acquired)
+	assert.Equal(t, "job1", holder)
+
+	acquired, _, _ = locker.TryLock("testapp-t1", "job2")
+	assert.True(t, acquired)
+
+	assert.NoError(t, locker.Unlock("testapp-t0", "job2"))
+	acquired, _, _ = locker.TryLock("testapp-t0", "job1")
+	assert.True(t, acquired, "a job not holding the lock cannot release it")
+
+	assert.NoError(t, locker.Unlock("testapp-t0", "job1"))
+	acquired, _, _ = locker.TryLock("testapp-t0", "job2")
+	assert.True(t, acquired)
+}
+
+func TestConfigureRejectsRunningApplication(t *testing.T) {
+	SetConfigurationLock(NewMemoryLocker(), LockReject)
+	defer SetConfigurationLock(NewMemoryLocker(), LockQueue)
+
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss", Jobs: NewJobPool(0, 2, 10)}
+	defer gock.Off()
+
+	configure := func() *httptest.ResponseRecorder {
+		gock.New("https://fasit.local").Get("/api/v2/environments/t0").
+			Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+		gock.New("https://fasit.local").Get("/api/v2/applications/testapp").Reply(200)
+
+		jsn, _ := json.Marshal(CreateConfigurationRequest("testapp", "1.0", "t0", "user", "pass", []string{"/test"}))
+		req, _ := http.NewRequest("POST", "/configure", strings.NewReader(string(jsn)))
+		rr := httptest.NewRecorder()
+		api.MakeHandler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := configure()
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var job Job
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &job))
+
+	rr = configure()
+	assert.Equal(t, http.StatusConflict, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Job "+job.ID+" is already configuring testapp/t0")
+	assert.Equal(t, "/jobs/"+job.ID, rr.Header().Get("Location"))
+}
+
+func TestDeconfigureAndRotateTakeTheLock(t *testing.T) {
+	locker := NewMemoryLocker()
+	SetConfigurationLock(locker, LockReject)
+	defer SetConfigurationLock(NewMemoryLocker(), LockQueue)
+	locker.TryLock(configurationLockKey("testapp", "t0"), "0123456789abcdef")
+
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+	defer gock.Off()
+
+	for _, request := range []struct{ method, path string }{
+		{"DELETE", "/configure/testapp/t0"},
+		{"POST", "/rotate/testapp/t0"},
+	} {
+		gock.New("https://fasit.local").Get("/api/v2/environments/t0").
+			Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+		gock.New("https://fasit.local").Get("/api/v2/applications/testapp").Reply(200)
+
+		req, _ := http.NewRequest(request.method, request.path, nil)
+		req.SetBasicAuth("user", "pass")
+		rr := httptest.NewRecorder()
+		api.MakeHandler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusConflict, rr.Code, request.path)
+		assert.Contains(t, rr.Body.String(), "Job 0123456789abcdef is already configuring testapp/t0", request.path)
+		assert.Equal(t, "/jobs/0123456789abcdef", rr.Header().Get("Location"), request.path)
+	}
+}
+
+func TestRequestLockRejectsOtherRequests(t *testing.T) {
+	SetConfigurationLock(NewMemoryLocker(), LockReject)
+	defer SetConfigurationLock(NewMemoryLocker(), LockQueue)
+
+	_, lock, appErr := lockRequest(context.Background(), "deconfigure", "testapp", "t0")
+	assert.Nil(t, appErr)
+
+	holder, _, appErr := lockRequest(context.Background(), "rotate", "testapp", "t0")
+	assert.Equal(t, http.StatusConflict, appErr.StatusCode)
+	assert.Equal(t, "Request "+holder+" is already changing testapp/t0", appErr.Message)
+	assert.True(t, heldByRequest(holder))
+
+	lock.unlock()
+	_, lock, appErr = lockRequest(context.Background(), "rotate", "testapp", "t0")
+	assert.Nil(t, appErr)
+	lock.unlock()
+}
+
+func TestRequestLockStopsWaitingWhenClientIsGone(t *testing.T) {
+	locker := NewMemoryLocker()
+	SetConfigurationLock(locker, LockQueue)
+	defer SetConfigurationLock(NewMemoryLocker(), LockQueue)
+
+	locker.TryLock("testapp/t0", "0123456789abcdef")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	holder, lock, appErr := lockRequest(ctx, "rotate", "testapp", "t0")
+	assert.Nil(t, lock)
+	assert.Equal(t, "0123456789abcdef", holder)
+	assert.Equal(t, http.StatusServiceUnavailable, appErr.StatusCode)
+	assert.Equal(t, "Request was cancelled while waiting for the lock of testapp/t0", appErr.Message)
+}
+
+func TestDeconfigureStopsWhenLockIsLost(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"unlocked\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/agents/testapp-t0").
+		Reply(200)
+
+	lost := &AppError{nil, "Lost the lock of testapp/t0 to job 0123456789abcdef", http.StatusConflict}
+	lock := &requestLock{}
+	lock.lost(lost)
+
+	request := &NamedConfigurationRequest{Application: "testapp", Environment: "t0"}
+	result := DeconfigurationResult{}
+	appErr := deconfigureFSSOpenam(&FasitClient{"https://fasit.local", "user", "pass"}, request, ZoneFss, lock,
+		&result)
+	assert.Equal(t, lost, appErr)
+	assert.Empty(t, result.Removed)
+	assert.True(t, gock.IsDone())
+}
+
+// failingLocker fails every request, like a lease backend that can't be reached
+type failingLocker struct{}
+
+func (failingLocker) TryLock(key, jobID string) (bool, string, error) {
+	return false, "", errors.New("connection refused")
+}
+
+func (failingLocker) Unlock(key, jobID string) error {
+	return errors.New("connection refused")
+}
+
+func (failingLocker) String() string {
+	return "failing"
+}
+
+func TestRenewLock(t *testing.T) {
+	locker := NewMemoryLocker()
+	locker.TryLock("testapp/t0", "job1")
+
+	before := time.Now().Add(-time.Second)
+	renewed, appErr := renew(locker, "testapp/t0", "job1", before)
+	assert.Nil(t, appErr)
+	assert.True(t, renewed.After(before))
+
+	_, appErr = renew(locker, "testapp/t0", "job2", before)
+	assert.Equal(t, http.StatusConflict, appErr.StatusCode)
+	assert.Equal(t, "Lost the lock of testapp/t0 to job job1", appErr.Message)
+
+	renewed, appErr = renew(failingLocker{}, "testapp/t0", "job1", before)
+	assert.Nil(t, appErr, "a failed renewal is retried while the lock can't expire before the next one")
+	assert.Equal(t, before, renewed)
+
+	_, appErr = renew(failingLocker{}, "testapp/t0", "job1", time.Now().Add(-lockLeaseDuration+lockRenewInterval))
+	assert.Equal(t, http.StatusServiceUnavailable, appErr.StatusCode)
+}
+
+func TestJobStopsWhenLockIsLost(t *testing.T) {
+	job, _ := NewJob(nil, nil, NamedConfigurationRequest{Application: "testapp", Environment: "t0"}, ZoneFss)
+	job.start()
+	assert.Nil(t, job.stage(StageFasitLookup))
+
+	lost := &AppError{nil, "Lost the lock of testapp/t0 to job job2", http.StatusConflict}
+	job.lockLost(lost)
+	assert.Equal(t, lost, job.stage(StageAgentCreation))
+	assert.Len(t, job.Stages, 1)
+}
+
+func TestLeaseLocker(t *testing.T) {
+	defer gock.Off()
+
+	const leases = "/apis/coordination.k8s.io/v1/namespaces/nais/leases"
+	name := leaseName("testapp/t0")
+	locker := NewLeaseLocker("https://kubernetes.local", "nais", "token", http.DefaultClient)
+
+	gock.New("https://kubernetes.local").Get(leases + "/" + name).Reply(404)
+	gock.New("https://kubernetes.local").Post(leases).
+		MatchHeader("Authorization", "Bearer token").
+		BodyString(`"holderIdentity":"job1"`).
+		Reply(201)
+
+	acquired, _, err := locker.TryLock("testapp/t0", "job1")
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	held := func(renewed time.Time) string {
+		return fmt.Sprintf(`{"metadata": {"name": "%s", "resourceVersion": "42"}, "spec": {
+			"holderIdentity": "job1", "leaseDurationSeconds": 60, "renewTime": "%s"}}`,
+			name, renewed.UTC().Format(leaseTimeFormat))
+	}
+
+	gock.New("https://kubernetes.local").Get(leases + "/" + name).Reply(200).BodyString(held(time.Now()))
+
+	acquired, holder, err := locker.TryLock("testapp/t0", "job2")
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, "job1", holder)
+
+	gock.New("https://kubernetes.local").Get(leases + "/" + name).
+		Reply(200).BodyString(held(time.Now().Add(-2 * time.Minute)))
+	gock.New("https://kubernetes.local").Put(leases + "/" + name).
+		BodyString(`"resourceVersion":"42".*"holderIdentity":"job2"`).
+		Reply(200)
+
+	acquired, _, err = locker.TryLock("testapp/t0", "job2")
+	assert.NoError(t, err)
+	assert.True(t, acquired, "an expired lease is taken over")
+	assert.True(t, gock.IsDone())
+}
+
+func TestLeaseName(t *testing.T) {
+	assert.Regexp(t, "^named-my-app-t0-[0-9a-f]{8}$", leaseName("My_App/t0"))
+	assert.NotEqual(t, leaseName("my-app/t0"), leaseName("my_app/t0"))
+
+	long := strings.Repeat("a", 100)
+	assert.Len(t, leaseName(long+"/t0"), maxLeaseNameLength)
+	assert.NotEqual(t, leaseName(long+"/t0"), leaseName(long+"/t1"))
+}
+
+func TestConfigurationLockKey(t *testing.T) {
+	assert.Equal(t, "testapp/t0", configurationLockKey("testapp", "t0"))
+	assert.NotEqual(t, configurationLockKey("a/b", "c"), configurationLockKey("a", "b/c"))
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Default OAuth2 client settings, used for settings not given in the configuration request
+const (
+	DefaultIDTokenSignedResponseAlg = "RS256"
+	DefaultClientType               = ClientTypeConfidential
+	defaultScope                    = "openid"
+)
+
+// OAuth2 client types supported by AM
+const (
+	ClientTypeConfidential = "Confidential"
+	ClientTypePublic       = "Public"
+)
+
+var supportedIDTokenAlgorithms = []string{
+	"RS256", "RS384", "RS512",
+	"HS256", "HS384", "HS512",
+	"ES256", "ES384", "ES512",
+}
+
+// OAuth2Settings contains the OAuth2 client settings of the ISSO agent. Lifetimes are given in seconds.
+// Post logout redirection uris and lifetimes not given are left as they are on an existing agent, an empty list or a
+// lifetime of 0 clears them.
+type OAuth2Settings struct {
+	Scopes                   []string `json:"scopes,omitempty"`
+	IDTokenSignedResponseAlg string   `json:"idTokenSignedResponseAlg,omitempty"`
+	PostLogoutRedirectUris   []string `json:"postLogoutRedirectUris"`
+	AccessTokenLifetime      *int     `json:"accessTokenLifetime,omitempty"`
+	RefreshTokenLifetime     *int     `json:"refreshTokenLifetime,omitempty"`
+	ClientType               string   `json:"clientType,omitempty"`
+	ConsentImplied           *bool    `json:"consentImplied,omitempty"`
+}
+
+// withDefaults returns the settings with defaults for everything not set
+func (settings *OAuth2Settings) withDefaults() OAuth2Settings {
+	s := OAuth2Settings{}
+	if settings != nil {
+		s = *settings
+	}
+
+	if len(s.Scopes) == 0 {
+		s.Scopes = []string{defaultScope}
+	}
+	if len(s.IDTokenSignedResponseAlg) == 0 {
+		s.IDTokenSignedResponseAlg = DefaultIDTokenSignedResponseAlg
+	}
+	if len(s.ClientType) == 0 {
+		s.ClientType = DefaultClientType
+	}
+	if s.ConsentImplied == nil {
+		consentImplied := true
+		s.ConsentImplied = &consentImplied
+	}
+
+	return s
+}
+
+// Validate performs validation of OAuth2Settings
+func (settings OAuth2Settings) Validate() []error {
+	var errs []error
+
+	if len(settings.Scopes) > 0 && !contains(settings.Scopes, defaultScope) {
+		errs = append(errs, fmt.Errorf("oauth2.scopes must include %s", defaultScope))
+	}
+	for _, scope := range settings.Scopes {
+		if len(scope) == 0 || strings.ContainsAny(scope, " \t\n\"\\") {
+			errs = append(errs, fmt.Errorf("oauth2.scopes contains invalid scope '%s'", scope))
+		}
+	}
+
+	if len(settings.IDTokenSignedResponseAlg) > 0 && !contains(supportedIDTokenAlgorithms, settings.IDTokenSignedResponseAlg) {
+		errs = append(errs, fmt.Errorf("oauth2.idTokenSignedResponseAlg must be one of %s, not %s",
+			strings.Join(supportedIDTokenAlgorithms, ", "), settings.IDTokenSignedResponseAlg))
+	}
+
+	for _, uri := range settings.PostLogoutRedirectUris {
+		u, err := url.Parse(uri)
+		if err != nil || u.Scheme != "https" || len(u.Host) == 0 {
+			errs = append(errs, fmt.Errorf("oauth2.postLogoutRedirectUris must be absolute https urls, not '%s'", uri))
+		}
+	}
+
+	if settings.AccessTokenLifetime != nil && *settings.AccessTokenLifetime < 0 {
+		errs = append(errs, fmt.Errorf("oauth2.accessTokenLifetime can not be negative"))
+	}
+	if settings.RefreshTokenLifetime != nil && *settings.RefreshTokenLifetime < 0 {
+		errs = append(errs, fmt.Errorf("oauth2.refreshTokenLifetime can not be negative"))
+	}
+
+	if len(settings.ClientType) > 0 && settings.ClientType != ClientTypeConfidential && settings.ClientType != ClientTypePublic {
+		errs = append(errs, fmt.Errorf("oauth2.clientType must be %s or %s, not %s", ClientTypeConfidential,
+			ClientTypePublic, settings.ClientType))
+	}
+
+	return errs
+}
+
+// indexed returns the values in the [n]=value format AM uses for lists
+func indexed(values []string) []string {
+	indexedValues := []string{}
+	for i, value := range values {
+		indexedValues = append(indexedValues, fmt.Sprintf("[%d]=%s", i, value))
+	}
+	return indexedValues
+}
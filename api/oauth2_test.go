@@ -0,0 +1,75 @@
+package api
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAgentPayload(t *testing.T) {
+	payload := buildAgentPayload("testAgent", "secret", []string{}, nil)
+
+	assert.Equal(t, "OAuth2Client", payload.AgentType)
+	assert.Equal(t, "RS256", payload.Algorithm)
+	assert.Equal(t, []string{"[0]=openid"}, payload.Scopes)
+	assert.Equal(t, "true", payload.ConsentImplied)
+	assert.Equal(t, ClientTypeConfidential, payload.ClientType)
+	assert.Empty(t, payload.PostLogoutRedirectUris)
+	assert.Empty(t, payload.AccessTokenLifetime)
+}
+
+func TestAgentPayloadWithOAuth2Settings(t *testing.T) {
+	consentImplied := false
+	accessTokenLifetime := 3600
+	payload := buildAgentPayload("testAgent", "secret", []string{}, &OAuth2Settings{
+		Scopes:                   []string{"openid", "profile"},
+		IDTokenSignedResponseAlg: "ES256",
+		PostLogoutRedirectUris:   []string{"https://testapp.domain/loggedout"},
+		AccessTokenLifetime:      &accessTokenLifetime,
+		ClientType:               ClientTypePublic,
+		ConsentImplied:           &consentImplied,
+	})
+
+	assert.Equal(t, "ES256", payload.Algorithm)
+	assert.Equal(t, []string{"[0]=openid", "[1]=profile"}, payload.Scopes)
+	assert.Equal(t, "false", payload.ConsentImplied)
+	assert.Equal(t, ClientTypePublic, payload.ClientType)
+	assert.Equal(t, []string{"[0]=https://testapp.domain/loggedout"}, payload.PostLogoutRedirectUris)
+	assert.Equal(t, "3600", payload.AccessTokenLifetime)
+	assert.Empty(t, payload.RefreshTokenLifetime)
+	assert.Empty(t, payload.cleared)
+}
+
+func TestAgentPayloadClearingOAuth2Settings(t *testing.T) {
+	refreshTokenLifetime := 0
+	payload := buildAgentPayload("testAgent", "secret", []string{}, &OAuth2Settings{
+		PostLogoutRedirectUris: []string{},
+		RefreshTokenLifetime:   &refreshTokenLifetime,
+	})
+
+	assert.Empty(t, payload.PostLogoutRedirectUris)
+	assert.Empty(t, payload.RefreshTokenLifetime)
+	assert.Equal(t, []string{postLogoutRedirectUrisAttribute, refreshTokenLifetimeAttribute}, payload.cleared)
+}
+
+func TestValidateOAuth2Settings(t *testing.T) {
+	assert.Empty(t, OAuth2Settings{}.Validate())
+
+	negative := -1
+	errs := OAuth2Settings{
+		Scopes:                   []string{"profile", "has space"},
+		IDTokenSignedResponseAlg: "none",
+		PostLogoutRedirectUris:   []string{"http://testapp.domain/loggedout", "/relative"},
+		AccessTokenLifetime:      &negative,
+		ClientType:               "Secret",
+	}.Validate()
+
+	assert.Contains(t, errs, errors.New("oauth2.scopes must include openid"))
+	assert.Contains(t, errs, errors.New("oauth2.scopes contains invalid scope 'has space'"))
+	assert.Contains(t, errs, errors.New("oauth2.idTokenSignedResponseAlg must be one of RS256, RS384, RS512, HS256, HS384, HS512, ES256, ES384, ES512, not none"))
+	assert.Contains(t, errs, errors.New("oauth2.postLogoutRedirectUris must be absolute https urls, not 'http://testapp.domain/loggedout'"))
+	assert.Contains(t, errs, errors.New("oauth2.postLogoutRedirectUris must be absolute https urls, not '/relative'"))
+	assert.Contains(t, errs, errors.New("oauth2.accessTokenLifetime can not be negative"))
+	assert.Contains(t, errs, errors.New("oauth2.clientType must be Confidential or Public, not Secret"))
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const maskedSecret = "********"
+
+// AgentPlan describes the ISSO agent a configuration would create
+type AgentPlan struct {
+	Name            string       `json:"name"`
+	Exists          bool         `json:"exists"`
+	Action          string       `json:"action"`
+	Payload         agentPayload `json:"payload"`
+	RedirectionUris []string     `json:"redirectionUris"`
+	Diff            []FieldDiff  `json:"diff,omitempty"`
+}
+
+// FasitResourcePlan describes the OpenIdConnect resource a configuration would write to Fasit
+type FasitResourcePlan struct {
+	Method   string        `json:"method"`
+	Resource FasitResource `json:"resource"`
+}
+
+// PolicyFilePlan contains a policy file as it would be copied to the AM server
+type PolicyFilePlan struct {
+	Name    string `json:"name"`
+	Content string `json:"content"`
+}
+
+// ConfigurationPlan describes what a configuration would change, without changing anything
+type ConfigurationPlan struct {
+	Application   string             `json:"application"`
+	Environment   string             `json:"environment"`
+	Zone          string             `json:"zone"`
+	Agent         *AgentPlan         `json:"agent,omitempty"`
+	FasitResource *FasitResourcePlan `json:"fasitResource,omitempty"`
+	PolicyFiles   []PolicyFilePlan   `json:"policyFiles,omitempty"`
+	PolicyDigests []PolicyDigest     `json:"policyDigests,omitempty"`
+	Policies      []interface{}      `json:"policies,omitempty"`
+	Commands      []string           `json:"commands,omitempty"`
+}
+
+func planConfiguration(w http.ResponseWriter, fasit *FasitClient, request *NamedConfigurationRequest, zone,
+	policyImport string) *AppError {
+	requests.With(prometheus.Labels{"path": "configure-dryrun"}).Inc()
+
+	plan := ConfigurationPlan{
+		Application: request.Application,
+		Environment: request.Environment,
+		Zone:        zone,
+	}
+
+	var appErr *AppError
+	if ZoneSbs == zone && policyImport == PolicyImportREST {
+		appErr = planSBSImport(fasit, request, zone, &plan)
+	} else if ZoneSbs == zone {
+		appErr = planSBSOpenam(fasit, request, zone, &plan)
+	} else {
+		appErr = planFSSOpenam(fasit, request, zone, &plan)
+	}
+
+	if appErr != nil {
+		return appErr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(plan); err != nil {
+		return &AppError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+func planSBSOpenam(fasit *FasitClient, request *NamedConfigurationRequest, zone string, plan *ConfigurationPlan) *AppError {
+	openamResource, apErr := fasit.GetOpenAmResource(ResourceRequest{"OpenAM", "OpenAM"},
+		request.Environment, request.Application, zone)
+	if apErr != nil {
+		glog.Errorf("Could not get OpenAM resource: %s", apErr)
+		return apErr
+	}
+
+	workspace, digests, err := GenerateAmFiles(request)
+	if err != nil {
+		glog.Errorf("Could not download am policy files: %s", err)
+		return &AppError{err, "Policy files not found", http.StatusNotFound}
+	}
+	plan.PolicyDigests = digests
+
+	defer workspace.Remove()
+
+	if err := UpdatePolicyFiles(workspace.Files, request.Environment); err != nil {
+		glog.Errorf("Could not update policy files with correct site name %s", err)
+		return &AppError{err, "AM policy files could not be updated", http.StatusBadRequest}
+	}
+
+	plan.Commands = append(plan.Commands, fmt.Sprintf("sftp %s: mkdir %s", openamResource.Hostname, workspace.RemoteDir()))
+	for _, file := range workspace.Files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return &AppError{err, "AM policy files could not be read", http.StatusInternalServerError}
+		}
+
+		plan.PolicyFiles = append(plan.PolicyFiles, PolicyFilePlan{Name: filepath.Base(file), Content: string(content)})
+		plan.Commands = append(plan.Commands, fmt.Sprintf("sftp %s: put %s %s", openamResource.Hostname, file,
+			path.Join(workspace.RemoteDir(), filepath.Base(file))))
+	}
+	plan.Commands = append(plan.Commands, fmt.Sprintf("ssh %s: %s", openamResource.Hostname,
+		amPolicyScriptCommand(request.Application, workspace)))
+	plan.Commands = append(plan.Commands, fmt.Sprintf("sftp %s: rm -r %s", openamResource.Hostname,
+		workspace.RemoteDir()))
+
+	return nil
+}
+
+func planSBSImport(fasit *FasitClient, request *NamedConfigurationRequest, zone string, plan *ConfigurationPlan) *AppError {
+	adminResource, appErr := fasit.GetAmAdminResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	workspace, digests, err := GenerateAmFiles(request)
+	if err != nil {
+		glog.Errorf("Could not download am policy files: %s", err)
+		return &AppError{err, "Policy files not found", http.StatusNotFound}
+	}
+	plan.PolicyDigests = digests
+
+	defer workspace.Remove()
+
+	if err := UpdatePolicyFiles(workspace.Files, request.Environment); err != nil {
+		glog.Errorf("Could not update policy files with correct site name %s", err)
+		return &AppError{err, "AM policy files could not be updated", http.StatusBadRequest}
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	resourceTypeUUID, err := am.resourceTypeUUID(urlResourceType)
+	if err != nil {
+		return &AppError{err, "AM resource types could not be read", http.StatusBadGateway}
+	}
+
+	existing, err := ListPolicy(am)
+	if err != nil {
+		glog.Errorf("Failed to list AM policies: %s", err)
+		return &AppError{err, "Could not list AM policies", http.StatusBadGateway}
+	}
+
+	exists := map[string]bool{}
+	for _, policy := range existing {
+		exists[policy.Name] = true
+	}
+	imported := map[string]bool{}
+
+	for _, file := range workspace.Files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return &AppError{err, "AM policy files could not be read", http.StatusInternalServerError}
+		}
+
+		plan.PolicyFiles = append(plan.PolicyFiles, PolicyFilePlan{Name: filepath.Base(file), Content: string(content)})
+		if filepath.Base(file) != policyFileName {
+			continue
+		}
+
+		policies, err := ConvertPolicies(content, resourceTypeUUID)
+		if err != nil {
+			return &AppError{err, "AM policy files could not be converted", http.StatusBadRequest}
+		}
+
+		for _, policy := range policies {
+			name := policy["name"].(string)
+			plan.Policies = append(plan.Policies, policy)
+			if exists[name] {
+				plan.Commands = append(plan.Commands, fmt.Sprintf("DELETE %s",
+					am.policyRealmPath(adminResource.realm, "/policies/"+name)))
+			}
+			plan.Commands = append(plan.Commands, fmt.Sprintf("POST %s %s",
+				am.policyRealmPath(adminResource.realm, "/policies?_action=create"), name))
+			imported[name] = true
+		}
+	}
+
+	for _, policy := range ApplicationPolicies(existing, request.Application) {
+		if !imported[policy.Name] {
+			plan.Commands = append(plan.Commands, fmt.Sprintf("DELETE %s",
+				am.policyRealmPath(adminResource.realm, "/policies/"+policy.Name)))
+		}
+	}
+
+	return nil
+}
+
+func planFSSOpenam(fasit *FasitClient, request *NamedConfigurationRequest, zone string, plan *ConfigurationPlan) *AppError {
+	agentName := fmt.Sprintf("%s-%s", request.Application, request.Environment)
+
+	issoResource, appErr := fasit.GetIssoResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	am, err := GetAmConnection(&issoResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	request.RedirectionUris = CreateRedirectionUris(&issoResource, request)
+
+	plan.Agent = &AgentPlan{
+		Name:            agentName,
+		Exists:          am.AgentExists(agentName),
+		Action:          "create",
+		Payload:         buildAgentPayload(agentName, maskedSecret, request.RedirectionUris, request.OAuth2),
+		RedirectionUris: request.RedirectionUris,
+	}
+	if plan.Agent.Exists {
+		agent, err := am.GetAgent(agentName)
+		if err != nil {
+			glog.Errorf("Failed to read AM agent %s: %s", agentName, err)
+			return &AppError{err, "AM agent could not be read", http.StatusBadGateway}
+		}
+
+		plan.Agent.Diff = DiffAgent(agent, plan.Agent.Payload)
+		switch {
+		case request.Recreate:
+			plan.Agent.Action = "recreate"
+		case len(plan.Agent.Diff) == 0:
+			plan.Agent.Action = "none"
+		default:
+			plan.Agent.Action = "update"
+		}
+	}
+
+	payload, appErr := fasit.CreateFasitResourceForOpenIDConnect(issoResource, request, zone)
+	if appErr != nil {
+		glog.Errorf("Failed to create payload for OpenIDConnect: %s", appErr)
+		return appErr
+	}
+
+	for name := range payload.Secrets {
+		payload.Secrets[name] = map[string]string{"value": maskedSecret}
+	}
+
+	plan.FasitResource = &FasitResourcePlan{Method: http.MethodPost, Resource: payload}
+	originalFasitResource, fasitErr := getFasitResource(*fasit, ResourceRequest{payload.Alias, payload.ResourceType},
+		request.Environment, request.Application, zone)
+	if fasitErr == nil {
+		plan.FasitResource.Method = http.MethodPut
+		plan.FasitResource.Resource.ID = originalFasitResource.ID
+	} else if fasitErr.StatusCode != http.StatusNotFound {
+		return fasitErr
+	}
+
+	return nil
+}
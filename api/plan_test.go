@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunFSS(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Persist().
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"admin\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectagentalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"agent\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/agents/testapp-t0").
+		Reply(404)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", "testapp-oidc").
+		MatchParam("type", ResourceTypeOIDC).
+		Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+
+	jsn, _ := json.Marshal(CreateConfigurationRequest("testapp", "1.0", "t0", "user", "pass", []string{"/test"}))
+	req, _ := http.NewRequest("POST", "/configure?dryRun=true", strings.NewReader(string(jsn)))
+
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var plan ConfigurationPlan
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &plan))
+	assert.Equal(t, "testapp-t0", plan.Agent.Name)
+	assert.Equal(t, "create", plan.Agent.Action)
+	assert.Equal(t, maskedSecret, plan.Agent.Payload.Password)
+	assert.Contains(t, plan.Agent.RedirectionUris, "[0]=https://testapp.nais.preprod.local/test")
+	assert.Equal(t, http.MethodPut, plan.FasitResource.Method)
+	assert.Equal(t, 256, plan.FasitResource.Resource.ID)
+	assert.Equal(t, maskedSecret, plan.FasitResource.Resource.Secrets["password"]["value"])
+}
+
+func TestPlanSBSImportListsDeletedPolicies(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\", \"realm\": \"/plan\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"planner\"}}")
+
+	gock.New(baseURL).
+		Post("/json/plan/authenticate").
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/plan/resourcetypes").
+		Reply(200).
+		BodyString(`{"result": [{"uuid": "url-uuid", "name": "URL"}]}`)
+
+	gock.New(baseURL).
+		Get("/json/plan/policies").
+		MatchParam("_queryFilter", "true").
+		Reply(200).
+		BodyString(`{"result": [{"name": "Testapp_001-rule_Testapp_001_01"}, {"name": "Testapp_002-rule_Testapp_002_01"},
+			{"name": "Otherapp_001-rule_Otherapp_001_01"}], "resultCount": 3}`)
+
+	request := &NamedConfigurationRequest{Application: "testapp", Environment: "t0", Realm: "/plan",
+		PolicyFiles: map[string][]byte{policyFileName: []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Policies>
+	<Policy name="Testapp_001" active="true">
+		<Rule name="rule_Testapp_001_01">
+			<ServiceName name="iPlanetAMWebAgentService" />
+			<ResourceName name="https://${DomainName}/testapp/*" />
+		</Rule>
+		<Subjects>
+			<Subject name="subject_Testapp_001_01" type="AuthenticatedUsers" includeType="inclusive" />
+		</Subjects>
+	</Policy>
+	<Policy name="Testapp_003" active="true">
+		<Rule name="rule_Testapp_003_01">
+			<ServiceName name="iPlanetAMWebAgentService" />
+			<ResourceName name="https://${DomainName}/testapp/api/*" />
+		</Rule>
+		<Subjects>
+			<Subject name="subject_Testapp_003_01" type="AuthenticatedUsers" includeType="inclusive" />
+		</Subjects>
+	</Policy>
+</Policies>`)}}
+
+	var plan ConfigurationPlan
+	appErr := planSBSImport(&FasitClient{"https://fasit.local", "user", "pass"}, request, ZoneSbs, &plan)
+	assert.Nil(t, appErr)
+	assert.Equal(t, []string{
+		"DELETE /json/plan/policies/Testapp_001-rule_Testapp_001_01",
+		"POST /json/plan/policies?_action=create Testapp_001-rule_Testapp_001_01",
+		"POST /json/plan/policies?_action=create Testapp_003-rule_Testapp_003_01",
+		"DELETE /json/plan/policies/Testapp_002-rule_Testapp_002_01",
+	}, plan.Commands)
+	assert.True(t, gock.IsDone())
+}
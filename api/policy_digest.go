@@ -0,0 +1,112 @@
+package api
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Digests a policy file can be verified against
+const (
+	DigestSHA256 = "sha256"
+	DigestSHA1   = "sha1"
+	// DigestOCI is the sha256 digest of an OCI layer, given by the manifest
+	DigestOCI = "oci"
+)
+
+const (
+	// maxPolicyFileSize limits how much is read from a policy source for a single file
+	maxPolicyFileSize  = 1 << 20
+	policyUploadSource = "upload"
+)
+
+// PolicyDigest records which policy file was applied, where it came from, and which published digest it matched
+type PolicyDigest struct {
+	File     string `json:"file"`
+	Source   string `json:"source"`
+	SHA256   string `json:"sha256"`
+	Verified string `json:"verified,omitempty"`
+}
+
+// policyContentTypes are the content types accepted for each kind of policy file. Anything else, like the HTML of a
+// login page, is rejected.
+var policyContentTypes = map[string][]string{
+	".xml": {"application/xml", "text/xml", "text/plain", "application/octet-stream"},
+	".txt": {"text/plain", "application/octet-stream"},
+}
+
+// newPolicyDigest computes the sha256 of the content, which is recorded whether it could be verified or not
+func newPolicyDigest(fileName, source string, content []byte) PolicyDigest {
+	sum := sha256.Sum256(content)
+	return PolicyDigest{File: fileName, Source: source, SHA256: hex.EncodeToString(sum[:])}
+}
+
+// checkContentType rejects responses whose content type does not fit the policy file
+func checkContentType(fileName, contentType string) error {
+	if len(contentType) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %s for %s", contentType, fileName)
+	}
+
+	for _, allowed := range policyContentTypes[filepath.Ext(fileName)] {
+		if mediaType == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected content type %s for %s", mediaType, fileName)
+}
+
+// verifySidecar checks the content against a sidecar file like app-policies.xml.sha1, which holds the hex digest
+// optionally followed by the file name
+func verifySidecar(algorithm string, sidecar, content []byte) error {
+	fields := strings.Fields(string(sidecar))
+	if len(fields) == 0 {
+		return fmt.Errorf("empty %s file", algorithm)
+	}
+
+	var actual string
+	switch algorithm {
+	case DigestSHA256:
+		sum := sha256.Sum256(content)
+		actual = hex.EncodeToString(sum[:])
+	case DigestSHA1:
+		sum := sha1.Sum(content)
+		actual = hex.EncodeToString(sum[:])
+	default:
+		return fmt.Errorf("unsupported digest %s", algorithm)
+	}
+
+	if !strings.EqualFold(fields[0], actual) {
+		return fmt.Errorf("%s mismatch, published %s but got %s", algorithm, fields[0], actual)
+	}
+	return nil
+}
+
+// fetchSidecar gets the sidecar digest published next to the file, returning nil when there is none
+func fetchSidecar(client *http.Client, auth PolicySourceAuth, fileURL, algorithm string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL+"."+algorithm, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request for %s digest: %s", algorithm, err)
+	}
+	auth.apply(req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET failed for url: %s. %s", req.URL, err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, nil
+	}
+
+	return readBody(resp, req.URL, maxPolicyFileSize)
+}
@@ -0,0 +1,389 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of policy sources, selected per cluster with the policySource flag
+const (
+	// PolicySourceHTTP downloads the policy files from an URL template, by default the Nexus raw repository
+	PolicySourceHTTP = "http"
+	// PolicySourceOCI pulls the policy files from an OCI artifact in a registry, tagged with the version
+	PolicySourceOCI = "oci"
+	// PolicySourceDir reads the policy files from a local directory
+	PolicySourceDir = "dir"
+)
+
+const (
+	// DefaultPolicyURLTemplate is where the policy files have always been published
+	DefaultPolicyURLTemplate = "https://repo.adeo.no/repository/raw/nais/{application}/{version}/am/{file}"
+	policySourceTimeout      = 30 * time.Second
+	ociManifestMediaType     = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType  = "application/vnd.docker.distribution.manifest.v2+json"
+	ociTitleAnnotation       = "org.opencontainers.image.title"
+)
+
+// PolicySource fetches the policy files of an application version
+type PolicySource interface {
+	// Fetch returns the content of the policy file, like app-policies.xml, and its verified digest
+	Fetch(application, version, fileName string) ([]byte, PolicyDigest, error)
+	// String describes the source for logging
+	String() string
+}
+
+// PolicySourceAuth are the credentials for a policy source. A bearer token is used instead of basic auth when set.
+type PolicySourceAuth struct {
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+// HTTPPolicySource downloads policy files from an URL template with {application}, {version} and {file} placeholders.
+// The files are verified against the .sha256 or .sha1 files published next to them, like Nexus does, and
+// RequireDigest rejects files without either.
+type HTTPPolicySource struct {
+	URLTemplate   string
+	Auth          PolicySourceAuth
+	RequireDigest bool
+	client        *http.Client
+}
+
+// OCIPolicySource pulls policy files from the layers of an OCI artifact, matched by their title annotation. The
+// repository, like registry.example.com/nais/{application}-policies, is tagged with the version.
+type OCIPolicySource struct {
+	Repository string
+	Auth       PolicySourceAuth
+	client     *http.Client
+}
+
+// DirPolicySource reads policy files from <dir>/<application>/<version>/<file>
+type DirPolicySource struct {
+	Dir string
+}
+
+var (
+	policySource    PolicySource = NewHTTPPolicySource(DefaultPolicyURLTemplate, PolicySourceAuth{}, true)
+	bearerChallenge              = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// SetPolicySource sets where policy files not uploaded with the request are fetched from
+func SetPolicySource(source PolicySource) {
+	policySource = source
+}
+
+// NewPolicySource creates a policy source of the given kind. The location is an URL template for http, a repository
+// for oci and a directory for dir. requireDigest only applies to http.
+func NewPolicySource(kind, location string, auth PolicySourceAuth, requireDigest bool) (PolicySource, error) {
+	switch kind {
+	case PolicySourceHTTP:
+		if len(location) == 0 {
+			location = DefaultPolicyURLTemplate
+		}
+		if !strings.Contains(location, "{file}") {
+			return nil, fmt.Errorf("policy URL template %s has no {file} placeholder", location)
+		}
+		return NewHTTPPolicySource(location, auth, requireDigest), nil
+	case PolicySourceOCI:
+		if len(location) == 0 || !strings.Contains(location, "/") {
+			return nil, fmt.Errorf("OCI policy source needs a repository like registry.example.com/nais/{application}, "+
+				"not '%s'", location)
+		}
+		return NewOCIPolicySource(location, auth), nil
+	case PolicySourceDir:
+		if info, err := os.Stat(location); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("policy directory %s does not exist", location)
+		}
+		return &DirPolicySource{Dir: location}, nil
+	}
+
+	return nil, fmt.Errorf("policy source has to be %s, %s or %s, not %s", PolicySourceHTTP, PolicySourceOCI,
+		PolicySourceDir, kind)
+}
+
+// NewHTTPPolicySource creates a source downloading from the URL template
+func NewHTTPPolicySource(urlTemplate string, auth PolicySourceAuth, requireDigest bool) *HTTPPolicySource {
+	return &HTTPPolicySource{
+		URLTemplate:   urlTemplate,
+		Auth:          auth,
+		RequireDigest: requireDigest,
+		client:        &http.Client{Timeout: policySourceTimeout},
+	}
+}
+
+// NewOCIPolicySource creates a source pulling from the repository
+func NewOCIPolicySource(repository string, auth PolicySourceAuth) *OCIPolicySource {
+	return &OCIPolicySource{Repository: repository, Auth: auth, client: &http.Client{Timeout: policySourceTimeout}}
+}
+
+// expandTemplate fills in the placeholders, escaping the values for use in URLs and paths
+func expandTemplate(template, application, version, fileName string) string {
+	return strings.NewReplacer(
+		"{application}", url.PathEscape(application),
+		"{version}", url.PathEscape(version),
+		"{file}", url.PathEscape(fileName),
+	).Replace(template)
+}
+
+func (auth PolicySourceAuth) apply(req *http.Request) {
+	switch {
+	case len(auth.BearerToken) > 0:
+		req.Header.Set("Authorization", "Bearer "+auth.BearerToken)
+	case len(auth.Username) > 0:
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+}
+
+// Fetch downloads the policy file and verifies it against the first sidecar digest found
+func (s *HTTPPolicySource) Fetch(application, version, fileName string) ([]byte, PolicyDigest, error) {
+	fileURL := expandTemplate(s.URLTemplate, application, version, fileName)
+
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, PolicyDigest{}, fmt.Errorf("could not create request for %s: %s", fileURL, err)
+	}
+	s.Auth.apply(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, PolicyDigest{}, fmt.Errorf("HTTP GET failed for url: %s. %s", fileURL, err)
+	}
+	content, err := readBody(resp, req.URL, maxPolicyFileSize)
+	if err != nil {
+		return nil, PolicyDigest{}, err
+	}
+	if err := checkContentType(fileName, resp.Header.Get("Content-Type")); err != nil {
+		return nil, PolicyDigest{}, fmt.Errorf("%s from %s", err, fileURL)
+	}
+
+	digest := newPolicyDigest(fileName, fileURL, content)
+	for _, algorithm := range []string{DigestSHA256, DigestSHA1} {
+		sidecar, err := fetchSidecar(s.client, s.Auth, fileURL, algorithm)
+		if err != nil {
+			return nil, PolicyDigest{}, err
+		}
+		if sidecar == nil {
+			continue
+		}
+
+		if err := verifySidecar(algorithm, sidecar, content); err != nil {
+			return nil, PolicyDigest{}, fmt.Errorf("%s from %s: %s", fileName, fileURL, err)
+		}
+		digest.Verified = algorithm
+		return content, digest, nil
+	}
+
+	if s.RequireDigest {
+		return nil, PolicyDigest{}, fmt.Errorf("no .sha256 or .sha1 digest published for %s", fileURL)
+	}
+	return content, digest, nil
+}
+
+func (s *HTTPPolicySource) String() string {
+	return "HTTP " + s.URLTemplate
+}
+
+// Fetch pulls the manifest of the version, and the layer titled with the file name, verified against its digest
+func (s *OCIPolicySource) Fetch(application, version, fileName string) ([]byte, PolicyDigest, error) {
+	repository := expandTemplate(s.Repository, application, version, fileName)
+	slash := strings.Index(repository, "/")
+	registry, name := repository[:slash], repository[slash+1:]
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, name,
+		url.PathEscape(version)), nil)
+	if err != nil {
+		return nil, PolicyDigest{}, fmt.Errorf("could not create manifest request: %s", err)
+	}
+	req.Header.Set("Accept", ociManifestMediaType+", "+dockerManifestMediaType)
+
+	body, err := s.do(req)
+	if err != nil {
+		return nil, PolicyDigest{}, err
+	}
+
+	var manifest struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, PolicyDigest{}, fmt.Errorf("could not read manifest of %s:%s: %s", repository, version, err)
+	}
+
+	for _, layer := range manifest.Layers {
+		if layer.Annotations[ociTitleAnnotation] != fileName {
+			continue
+		}
+
+		blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", registry, name, layer.Digest)
+		req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+		if err != nil {
+			return nil, PolicyDigest{}, fmt.Errorf("could not create blob request: %s", err)
+		}
+
+		content, err := s.do(req)
+		if err != nil {
+			return nil, PolicyDigest{}, err
+		}
+
+		digest := newPolicyDigest(fileName, fmt.Sprintf("%s:%s@%s", repository, version, layer.Digest), content)
+		if layer.Digest != DigestSHA256+":"+digest.SHA256 {
+			return nil, PolicyDigest{}, fmt.Errorf("%s in %s:%s has digest sha256:%s, not %s", fileName, repository,
+				version, digest.SHA256, layer.Digest)
+		}
+		digest.Verified = DigestOCI
+		return content, digest, nil
+	}
+
+	return nil, PolicyDigest{}, fmt.Errorf("%s not found in %s:%s", fileName, repository, version)
+}
+
+// do sends the request with the credentials, getting a token first if the registry answers with a bearer challenge
+func (s *OCIPolicySource) do(req *http.Request) ([]byte, error) {
+	s.Auth.apply(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET failed for url: %s. %s", req.URL, err)
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode == http.StatusUnauthorized && strings.HasPrefix(challenge, "Bearer ") {
+		resp.Body.Close()
+
+		token, err := s.token(challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		if resp, err = s.client.Do(req); err != nil {
+			return nil, fmt.Errorf("HTTP GET failed for url: %s. %s", req.URL, err)
+		}
+	}
+
+	return readBody(resp, req.URL, maxPolicyFileSize)
+}
+
+// token gets a registry token from the realm of the challenge, with the basic auth credentials if there are any
+func (s *OCIPolicySource) token(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range bearerChallenge.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(params["realm"]) == 0 {
+		return "", fmt.Errorf("registry gave an invalid token realm: %s", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if value, ok := params[key]; ok {
+			query.Set(key, value)
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create token request: %s", err)
+	}
+	if len(s.Auth.Username) > 0 {
+		req.SetBasicAuth(s.Auth.Username, s.Auth.Password)
+	}
+
+	body, err := readResponse(s.client, req)
+	if err != nil {
+		return "", err
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", fmt.Errorf("could not read registry token: %s", err)
+	}
+	if len(token.Token) > 0 {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+func (s *OCIPolicySource) String() string {
+	return "OCI " + s.Repository
+}
+
+// Fetch reads the policy file from the directory, verifying it against a .sha256 or .sha1 file next to it if there is
+// one
+func (s *DirPolicySource) Fetch(application, version, fileName string) ([]byte, PolicyDigest, error) {
+	for _, part := range []string{application, version, fileName} {
+		if part != filepath.Base(part) || part == ".." {
+			return nil, PolicyDigest{}, fmt.Errorf("invalid path element %s", part)
+		}
+	}
+
+	path := filepath.Join(s.Dir, application, version, fileName)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, PolicyDigest{}, fmt.Errorf("could not read policy file: %s", err)
+	}
+	if len(content) > maxPolicyFileSize {
+		return nil, PolicyDigest{}, fmt.Errorf("policy file %s is larger than %d bytes", path, maxPolicyFileSize)
+	}
+
+	digest := newPolicyDigest(fileName, path, content)
+	for _, algorithm := range []string{DigestSHA256, DigestSHA1} {
+		sidecar, err := ioutil.ReadFile(path + "." + algorithm)
+		if err != nil {
+			continue
+		}
+		if err := verifySidecar(algorithm, sidecar, content); err != nil {
+			return nil, PolicyDigest{}, fmt.Errorf("%s: %s", path, err)
+		}
+		digest.Verified = algorithm
+		break
+	}
+
+	return content, digest, nil
+}
+
+func (s *DirPolicySource) String() string {
+	return "directory " + s.Dir
+}
+
+func readResponse(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP GET failed for url: %s. %s", req.URL, err)
+	}
+	return readBody(resp, req.URL, maxPolicyFileSize)
+}
+
+// readBody reads at most limit bytes of a successful response
+func readBody(resp *http.Response, requestURL *url.URL, limit int64) ([]byte, error) {
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("got HTTP status code %d fetching manifest from URL: %s", resp.StatusCode, requestURL)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read response from %s: %s", requestURL, err)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response from %s is larger than %d bytes", requestURL, limit)
+	}
+	return body, nil
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+// policiesSHA256 is the sha256 of <Policies/>
+const policiesSHA256 = "52d6fcdaee31aa454b687554c9520ec49c59684431a86c85a312ceee9b4a1efc"
+
+func TestHTTPPolicySourceWithBasicAuth(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://artifacts.example.com").
+		Get("/policies/testapp/1.0/app-policies.xml").
+		MatchHeader("Authorization", "Basic dXNlcjpwYXNz").
+		Reply(200).BodyString("<Policies/>")
+	gock.New("https://artifacts.example.com").
+		Get("/policies/testapp/1.0/app-policies.xml.sha256").
+		MatchHeader("Authorization", "Basic dXNlcjpwYXNz").
+		Reply(404)
+	gock.New("https://artifacts.example.com").
+		Get("/policies/testapp/1.0/app-policies.xml.sha1").
+		MatchHeader("Authorization", "Basic dXNlcjpwYXNz").
+		Reply(404)
+
+	source := NewHTTPPolicySource("https://artifacts.example.com/policies/{application}/{version}/{file}",
+		PolicySourceAuth{Username: "user", Password: "pass"}, false)
+
+	content, digest, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, "<Policies/>", string(content))
+	assert.Equal(t, policiesSHA256, digest.SHA256)
+	assert.Empty(t, digest.Verified)
+	assert.True(t, gock.IsDone())
+}
+
+func TestHTTPPolicySourceWithBearerToken(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://artifacts.example.com").
+		Get("/policies/testapp/1.0/app-policies.xml").
+		MatchHeader("Authorization", "Bearer token").
+		Reply(404)
+
+	source := NewHTTPPolicySource("https://artifacts.example.com/policies/{application}/{version}/{file}",
+		PolicySourceAuth{BearerToken: "token", Username: "ignored"}, false)
+
+	_, _, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.EqualError(t, err, "got HTTP status code 404 fetching manifest from URL: "+
+		"https://artifacts.example.com/policies/testapp/1.0/app-policies.xml")
+	assert.True(t, gock.IsDone())
+}
+
+func TestOCIPolicySource(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://registry.example.com").
+		Get("/v2/nais/testapp-policies/manifests/1.0").
+		Reply(401).
+		SetHeader("WWW-Authenticate",
+			`Bearer realm="https://auth.example.com/token",service="registry",scope="repository:nais/testapp-policies:pull"`)
+
+	gock.New("https://auth.example.com").
+		Get("/token").
+		MatchParam("service", "registry").
+		MatchParam("scope", "repository:nais/testapp-policies:pull").
+		MatchHeader("Authorization", "Basic dXNlcjpwYXNz").
+		Reply(200).BodyString(`{"token": "registry-token"}`)
+
+	gock.New("https://registry.example.com").
+		Get("/v2/nais/testapp-policies/manifests/1.0").
+		MatchHeader("Authorization", "Bearer registry-token").
+		Reply(200).BodyString(`{"layers": [
+			{"digest": "sha256:aaa", "annotations": {"org.opencontainers.image.title": "not-enforced-urls.txt"}},
+			{"digest": "sha256:` + policiesSHA256 + `", "annotations": {"org.opencontainers.image.title": "app-policies.xml"}}
+		]}`)
+
+	gock.New("https://registry.example.com").
+		Get("/v2/nais/testapp-policies/blobs/sha256:" + policiesSHA256).
+		Reply(200).BodyString("<Policies/>")
+
+	source := NewOCIPolicySource("registry.example.com/nais/{application}-policies",
+		PolicySourceAuth{Username: "user", Password: "pass"})
+
+	content, digest, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, "<Policies/>", string(content))
+	assert.Equal(t, DigestOCI, digest.Verified)
+	assert.True(t, gock.IsDone())
+}
+
+func TestOCIPolicySourceWithWrongLayerDigest(t *testing.T) {
+	defer gock.Off()
+
+	gock.New("https://registry.example.com").
+		Get("/v2/nais/testapp-policies/manifests/1.0").
+		Reply(200).BodyString(`{"layers": [
+			{"digest": "sha256:bbb", "annotations": {"org.opencontainers.image.title": "app-policies.xml"}}
+		]}`)
+	gock.New("https://registry.example.com").
+		Get("/v2/nais/testapp-policies/blobs/sha256:bbb").
+		Reply(200).BodyString("<Policies/>")
+
+	source := NewOCIPolicySource("registry.example.com/nais/{application}-policies", PolicySourceAuth{})
+
+	_, _, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.EqualError(t, err, "app-policies.xml in registry.example.com/nais/testapp-policies:1.0 has digest sha256:"+
+		policiesSHA256+", not sha256:bbb")
+}
+
+func TestDirPolicySource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policies")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "testapp", "1.0"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "testapp", "1.0", "app-policies.xml"),
+		[]byte("<Policies/>"), 0644))
+
+	source, err := NewPolicySource(PolicySourceDir, dir, PolicySourceAuth{}, true)
+	assert.NoError(t, err)
+
+	content, digest, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, "<Policies/>", string(content))
+	assert.Empty(t, digest.Verified)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "testapp", "1.0", "app-policies.xml.sha256"),
+		[]byte("0000  app-policies.xml\n"), 0644))
+	_, _, err = source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.Contains(t, err.Error(), "sha256 mismatch, published 0000")
+
+	_, _, err = source.Fetch("..", "1.0", "app-policies.xml")
+	assert.EqualError(t, err, "invalid path element ..")
+}
+
+func TestNewPolicySource(t *testing.T) {
+	source, err := NewPolicySource(PolicySourceHTTP, "", PolicySourceAuth{}, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP "+DefaultPolicyURLTemplate, source.String())
+
+	_, err = NewPolicySource(PolicySourceHTTP, "https://example.com/{application}", PolicySourceAuth{},
+		true)
+	assert.EqualError(t, err, "policy URL template https://example.com/{application} has no {file} placeholder")
+
+	_, err = NewPolicySource("s3", "", PolicySourceAuth{}, true)
+	assert.EqualError(t, err, "policy source has to be http, oci or dir, not s3")
+}
+
+func TestHTTPPolicySourceVerifiesDigest(t *testing.T) {
+	defer gock.Off()
+
+	const template = "https://artifacts.example.com/policies/{application}/{version}/{file}"
+	source := NewHTTPPolicySource(template, PolicySourceAuth{}, true)
+
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml").
+		Reply(200).SetHeader("Content-Type", "application/xml").BodyString("<Policies/>")
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml.sha256").Reply(404)
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml.sha1").
+		Reply(200).BodyString("2aa2c7f3b27ad2ea5b3a8b8e6a2c3fb5c7b81a0e")
+
+	_, _, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.Contains(t, err.Error(), "sha1 mismatch")
+
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml").
+		Reply(200).BodyString("<Policies/>")
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml.sha256").
+		Reply(200).BodyString(policiesSHA256 + "  app-policies.xml\n")
+
+	_, digest, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.NoError(t, err)
+	assert.Equal(t, PolicyDigest{File: "app-policies.xml", Source: "https://artifacts.example.com/policies/testapp/1.0/" +
+		"app-policies.xml", SHA256: policiesSHA256, Verified: DigestSHA256}, digest)
+
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml").
+		Reply(200).BodyString("<Policies/>")
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml.sha256").Reply(404)
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml.sha1").Reply(404)
+
+	_, _, err = source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.EqualError(t, err, "no .sha256 or .sha1 digest published for "+
+		"https://artifacts.example.com/policies/testapp/1.0/app-policies.xml")
+	assert.True(t, gock.IsDone())
+}
+
+func TestHTTPPolicySourceRejectsUnexpectedResponses(t *testing.T) {
+	defer gock.Off()
+
+	source := NewHTTPPolicySource("https://artifacts.example.com/policies/{application}/{version}/{file}",
+		PolicySourceAuth{}, false)
+
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml").
+		Reply(200).SetHeader("Content-Type", "text/html; charset=utf-8").BodyString("<html>Log in</html>")
+
+	_, _, err := source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.EqualError(t, err, "unexpected content type text/html for app-policies.xml from "+
+		"https://artifacts.example.com/policies/testapp/1.0/app-policies.xml")
+
+	gock.New("https://artifacts.example.com").Get("/policies/testapp/1.0/app-policies.xml").
+		Reply(200).BodyString(strings.Repeat("x", maxPolicyFileSize+1))
+
+	_, _, err = source.Fetch("testapp", "1.0", "app-policies.xml")
+	assert.EqualError(t, err, "response from https://artifacts.example.com/policies/testapp/1.0/app-policies.xml "+
+		"is larger than 1048576 bytes")
+}
@@ -0,0 +1,357 @@
+package policyfile
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Severity tells whether a lint finding fails validation
+type Severity string
+
+// Severities of lint rules
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// IDs of the lint rules, used to disable them
+const (
+	RuleDuplicateName        = "duplicate-name"
+	RuleMissingDomainName    = "missing-domain-name"
+	RuleHardcodedHost        = "hardcoded-host"
+	RuleEmptyAttributeValue  = "empty-attribute-value"
+	RuleUnknownHTTPMethod    = "unknown-http-method"
+	RuleMissingAgentService  = "missing-agent-service"
+	RuleInactivePolicy       = "inactive-policy"
+	RuleBroadNotEnforcedURL  = "broad-not-enforced-url"
+	RuleProtectedNotEnforced = "protected-not-enforced"
+)
+
+const (
+	domainNamePlaceholder = "${DomainName}"
+	agentService          = "iPlanetAMWebAgentService"
+	disableDirective      = "named:disable"
+)
+
+type reportFunc func(position Position, format string, args ...interface{})
+
+// LintRule is a check of a parsed policy file, a not-enforced-urls.txt file, or both
+type LintRule struct {
+	ID            string
+	Severity      Severity
+	Description   string
+	checkPolicies func(policies *Policies, report reportFunc)
+	checkURLs     func(urls *NotEnforcedURLs, report reportFunc)
+	// checkBoth cross-checks the files, reporting positions in not-enforced-urls.txt
+	checkBoth func(policies *Policies, urls *NotEnforcedURLs, report reportFunc)
+}
+
+// Finding is a problem found by a lint rule
+type Finding struct {
+	Position
+	RuleID   string
+	Severity Severity
+	Message  string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("line %d, column %d: %s: %s [%s]", f.Line, f.Column, f.Severity, f.Message, f.RuleID)
+}
+
+var (
+	environmentHost = regexp.MustCompile(`(?i)^[a-z]+://[^/]*-[tuqp][0-9]+\.`)
+	httpMethods     = map[string]bool{
+		"GET": true, "POST": true, "PUT": true, "DELETE": true, "HEAD": true, "PATCH": true, "OPTIONS": true,
+	}
+)
+
+// LintRules are all lint rules, run in this order
+var LintRules = []LintRule{
+	{
+		ID:            RuleDuplicateName,
+		Severity:      SeverityError,
+		Description:   "policy and rule names must be unique",
+		checkPolicies: checkDuplicateNames,
+	},
+	{
+		ID:            RuleMissingDomainName,
+		Severity:      SeverityWarning,
+		Description:   "resources and not enforced URLs should use ${DomainName} instead of a host",
+		checkPolicies: checkDomainName,
+		checkURLs:     checkURLDomainName,
+	},
+	{
+		ID:            RuleHardcodedHost,
+		Severity:      SeverityWarning,
+		Description:   "resources and not enforced URLs should not point to the host of one environment",
+		checkPolicies: checkHardcodedHost,
+		checkURLs:     checkURLHardcodedHost,
+	},
+	{
+		ID:            RuleEmptyAttributeValue,
+		Severity:      SeverityError,
+		Description:   "attribute value pairs must have a value",
+		checkPolicies: checkEmptyAttributeValues,
+	},
+	{
+		ID:            RuleUnknownHTTPMethod,
+		Severity:      SeverityError,
+		Description:   "actions must be HTTP methods",
+		checkPolicies: checkHTTPMethods,
+	},
+	{
+		ID:            RuleMissingAgentService,
+		Severity:      SeverityError,
+		Description:   "rules must belong to " + agentService,
+		checkPolicies: checkAgentService,
+	},
+	{
+		ID:            RuleInactivePolicy,
+		Severity:      SeverityWarning,
+		Description:   "policies should be active",
+		checkPolicies: checkInactivePolicies,
+	},
+	{
+		ID:          RuleBroadNotEnforcedURL,
+		Severity:    SeverityError,
+		Description: "not enforced URLs must not cover a whole site",
+		checkURLs:   checkBroadURLs,
+	},
+	{
+		ID:          RuleProtectedNotEnforced,
+		Severity:    SeverityWarning,
+		Description: "resources protected by a policy should not also be not enforced",
+		checkBoth:   checkProtectedNotEnforced,
+	},
+}
+
+// Lint runs the lint rules on the policies, except those disabled by the caller or by named:disable comments in the
+// file. Findings are ordered by position.
+func Lint(policies *Policies, disabled []string) []Finding {
+	return lint(disabled, policies.Disabled, func(rule LintRule, report reportFunc) {
+		if rule.checkPolicies != nil {
+			rule.checkPolicies(policies, report)
+		}
+	})
+}
+
+// LintNotEnforcedURLs runs the lint rules on the not enforced URLs, except those disabled by the caller or by
+// named:disable comments in the file. Findings are ordered by position.
+func LintNotEnforcedURLs(urls *NotEnforcedURLs, disabled []string) []Finding {
+	return lint(disabled, urls.Disabled, func(rule LintRule, report reportFunc) {
+		if rule.checkURLs != nil {
+			rule.checkURLs(urls, report)
+		}
+	})
+}
+
+// CrossCheck runs the lint rules that need both app-policies.xml and not-enforced-urls.txt, except those disabled by
+// the caller or in either file. Findings are positions in not-enforced-urls.txt.
+func CrossCheck(policies *Policies, urls *NotEnforcedURLs, disabled []string) []Finding {
+	return lint(disabled, append(append([]string{}, policies.Disabled...), urls.Disabled...),
+		func(rule LintRule, report reportFunc) {
+			if rule.checkBoth != nil {
+				rule.checkBoth(policies, urls, report)
+			}
+		})
+}
+
+func lint(disabled []string, disabledInFile []string, check func(LintRule, reportFunc)) []Finding {
+	off := map[string]bool{}
+	for _, id := range append(append([]string{}, disabled...), disabledInFile...) {
+		off[id] = true
+	}
+
+	var findings []Finding
+	for _, rule := range LintRules {
+		if off[rule.ID] {
+			continue
+		}
+		rule := rule
+		check(rule, func(position Position, format string, args ...interface{}) {
+			findings = append(findings, Finding{position, rule.ID, rule.Severity, fmt.Sprintf(format, args...)})
+		})
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i].Position, findings[j].Position
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return findings
+}
+
+// FindLintRule returns the lint rule with the given ID
+func FindLintRule(id string) (LintRule, bool) {
+	for _, rule := range LintRules {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return LintRule{}, false
+}
+
+// disabledRules reads the rule IDs from a comment like <!-- named:disable hardcoded-host, inactive-policy -->
+func disabledRules(comment string) []string {
+	comment = strings.TrimSpace(comment)
+	if !strings.HasPrefix(comment, disableDirective) {
+		return nil
+	}
+
+	return strings.FieldsFunc(comment[len(disableDirective):], func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+func checkDuplicateNames(policies *Policies, report reportFunc) {
+	policyNames := map[string]Position{}
+	ruleNames := map[string]Position{}
+	for _, policy := range policies.Policies {
+		if first, ok := policyNames[policy.Name]; ok && len(policy.Name) > 0 {
+			report(policy.Position, "policy %s is also defined at line %d", policy.Name, first.Line)
+		} else {
+			policyNames[policy.Name] = policy.Position
+		}
+
+		for _, rule := range policy.Rules {
+			if first, ok := ruleNames[rule.Name]; ok && len(rule.Name) > 0 {
+				report(rule.Position, "rule %s is also defined at line %d", rule.Name, first.Line)
+			} else {
+				ruleNames[rule.Name] = rule.Position
+			}
+		}
+	}
+}
+
+func checkDomainName(policies *Policies, report reportFunc) {
+	forEachResource(policies, func(resource ResourceName) {
+		if !strings.Contains(resource.Name, domainNamePlaceholder) {
+			report(resource.Position, "resource %s does not use %s", resource.Name, domainNamePlaceholder)
+		}
+	})
+}
+
+func checkHardcodedHost(policies *Policies, report reportFunc) {
+	forEachResource(policies, func(resource ResourceName) {
+		if environmentHost.MatchString(resource.Name) {
+			report(resource.Position, "resource %s points to the host of a single environment", resource.Name)
+		}
+	})
+}
+
+func checkEmptyAttributeValues(policies *Policies, report reportFunc) {
+	check := func(pair AttributeValuePair) {
+		empty := len(pair.Values) == 0
+		for _, value := range pair.Values {
+			empty = empty || len(value) == 0
+		}
+		if empty {
+			report(pair.Position, "attribute %s has an empty value", pair.Attribute)
+		}
+	}
+
+	for _, policy := range policies.Policies {
+		for _, rule := range policy.Rules {
+			for _, pair := range rule.AttributeValuePairs {
+				check(pair)
+			}
+		}
+		if policy.Conditions != nil {
+			for _, condition := range policy.Conditions.Conditions {
+				for _, pair := range condition.AttributeValuePairs {
+					check(pair)
+				}
+			}
+		}
+	}
+}
+
+func checkHTTPMethods(policies *Policies, report reportFunc) {
+	for _, policy := range policies.Policies {
+		for _, rule := range policy.Rules {
+			if rule.ServiceName == nil || rule.ServiceName.Name != agentService {
+				continue
+			}
+			for _, pair := range rule.AttributeValuePairs {
+				if !httpMethods[pair.Attribute] {
+					report(pair.Position, "%s in rule %s is not an HTTP method", pair.Attribute, rule.Name)
+				}
+			}
+		}
+	}
+}
+
+func checkAgentService(policies *Policies, report reportFunc) {
+	for _, policy := range policies.Policies {
+		for _, rule := range policy.Rules {
+			// a missing ServiceName is already a parse error
+			if rule.ServiceName != nil && rule.ServiceName.Name != agentService {
+				report(rule.ServiceName.Position, "rule %s uses service %s, not %s", rule.Name,
+					rule.ServiceName.Name, agentService)
+			}
+		}
+	}
+}
+
+func checkInactivePolicies(policies *Policies, report reportFunc) {
+	for _, policy := range policies.Policies {
+		if policy.Active == "false" {
+			report(policy.Position, "policy %s is not active", policy.Name)
+		}
+	}
+}
+
+func forEachResource(policies *Policies, f func(ResourceName)) {
+	for _, policy := range policies.Policies {
+		for _, rule := range policy.Rules {
+			for _, resource := range rule.ResourceNames {
+				f(resource)
+			}
+		}
+	}
+}
+
+func checkURLDomainName(urls *NotEnforcedURLs, report reportFunc) {
+	for _, pattern := range urls.Patterns {
+		if !strings.Contains(pattern.Pattern, domainNamePlaceholder) {
+			report(pattern.Position, "not enforced URL %s does not use %s", pattern.Pattern, domainNamePlaceholder)
+		}
+	}
+}
+
+func checkURLHardcodedHost(urls *NotEnforcedURLs, report reportFunc) {
+	for _, pattern := range urls.Patterns {
+		if environmentHost.MatchString(pattern.Pattern) {
+			report(pattern.Position, "not enforced URL %s points to the host of a single environment", pattern.Pattern)
+		}
+	}
+}
+
+// checkBroadURLs finds patterns that match every path on a host, like https://${DomainName}/*, which would turn off
+// enforcement for the whole site
+func checkBroadURLs(urls *NotEnforcedURLs, report reportFunc) {
+	for _, pattern := range urls.Patterns {
+		path := patternPath(pattern.Pattern)
+		for _, wildcard := range []string{"?*", "-*-", "*"} {
+			path = strings.Replace(path, wildcard, "", -1)
+		}
+		if strings.Trim(path, "/") == "" {
+			report(pattern.Position, "not enforced URL %s turns off enforcement for the whole site", pattern.Pattern)
+		}
+	}
+}
+
+// checkProtectedNotEnforced finds resources of policies that a not enforced pattern matches, so the policy never
+// applies to them
+func checkProtectedNotEnforced(policies *Policies, urls *NotEnforcedURLs, report reportFunc) {
+	for _, pattern := range urls.Patterns {
+		matcher := patternRegexp(pattern.Pattern)
+		forEachResource(policies, func(resource ResourceName) {
+			if matcher.MatchString(resource.Name) {
+				report(pattern.Position, "not enforced URL %s matches %s, protected by the policy at line %d",
+					pattern.Pattern, resource.Name, resource.Position.Line)
+			}
+		})
+	}
+}
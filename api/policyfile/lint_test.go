@@ -0,0 +1,90 @@
+package policyfile
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const lintPolicies = `<?xml version="1.0" encoding="UTF-8"?>
+<Policies>
+  <Policy name="App_001" active="false">
+    <Rule name="rule_01">
+      <ServiceName name="iPlanetAMWebAgentService" />
+      <ResourceName name="https://${DomainName}/app/*" />
+      <AttributeValuePair><Attribute name="GET" /><Value>allow</Value></AttributeValuePair>
+      <AttributeValuePair><Attribute name="FETCH" /><Value>allow</Value></AttributeValuePair>
+    </Rule>
+    <Rule name="rule_01">
+      <ServiceName name="sunAMDelegationService" />
+      <ResourceName name="https://app-q1.nav.no/app/*" />
+      <AttributeValuePair><Attribute name="POST" /></AttributeValuePair>
+    </Rule>
+  </Policy>
+</Policies>`
+
+func TestLint(t *testing.T) {
+	policies, err := Parse([]byte(lintPolicies))
+	assert.NoError(t, err)
+
+	findings := Lint(policies, nil)
+
+	var ids []string
+	for _, finding := range findings {
+		ids = append(ids, finding.RuleID)
+	}
+	assert.Equal(t, []string{
+		RuleInactivePolicy,
+		RuleUnknownHTTPMethod,
+		RuleDuplicateName,
+		RuleMissingAgentService,
+		RuleMissingDomainName,
+		RuleHardcodedHost,
+		RuleEmptyAttributeValue,
+	}, ids)
+	assert.Equal(t, Finding{Position{8, 7}, RuleUnknownHTTPMethod, SeverityError,
+		"FETCH in rule rule_01 is not an HTTP method"}, findings[1])
+	assert.Equal(t, "rule rule_01 is also defined at line 4", findings[2].Message)
+}
+
+func TestLintRulesCanBeDisabled(t *testing.T) {
+	content := strings.Replace(lintPolicies, "<Policies>", "<!-- named:disable inactive-policy, duplicate-name -->\n<Policies>", 1)
+	policies, err := Parse([]byte(content))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{RuleInactivePolicy, RuleDuplicateName}, policies.Disabled)
+
+	findings := Lint(policies, []string{RuleHardcodedHost, RuleMissingDomainName})
+	for _, finding := range findings {
+		assert.NotContains(t, []string{RuleInactivePolicy, RuleDuplicateName, RuleHardcodedHost,
+			RuleMissingDomainName}, finding.RuleID)
+	}
+	assert.Len(t, findings, 3)
+}
+
+func TestLintFixtureHasOnlyHostWarnings(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/app-policies.xml")
+	assert.NoError(t, err)
+	policies, err := Parse(content)
+	assert.NoError(t, err)
+
+	findings := Lint(policies, nil)
+	assert.Len(t, findings, 8)
+	for _, finding := range findings {
+		assert.Equal(t, SeverityWarning, finding.Severity)
+	}
+}
+
+func TestCrossCheck(t *testing.T) {
+	policies, err := Parse([]byte(lintPolicies))
+	assert.NoError(t, err)
+	urls, err := ParseNotEnforcedURLs([]byte("https://${DomainName}/app/login*\nhttps://${DomainName}/-*-/*\n"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Finding{{Position{2, 1}, RuleProtectedNotEnforced, SeverityWarning,
+		"not enforced URL https://${DomainName}/-*-/* matches https://${DomainName}/app/*, protected by the policy " +
+			"at line 6"}}, CrossCheck(policies, urls, nil))
+
+	assert.Empty(t, CrossCheck(policies, urls, []string{RuleProtectedNotEnforced}))
+}
@@ -0,0 +1,112 @@
+package policyfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// NotEnforcedURLs is a not-enforced-urls.txt file, listing the URL patterns the agent lets through without a session
+type NotEnforcedURLs struct {
+	Patterns []URLPattern
+	// Disabled are the lint rules turned off by # named:disable comments in the file
+	Disabled []string
+}
+
+// URLPattern is an URL with AM wildcards: * matches anything, -*- matches within one path segment, and ?* matches any
+// query string
+type URLPattern struct {
+	Pattern  string
+	Position Position
+}
+
+const wildcardReplacement = "x"
+
+// ParseNotEnforcedURLs parses a not-enforced-urls.txt file, with one pattern per line. Blank lines and lines starting
+// with # are skipped. The error is Errors, with the position of every invalid pattern.
+func ParseNotEnforcedURLs(content []byte) (*NotEnforcedURLs, error) {
+	urls := &NotEnforcedURLs{}
+	var errs Errors
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		pattern := strings.TrimSpace(text)
+		position := Position{line, utf8.RuneCountInString(text[:strings.Index(text, pattern)]) + 1}
+
+		switch {
+		case len(pattern) == 0:
+			continue
+		case strings.HasPrefix(pattern, "#"):
+			urls.Disabled = append(urls.Disabled, disabledRules(strings.TrimPrefix(pattern, "#"))...)
+			continue
+		}
+
+		if err := validateURLPattern(pattern); err != nil {
+			errs = append(errs, Error{position, err.Error()})
+			continue
+		}
+		urls.Patterns = append(urls.Patterns, URLPattern{pattern, position})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, Errors{{Position{1, 1}, err.Error()}}
+	}
+
+	if len(errs) > 0 {
+		return urls, errs
+	}
+	return urls, nil
+}
+
+// validateURLPattern checks that the pattern is an absolute http or https URL once the wildcards are filled in
+func validateURLPattern(pattern string) error {
+	if strings.ContainsAny(pattern, " \t") {
+		return fmt.Errorf("pattern %s contains whitespace", pattern)
+	}
+
+	parsed, err := url.Parse(expandWildcards(pattern))
+	if err != nil {
+		return fmt.Errorf("pattern %s is not a valid URL", pattern)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("pattern %s must start with http:// or https://", pattern)
+	}
+	if len(parsed.Host) == 0 {
+		return fmt.Errorf("pattern %s has no host", pattern)
+	}
+
+	return nil
+}
+
+// expandWildcards replaces the placeholder and wildcards of a pattern so it can be parsed as an URL
+func expandWildcards(pattern string) string {
+	expanded := strings.Replace(pattern, domainNamePlaceholder, "domainname.invalid", -1)
+	expanded = strings.Replace(expanded, "-*-", wildcardReplacement, -1)
+	return strings.Replace(expanded, "*", wildcardReplacement, -1)
+}
+
+// patternPath returns the path and query of a pattern, with the wildcards left in
+func patternPath(pattern string) string {
+	rest := pattern[strings.Index(pattern, "://")+len("://"):]
+	if slash := strings.IndexAny(rest, "/?"); slash >= 0 {
+		return rest[slash:]
+	}
+	return ""
+}
+
+// patternRegexp returns a regexp matching what the pattern matches, with -*- not crossing a /
+func patternRegexp(pattern string) *regexp.Regexp {
+	var expr []string
+	for _, segmentWildcard := range strings.Split(pattern, "-*-") {
+		var parts []string
+		for _, literal := range strings.Split(segmentWildcard, "*") {
+			parts = append(parts, regexp.QuoteMeta(literal))
+		}
+		expr = append(expr, strings.Join(parts, ".*"))
+	}
+	return regexp.MustCompile("^" + strings.Join(expr, "[^/]*") + "$")
+}
@@ -0,0 +1,61 @@
+package policyfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNotEnforcedURLs(t *testing.T) {
+	content := []byte("# public pages\n\nhttps://${DomainName}/app/login*\n  https://${DomainName}/app/-*-/static/*?*\n")
+
+	urls, err := ParseNotEnforcedURLs(content)
+	assert.NoError(t, err)
+	assert.Equal(t, []URLPattern{
+		{"https://${DomainName}/app/login*", Position{3, 1}},
+		{"https://${DomainName}/app/-*-/static/*?*", Position{4, 3}},
+	}, urls.Patterns)
+}
+
+func TestInvalidNotEnforcedURLs(t *testing.T) {
+	content := []byte("/app/login*\nftp://${DomainName}/app\nhttps:///app\nhttps://${DomainName}/app login\n")
+
+	_, err := ParseNotEnforcedURLs(content)
+	assert.Equal(t, Errors{
+		{Position{1, 1}, "pattern /app/login* must start with http:// or https://"},
+		{Position{2, 1}, "pattern ftp://${DomainName}/app must start with http:// or https://"},
+		{Position{3, 1}, "pattern https:///app has no host"},
+		{Position{4, 1}, "pattern https://${DomainName}/app login contains whitespace"},
+	}, err)
+}
+
+func TestLintNotEnforcedURLs(t *testing.T) {
+	content := []byte("https://${DomainName}/*\nhttps://${DomainName}/-*-/*?*\nhttps://${DomainName}\n" +
+		"https://app-q1.nav.no/app/login*\nhttps://${DomainName}/app/*\n")
+
+	urls, err := ParseNotEnforcedURLs(content)
+	assert.NoError(t, err)
+
+	var ids []string
+	for _, finding := range LintNotEnforcedURLs(urls, nil) {
+		ids = append(ids, finding.RuleID)
+	}
+	assert.Equal(t, []string{
+		RuleBroadNotEnforcedURL,
+		RuleBroadNotEnforcedURL,
+		RuleBroadNotEnforcedURL,
+		RuleMissingDomainName,
+		RuleHardcodedHost,
+	}, ids)
+
+	urls, err = ParseNotEnforcedURLs(append([]byte("# named:disable broad-not-enforced-url\n"), content...))
+	assert.NoError(t, err)
+	assert.Len(t, LintNotEnforcedURLs(urls, []string{RuleHardcodedHost}), 1)
+}
+
+func TestPatternRegexp(t *testing.T) {
+	assert.True(t, patternRegexp("https://${DomainName}/app/*").MatchString("https://${DomainName}/app/a/b?c"))
+	assert.True(t, patternRegexp("https://${DomainName}/-*-/login").MatchString("https://${DomainName}/app/login"))
+	assert.False(t, patternRegexp("https://${DomainName}/-*-/login").MatchString("https://${DomainName}/a/b/login"))
+	assert.False(t, patternRegexp("https://${DomainName}/app/login*").MatchString("https://${DomainName}/app/*"))
+}
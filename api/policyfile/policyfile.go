@@ -0,0 +1,403 @@
+// Package policyfile parses the legacy OpenSSO policy files (policyAdmin.dtd) used for SBS applications
+package policyfile
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Position is where an element starts in a policy file. Lines and columns start at 1, and columns count characters.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Policies is the root element of a policy file
+type Policies struct {
+	Policies []Policy
+	Position Position
+	// Disabled are the lint rules turned off by named:disable comments in the file
+	Disabled []string
+}
+
+// Policy groups rules with the subjects and conditions that apply to all of them
+type Policy struct {
+	Name           string
+	ReferralPolicy string
+	Active         string
+	Rules          []Rule
+	Subjects       *Subjects
+	Conditions     *Conditions
+	Position       Position
+}
+
+// Rule gives actions on resources of a service
+type Rule struct {
+	Name                string
+	ServiceName         *ServiceName
+	ResourceNames       []ResourceName
+	AttributeValuePairs []AttributeValuePair
+	Position            Position
+}
+
+// ServiceName is the service a rule belongs to, like iPlanetAMWebAgentService
+type ServiceName struct {
+	Name     string
+	Position Position
+}
+
+// ResourceName is a resource, usually an url pattern, a rule applies to
+type ResourceName struct {
+	Name     string
+	Position Position
+}
+
+// AttributeValuePair is an attribute with its values, like an HTTP method and allow
+type AttributeValuePair struct {
+	Attribute string
+	Values    []string
+	Position  Position
+}
+
+// Subjects lists who a policy applies to
+type Subjects struct {
+	Subjects []Subject
+	Position Position
+}
+
+// Subject is a single subject of a policy, like AuthenticatedUsers
+type Subject struct {
+	Name        string
+	Type        string
+	IncludeType string
+	Position    Position
+}
+
+// Conditions lists the conditions for a policy to apply
+type Conditions struct {
+	Conditions []Condition
+	Position   Position
+}
+
+// Condition is a single condition of a policy, like AuthLevelCondition
+type Condition struct {
+	Name                string
+	Type                string
+	AttributeValuePairs []AttributeValuePair
+	Position            Position
+}
+
+// Error is a problem at a position in a policy file
+type Error struct {
+	Position
+	Message string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Message)
+}
+
+// Errors are all problems found in a policy file, ordered by position
+type Errors []Error
+
+func (errs Errors) Error() string {
+	messages := []string{}
+	for _, e := range errs {
+		messages = append(messages, e.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+var encodingDeclaration = regexp.MustCompile(`^<\?xml[^>]*encoding=["']([A-Za-z0-9._-]+)["']`)
+
+// Parse parses a policy file. The error is Errors, with the position of every problem found. Parsing stops at the
+// first XML syntax error, while structural problems are all collected.
+func Parse(content []byte) (*Policies, error) {
+	decoded, err := toUTF8(content)
+	if err != nil {
+		return nil, Errors{{Position{1, 1}, err.Error()}}
+	}
+
+	p := &parser{content: decoded}
+	root, syntaxErr := p.parseTree()
+	if syntaxErr != nil {
+		return nil, Errors{*syntaxErr}
+	}
+
+	policies := p.policies(root)
+	if len(p.errs) > 0 {
+		sort.SliceStable(p.errs, func(i, j int) bool {
+			a, b := p.errs[i].Position, p.errs[j].Position
+			return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+		})
+		return policies, p.errs
+	}
+
+	return policies, nil
+}
+
+// toUTF8 converts ISO-8859-1 policy files, which most legacy files are declared as, to UTF-8
+func toUTF8(content []byte) ([]byte, error) {
+	match := encodingDeclaration.FindSubmatch(content)
+	if match == nil {
+		return content, nil
+	}
+
+	switch strings.ToLower(string(match[1])) {
+	case "utf-8", "utf8", "us-ascii":
+		return content, nil
+	case "iso-8859-1", "iso8859-1", "latin1":
+		var buf bytes.Buffer
+		for _, b := range content {
+			buf.WriteRune(rune(b))
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unsupported encoding %s", match[1])
+}
+
+type node struct {
+	name     string
+	attrs    map[string]string
+	children []*node
+	text     string
+	position Position
+}
+
+type parser struct {
+	content  []byte
+	errs     Errors
+	disabled []string
+}
+
+// parseTree reads the elements of the file into a tree, remembering where each element starts
+func (p *parser) parseTree() (*node, *Error) {
+	decoder := xml.NewDecoder(bytes.NewReader(p.content))
+	decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+		// the content has already been converted to UTF-8
+		return input, nil
+	}
+
+	var root *node
+	var stack []*node
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			message := err.Error()
+			if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+				message = syntaxErr.Msg
+			}
+			// the error belongs to the token starting where the previous one ended
+			return nil, &Error{p.position(offset), message}
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			n := &node{name: t.Name.Local, attrs: map[string]string{}, position: p.position(offset)}
+			for _, attr := range t.Attr {
+				n.attrs[attr.Name.Local] = attr.Value
+			}
+
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			} else {
+				return nil, &Error{n.position, "only one root element is allowed, found " + n.name}
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(t)
+			}
+		case xml.Comment:
+			p.disabled = append(p.disabled, disabledRules(string(t))...)
+		}
+	}
+
+	if root == nil {
+		return nil, &Error{p.position(int64(len(p.content))), "no root element found"}
+	}
+	return root, nil
+}
+
+// position converts a byte offset to a line and column
+func (p *parser) position(offset int64) Position {
+	if offset > int64(len(p.content)) {
+		offset = int64(len(p.content))
+	}
+
+	before := p.content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return Position{line, utf8.RuneCount(before[lineStart:]) + 1}
+}
+
+func (p *parser) errorf(n *node, format string, args ...interface{}) {
+	p.errs = append(p.errs, Error{n.position, fmt.Sprintf(format, args...)})
+}
+
+func (p *parser) requireAttr(n *node, name string) string {
+	value, ok := n.attrs[name]
+	if !ok || len(strings.TrimSpace(value)) == 0 {
+		p.errorf(n, "%s is missing the %s attribute", n.name, name)
+	}
+	return value
+}
+
+func (p *parser) unexpected(n *node, child *node) {
+	p.errorf(child, "unexpected element %s in %s", child.name, n.name)
+}
+
+func (p *parser) policies(root *node) *Policies {
+	policies := &Policies{Position: root.position, Disabled: p.disabled}
+	if root.name != "Policies" {
+		p.errorf(root, "root element must be Policies, not %s", root.name)
+		return policies
+	}
+
+	for _, child := range root.children {
+		if child.name != "Policy" {
+			p.unexpected(root, child)
+			continue
+		}
+		policies.Policies = append(policies.Policies, p.policy(child))
+	}
+	return policies
+}
+
+func (p *parser) policy(n *node) Policy {
+	policy := Policy{
+		Name:           p.requireAttr(n, "name"),
+		ReferralPolicy: n.attrs["referralPolicy"],
+		Active:         n.attrs["active"],
+		Position:       n.position,
+	}
+
+	for _, child := range n.children {
+		switch child.name {
+		case "Rule":
+			policy.Rules = append(policy.Rules, p.rule(child))
+		case "Subjects":
+			if policy.Subjects != nil {
+				p.errorf(child, "Policy %s has more than one Subjects", policy.Name)
+			}
+			policy.Subjects = p.subjects(child)
+		case "Conditions":
+			if policy.Conditions != nil {
+				p.errorf(child, "Policy %s has more than one Conditions", policy.Name)
+			}
+			policy.Conditions = p.conditions(child)
+		default:
+			p.unexpected(n, child)
+		}
+	}
+
+	return policy
+}
+
+func (p *parser) rule(n *node) Rule {
+	rule := Rule{Name: p.requireAttr(n, "name"), Position: n.position}
+
+	for _, child := range n.children {
+		switch child.name {
+		case "ServiceName":
+			if rule.ServiceName != nil {
+				p.errorf(child, "Rule %s has more than one ServiceName", rule.Name)
+			}
+			rule.ServiceName = &ServiceName{p.requireAttr(child, "name"), child.position}
+		case "ResourceName":
+			rule.ResourceNames = append(rule.ResourceNames, ResourceName{p.requireAttr(child, "name"), child.position})
+		case "AttributeValuePair":
+			rule.AttributeValuePairs = append(rule.AttributeValuePairs, p.attributeValuePair(child))
+		default:
+			p.unexpected(n, child)
+		}
+	}
+
+	if rule.ServiceName == nil {
+		p.errorf(n, "Rule %s has no ServiceName", rule.Name)
+	}
+	return rule
+}
+
+func (p *parser) attributeValuePair(n *node) AttributeValuePair {
+	pair := AttributeValuePair{Position: n.position}
+	hasAttribute := false
+
+	for _, child := range n.children {
+		switch child.name {
+		case "Attribute":
+			if hasAttribute {
+				p.errorf(child, "AttributeValuePair has more than one Attribute")
+			}
+			hasAttribute = true
+			pair.Attribute = p.requireAttr(child, "name")
+		case "Value":
+			pair.Values = append(pair.Values, strings.TrimSpace(child.text))
+		default:
+			p.unexpected(n, child)
+		}
+	}
+
+	if !hasAttribute {
+		p.errorf(n, "AttributeValuePair has no Attribute")
+	}
+	return pair
+}
+
+func (p *parser) subjects(n *node) *Subjects {
+	subjects := &Subjects{Position: n.position}
+	for _, child := range n.children {
+		if child.name != "Subject" {
+			p.unexpected(n, child)
+			continue
+		}
+		subjects.Subjects = append(subjects.Subjects, Subject{
+			Name:        p.requireAttr(child, "name"),
+			Type:        p.requireAttr(child, "type"),
+			IncludeType: child.attrs["includeType"],
+			Position:    child.position,
+		})
+	}
+	return subjects
+}
+
+func (p *parser) conditions(n *node) *Conditions {
+	conditions := &Conditions{Position: n.position}
+	for _, child := range n.children {
+		if child.name != "Condition" {
+			p.unexpected(n, child)
+			continue
+		}
+
+		condition := Condition{
+			Name:     p.requireAttr(child, "name"),
+			Type:     p.requireAttr(child, "type"),
+			Position: child.position,
+		}
+		for _, grandchild := range child.children {
+			if grandchild.name != "AttributeValuePair" {
+				p.unexpected(child, grandchild)
+				continue
+			}
+			condition.AttributeValuePairs = append(condition.AttributeValuePairs, p.attributeValuePair(grandchild))
+		}
+		conditions.Conditions = append(conditions.Conditions, condition)
+	}
+	return conditions
+}
@@ -0,0 +1,73 @@
+package policyfile
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePolicyFile(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/app-policies.xml")
+	assert.NoError(t, err)
+
+	policies, err := Parse(content)
+	assert.NoError(t, err)
+	assert.Len(t, policies.Policies, 1)
+
+	policy := policies.Policies[0]
+	assert.Equal(t, "Draco_001", policy.Name)
+	assert.Equal(t, "true", policy.Active)
+	assert.Equal(t, Position{8, 2}, policy.Position)
+	assert.Len(t, policy.Rules, 4)
+
+	rule := policy.Rules[0]
+	assert.Equal(t, "rule_Draco_001_01", rule.Name)
+	assert.Equal(t, "iPlanetAMWebAgentService", rule.ServiceName.Name)
+	assert.Equal(t, "https://tjenester-u653.nav.no/draco/*", rule.ResourceNames[0].Name)
+	assert.Equal(t, []AttributeValuePair{
+		{Attribute: "POST", Values: []string{"allow"}, Position: Position{12, 4}},
+		{Attribute: "GET", Values: []string{"allow"}, Position: Position{16, 4}},
+	}, rule.AttributeValuePairs)
+
+	assert.Equal(t, []Subject{{Name: "subject_Draco_001_01", Type: "AuthenticatedUsers", IncludeType: "inclusive",
+		Position: Position{58, 4}}}, policy.Subjects.Subjects)
+	assert.Equal(t, "AuthLevelCondition", policy.Conditions.Conditions[0].Type)
+	assert.Equal(t, []string{"3"}, policy.Conditions.Conditions[0].AttributeValuePairs[0].Values)
+}
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	_, err := Parse([]byte("<?xml version=\"1.0\"?>\n<Policies>\n  <Policy name=\"a\">\n  </Polcy>\n</Policies>"))
+
+	assert.Equal(t, Errors{{Position{4, 3}, "element <Policy> closed by </Polcy>"}}, err)
+}
+
+func TestStructuralErrors(t *testing.T) {
+	_, err := Parse([]byte("<Policies>\n  <Policy>\n    <Rule name=\"r\"><Foo/></Rule>\n  </Policy>\n</Policies>"))
+
+	assert.Equal(t, Errors{
+		{Position{2, 3}, "Policy is missing the name attribute"},
+		{Position{3, 5}, "Rule r has no ServiceName"},
+		{Position{3, 20}, "unexpected element Foo in Rule"},
+	}, err)
+}
+
+func TestMissingRootElement(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/app-policies-error.xml")
+	assert.NoError(t, err)
+
+	_, err = Parse(content)
+	assert.Error(t, err)
+	assert.Equal(t, 64, err.(Errors)[0].Line)
+}
+
+func TestLatin1(t *testing.T) {
+	content := []byte("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<Policies><Policy name=\"S\xf8knad\">" +
+		"<Rule name=\"r\"><ServiceName name=\"s\" /></Rule></Policy></Policies>")
+
+	policies, err := Parse(content)
+	assert.NoError(t, err)
+	assert.Equal(t, "Søknad", policies.Policies[0].Name)
+	assert.Equal(t, Position{2, 11}, policies.Policies[0].Position)
+	assert.Equal(t, Position{2, 33}, policies.Policies[0].Rules[0].Position)
+}
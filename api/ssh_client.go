@@ -1,23 +1,98 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHSettings configure how named connects to the AM hosts, set with SetSSHSettings
+type SSHSettings struct {
+	// KnownHostsFile verifies the AM hosts without a hostKey property in Fasit
+	KnownHostsFile string
+	// PrivateKeyFile is an unencrypted private key, tried before the password from Fasit
+	PrivateKeyFile string
+	// UseAgent tries the keys of the SSH agent at SSH_AUTH_SOCK before the password from Fasit
+	UseAgent bool
+	// InsecureIgnoreHostKey accepts any host key, for tests only
+	InsecureIgnoreHostKey bool
+	DialTimeout           time.Duration
+	HandshakeTimeout      time.Duration
+}
+
+// HostKeyError is returned when the host key of an AM host is unknown or does not match the known one
+type HostKeyError struct {
+	Hostname string
+	Unknown  bool
+	Err      error
+}
+
+const (
+	defaultSSHDialTimeout      = 10 * time.Second
+	defaultSSHHandshakeTimeout = 10 * time.Second
 )
 
+var sshSettings = SSHSettings{DialTimeout: defaultSSHDialTimeout, HandshakeTimeout: defaultSSHHandshakeTimeout}
+
+// SetSSHSettings sets how AM hosts are verified and authenticated with
+func SetSSHSettings(settings SSHSettings) {
+	sshSettings = settings
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("host key of %s is not known: %s", e.Hostname, e.Err)
+	}
+	return fmt.Sprintf("host key of %s does not match the known host key: %s", e.Hostname, e.Err)
+}
+
 //SSHConnect returns ssh client and session for specified host
 func SSHConnect(resource *OpenAmResource, port string) (*ssh.Client, *ssh.Session, error) {
+	address := net.JoinHostPort(resource.Hostname, port)
+	hostKeyCallback, hostKeyAlgorithms, err := sshHostKeyCallback(resource, address)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	auth, closeAgent, err := sshAuthMethods(resource)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeAgent()
+
+	// the error of the host key check is kept, as the handshake error only has its message
+	var hostKeyErr error
 	sshConfig := &ssh.ClientConfig{
 		User: resource.Username,
-		Auth: []ssh.AuthMethod{ssh.Password(resource.Password)},
+		Auth: auth,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if err := hostKeyCallback(hostname, remote, key); err != nil {
+				keyErr, ok := err.(*knownhosts.KeyError)
+				hostKeyErr = &HostKeyError{Hostname: resource.Hostname, Unknown: ok && len(keyErr.Want) == 0, Err: err}
+				return hostKeyErr
+			}
+			return nil
+		},
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           sshSettings.DialTimeout,
 	}
 
-	serverString := resource.Hostname + ":" + port
-
-	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
-	client, err := ssh.Dial("tcp", serverString, sshConfig)
+	client, err := sshDial(address, sshConfig)
 	if err != nil {
+		if hostKeyErr != nil {
+			return nil, nil, hostKeyErr
+		}
 		return nil, nil, err
 	}
 
@@ -30,6 +105,165 @@ func SSHConnect(resource *OpenAmResource, port string) (*ssh.Client, *ssh.Sessio
 	return client, session, nil
 }
 
+// SSHAppError describes why connecting to the AM host failed
+func SSHAppError(err error, hostname string) *AppError {
+	if hostKeyErr, ok := err.(*HostKeyError); ok {
+		return &AppError{hostKeyErr, "Refusing to connect to " + hostname + ", add its host key to the known hosts " +
+			"of named or the hostKey property of the OpenAM resource in Fasit", http.StatusBadGateway}
+	}
+	return &AppError{err, "SSH session failed", http.StatusServiceUnavailable}
+}
+
+// sshDial connects within the dial timeout, and gives up if the handshake is not done within the handshake timeout
+func sshDial(address string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", address, sshConfig.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %s", address, err)
+	}
+
+	if sshSettings.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(sshSettings.HandshakeTimeout))
+	}
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+// sshHostKeyCallback verifies the AM host against the hostKey property in Fasit, or else the known hosts file. Unknown
+// hosts are refused unless InsecureIgnoreHostKey is set. The host key algorithms are those of the known keys, so the
+// server can't offer a key of another type, which would be refused as a changed key.
+func sshHostKeyCallback(resource *OpenAmResource, address string) (ssh.HostKeyCallback, []string, error) {
+	if len(resource.HostKey) > 0 {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resource.HostKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse hostKey of %s in Fasit: %s", resource.Hostname, err)
+		}
+		return ssh.FixedHostKey(key), hostKeyAlgorithms(key.Type()), nil
+	}
+
+	if sshSettings.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	if len(sshSettings.KnownHostsFile) == 0 {
+		return nil, nil, &HostKeyError{Hostname: resource.Hostname, Unknown: true,
+			Err: errors.New("no known hosts file is configured")}
+	}
+
+	callback, err := knownhosts.New(sshSettings.KnownHostsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read known hosts: %s", err)
+	}
+	return callback, knownHostKeyAlgorithms(callback, address), nil
+}
+
+// probeKey is a key of a type no host has, so checking it against the known hosts lists all known keys of a host
+type probeKey struct{}
+
+func (probeKey) Type() string {
+	return "named-probe"
+}
+
+func (probeKey) Marshal() []byte {
+	return []byte("named-probe")
+}
+
+func (probeKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("probe keys can't verify signatures")
+}
+
+// knownHostKeyAlgorithms returns the host key algorithms of the keys known for the address. It returns nil to allow
+// any when no keys are listed for it, or when it is verified by a certificate authority, as its certificates may be
+// signed with keys of any type.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, address string) []string {
+	keyErr, ok := callback(address, &net.TCPAddr{}, probeKey{}).(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+
+	var keyTypes []string
+	for _, known := range keyErr.Want {
+		if certificateAuthority(known) {
+			return nil
+		}
+		keyTypes = append(keyTypes, known.Key.Type())
+	}
+	return hostKeyAlgorithms(keyTypes...)
+}
+
+// certificateAuthority tells whether the known key is on a @cert-authority line
+func certificateAuthority(known knownhosts.KnownKey) bool {
+	content, err := ioutil.ReadFile(known.Filename)
+	if err != nil {
+		return false
+	}
+
+	lines := strings.Split(string(content), "\n")
+	return known.Line > 0 && known.Line <= len(lines) &&
+		strings.HasPrefix(strings.TrimSpace(lines[known.Line-1]), "@cert-authority")
+}
+
+// hostKeyAlgorithms returns the algorithms the host may sign with using keys of the types. RSA keys also sign with
+// SHA-2, which servers prefer or require.
+func hostKeyAlgorithms(keyTypes ...string) []string {
+	var algorithms []string
+	for _, keyType := range keyTypes {
+		if keyType == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, keyType)
+	}
+	sort.Strings(algorithms)
+	return algorithms
+}
+
+// sshAuthMethods returns the private key, the agent and the password from Fasit, in the order they are tried, and a
+// function closing the connection to the agent once the handshake is done
+func sshAuthMethods(resource *OpenAmResource) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closeAgent := func() {}
+
+	if len(sshSettings.PrivateKeyFile) > 0 {
+		key, err := ioutil.ReadFile(sshSettings.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read SSH private key: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse SSH private key %s: %s", sshSettings.PrivateKeyFile, err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	if sshSettings.UseAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if len(socket) == 0 {
+			return nil, nil, errors.New("SSH agent is enabled, but SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not connect to SSH agent: %s", err)
+		}
+		closeAgent = func() { conn.Close() }
+		methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+
+	if len(resource.Password) > 0 {
+		methods = append(methods, ssh.Password(resource.Password))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, fmt.Errorf("no SSH credentials for %s, set a private key, the agent or a password in Fasit",
+			resource.Hostname)
+	}
+	return methods, closeAgent, nil
+}
+
 // SftpConnect returns sftp client for existing ssh client
 func SftpConnect(sshClient *ssh.Client) (*sftp.Client, error) {
 	sftpClient, err := sftp.NewClient(sshClient)
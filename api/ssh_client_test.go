@@ -0,0 +1,264 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// execHandler runs a command on the test SSH server, returning its exit status
+type execHandler func(command string, stdout, stderr io.Writer) uint32
+
+// startSSHServer accepts password logins as user/pass until the listener is closed, and returns the host key and port
+// of the server. Commands are run by exec, if given. The server also offers the extra host keys.
+func startSSHServer(t *testing.T, exec execHandler, extraHostKeys ...ssh.Signer) (ssh.Signer, string, net.Listener) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "user" && string(password) == "pass" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostKey)
+	for _, extraHostKey := range extraHostKeys {
+		config.AddHostKey(extraHostKey)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for channel := range channels {
+					ch, channelRequests, err := channel.Accept()
+					if err != nil {
+						continue
+					}
+					if exec == nil {
+						ch.Close()
+						continue
+					}
+					go serveSession(ch, channelRequests, exec)
+				}
+			}()
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return hostKey, port, listener
+}
+
+// tempFile writes the file to a temp directory, returning a function removing it
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request, exec execHandler) {
+	defer channel.Close()
+
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			req.Reply(true, nil)
+
+			status := exec(payload.Command, channel, channel.Stderr())
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func tempFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ssh")
+	assert.NoError(t, err)
+
+	fileName := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(fileName, []byte(content), 0600))
+	return fileName, func() { os.RemoveAll(dir) }
+}
+
+func TestSSHConnectRefusesUnknownHost(t *testing.T) {
+	_, port, listener := startSSHServer(t, nil)
+	defer listener.Close()
+	defer SetSSHSettings(sshSettings)
+	SetSSHSettings(SSHSettings{DialTimeout: time.Second, HandshakeTimeout: time.Second})
+
+	resource := &OpenAmResource{Hostname: "127.0.0.1", Username: "user", Password: "pass"}
+	_, _, err := SSHConnect(resource, port)
+	assert.IsType(t, &HostKeyError{}, err)
+	assert.EqualError(t, err, "host key of 127.0.0.1 is not known: no known hosts file is configured")
+
+	knownHosts, cleanup := tempFile(t, "known_hosts", "")
+	defer cleanup()
+	SetSSHSettings(SSHSettings{KnownHostsFile: knownHosts, DialTimeout: time.Second, HandshakeTimeout: time.Second})
+
+	_, _, err = SSHConnect(resource, port)
+	assert.IsType(t, &HostKeyError{}, err)
+	assert.True(t, err.(*HostKeyError).Unknown)
+
+	appErr := SSHAppError(err, resource.Hostname)
+	assert.Equal(t, 502, appErr.StatusCode)
+	assert.Contains(t, appErr.Message, "Refusing to connect to 127.0.0.1")
+}
+
+func TestSSHConnectWithKnownHost(t *testing.T) {
+	hostKey, port, listener := startSSHServer(t, nil)
+	defer listener.Close()
+
+	knownHosts, cleanup := tempFile(t, "known_hosts",
+		knownhosts.Line([]string{knownhosts.Normalize("127.0.0.1:" + port)}, hostKey.PublicKey())+"\n")
+	defer cleanup()
+	defer SetSSHSettings(sshSettings)
+	SetSSHSettings(SSHSettings{KnownHostsFile: knownHosts, DialTimeout: time.Second, HandshakeTimeout: time.Second})
+
+	client, session, err := SSHConnect(&OpenAmResource{Hostname: "127.0.0.1", Username: "user", Password: "pass"}, port)
+	assert.NoError(t, err)
+	session.Close()
+	client.Close()
+}
+
+func TestSSHConnectWithHostKeyFromFasit(t *testing.T) {
+	hostKey, port, listener := startSSHServer(t, nil)
+	defer listener.Close()
+	otherKey, _, otherListener := startSSHServer(t, nil)
+	otherListener.Close()
+	defer SetSSHSettings(sshSettings)
+	SetSSHSettings(SSHSettings{DialTimeout: time.Second, HandshakeTimeout: time.Second})
+
+	resource := &OpenAmResource{Hostname: "127.0.0.1", Username: "user", Password: "pass",
+		HostKey: string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))}
+	client, session, err := SSHConnect(resource, port)
+	assert.NoError(t, err)
+	session.Close()
+	client.Close()
+
+	resource.HostKey = string(ssh.MarshalAuthorizedKey(otherKey.PublicKey()))
+	_, _, err = SSHConnect(resource, port)
+	assert.IsType(t, &HostKeyError{}, err)
+	assert.False(t, err.(*HostKeyError).Unknown)
+}
+
+// rsaHostKey returns a new RSA host key, which clients prefer over ed25519 when the host key algorithms are not
+// restricted
+func rsaHostKey(t *testing.T) ssh.Signer {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(private)
+	assert.NoError(t, err)
+	return signer
+}
+
+func TestSSHConnectOnlyNegotiatesKnownKeyTypes(t *testing.T) {
+	hostKey, port, listener := startSSHServer(t, nil, rsaHostKey(t))
+	defer listener.Close()
+	defer SetSSHSettings(sshSettings)
+
+	SetSSHSettings(SSHSettings{DialTimeout: time.Second, HandshakeTimeout: time.Second})
+	resource := &OpenAmResource{Hostname: "127.0.0.1", Username: "user", Password: "pass",
+		HostKey: string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))}
+	client, session, err := SSHConnect(resource, port)
+	assert.NoError(t, err, "the ed25519 key from Fasit is used, though the server also has an RSA key")
+	session.Close()
+	client.Close()
+
+	knownHosts, cleanup := tempFile(t, "known_hosts",
+		knownhosts.Line([]string{knownhosts.Normalize("127.0.0.1:" + port)}, hostKey.PublicKey())+"\n")
+	defer cleanup()
+	SetSSHSettings(SSHSettings{KnownHostsFile: knownHosts, DialTimeout: time.Second, HandshakeTimeout: time.Second})
+
+	resource.HostKey = ""
+	client, session, err = SSHConnect(resource, port)
+	assert.NoError(t, err, "the ed25519 key from known_hosts is used, though the server also has an RSA key")
+	session.Close()
+	client.Close()
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	assert.Equal(t, []string{"ssh-ed25519"}, hostKeyAlgorithms("ssh-ed25519"))
+	assert.Equal(t, []string{"rsa-sha2-256", "rsa-sha2-512", "ssh-rsa"}, hostKeyAlgorithms("ssh-rsa"))
+
+	rsaKey := rsaHostKey(t).PublicKey()
+	knownHosts, cleanup := tempFile(t, "known_hosts",
+		knownhosts.Line([]string{knownhosts.Normalize("am.local")}, rsaKey)+"\n"+
+			"@cert-authority *.example.com "+string(ssh.MarshalAuthorizedKey(rsaKey)))
+	defer cleanup()
+	callback, err := knownhosts.New(knownHosts)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"rsa-sha2-256", "rsa-sha2-512", "ssh-rsa"}, knownHostKeyAlgorithms(callback, "am.local:22"))
+	assert.Nil(t, knownHostKeyAlgorithms(callback, "other.local:22"))
+	assert.Nil(t, knownHostKeyAlgorithms(callback, "am.example.com:22"), "hosts with certificates may use any key")
+}
+
+func TestSSHConnectWithPrivateKey(t *testing.T) {
+	_, port, listener := startSSHServer(t, nil)
+	defer listener.Close()
+
+	keyFile, cleanup := tempFile(t, "id_rsa", "not a key")
+	defer cleanup()
+	defer SetSSHSettings(sshSettings)
+	SetSSHSettings(SSHSettings{PrivateKeyFile: keyFile, InsecureIgnoreHostKey: true})
+
+	_, _, err := SSHConnect(&OpenAmResource{Hostname: "127.0.0.1", Username: "user"}, port)
+	assert.Contains(t, err.Error(), "could not parse SSH private key")
+
+	SetSSHSettings(SSHSettings{InsecureIgnoreHostKey: true})
+	_, _, err = SSHConnect(&OpenAmResource{Hostname: "127.0.0.1", Username: "user"}, port)
+	assert.EqualError(t, err, "no SSH credentials for 127.0.0.1, set a private key, the agent or a password in Fasit")
+}
+
+func TestSSHHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	// accepts connections, but never says anything
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	defer SetSSHSettings(sshSettings)
+	SetSSHSettings(SSHSettings{InsecureIgnoreHostKey: true, DialTimeout: time.Second,
+		HandshakeTimeout: 100 * time.Millisecond})
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	started := time.Now()
+	_, _, err = SSHConnect(&OpenAmResource{Hostname: "127.0.0.1", Username: "user", Password: "pass"}, port)
+	assert.Error(t, err)
+	assert.True(t, time.Since(started) < time.Second)
+}
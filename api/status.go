@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AgentStatus describes the ISSO agent of an application as it is in AM
+type AgentStatus struct {
+	Name            string   `json:"name"`
+	Exists          bool     `json:"exists"`
+	RedirectionUris []string `json:"redirectionUris,omitempty"`
+}
+
+// FasitResourceStatus describes the OpenIdConnect resource of an application as it is in Fasit
+type FasitResourceStatus struct {
+	Alias      string            `json:"alias"`
+	Exists     bool              `json:"exists"`
+	ID         int               `json:"id,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Secrets    []string          `json:"secrets,omitempty"`
+}
+
+// ConfigurationStatus describes the current AM configuration of an application
+type ConfigurationStatus struct {
+	Application   string               `json:"application"`
+	Environment   string               `json:"environment"`
+	Zone          string               `json:"zone"`
+	Agent         *AgentStatus         `json:"agent,omitempty"`
+	FasitResource *FasitResourceStatus `json:"fasitResource,omitempty"`
+	Policies      []Policy             `json:"policies,omitempty"`
+}
+
+func (api *API) status(w http.ResponseWriter, r *http.Request) *AppError {
+	requests.With(prometheus.Labels{"path": "status"}).Inc()
+
+	request, appErr := requestFromPath(r)
+	if appErr != nil {
+		return appErr
+	}
+
+	fasitClient := FasitClient{api.FasitURL, request.Username, request.Password}
+	if fasitErr := validateFasitRequirements(&fasitClient, &request); fasitErr != nil {
+		return fasitErr
+	}
+
+	zone := GetZone(api.ClusterName)
+	status := ConfigurationStatus{
+		Application: request.Application,
+		Environment: request.Environment,
+		Zone:        zone,
+	}
+
+	switch zone {
+	case ZoneFss:
+		appErr = fssStatus(&fasitClient, &request, zone, &status)
+	case ZoneSbs:
+		appErr = sbsStatus(&fasitClient, &request, zone, &status)
+	default:
+		return &AppError{nil, "Zone has to be fss or sbs, not " + zone, http.StatusBadRequest}
+	}
+
+	if appErr != nil {
+		return appErr
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		return &AppError{err, "Unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	return nil
+}
+
+func fssStatus(fasit *FasitClient, request *NamedConfigurationRequest, zone string, status *ConfigurationStatus) *AppError {
+	adminResource, appErr := fasit.GetAmAdminResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	agentName := fmt.Sprintf("%s-%s", request.Application, request.Environment)
+	status.Agent = &AgentStatus{Name: agentName}
+	if am.AgentExists(agentName) {
+		agent, err := am.GetAgent(agentName)
+		if err != nil {
+			glog.Errorf("Failed to read AM agent %s: %s", agentName, err)
+			return &AppError{err, "AM agent could not be read", http.StatusBadGateway}
+		}
+
+		status.Agent.Exists = true
+		status.Agent.RedirectionUris = agent.RedirectionUris()
+	}
+
+	alias := fmt.Sprintf("%s-oidc", request.Application)
+	status.FasitResource = &FasitResourceStatus{Alias: alias}
+	resource, fasitErr := getFasitResource(*fasit, ResourceRequest{alias, ResourceTypeOIDC}, request.Environment,
+		request.Application, zone)
+	if fasitErr != nil {
+		if fasitErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return fasitErr
+	}
+
+	status.FasitResource.Exists = true
+	status.FasitResource.ID = resource.ID
+	status.FasitResource.Properties = resource.Properties
+	for name := range resource.Secrets {
+		status.FasitResource.Secrets = append(status.FasitResource.Secrets, name)
+	}
+	sort.Strings(status.FasitResource.Secrets)
+
+	return nil
+}
+
+func sbsStatus(fasit *FasitClient, request *NamedConfigurationRequest, zone string, status *ConfigurationStatus) *AppError {
+	adminResource, appErr := fasit.GetAmAdminResource(request, zone)
+	if appErr != nil {
+		glog.Errorf("Could not get OIDC resource: %s", appErr)
+		return appErr
+	}
+
+	am, err := GetAmConnection(&adminResource)
+	if err != nil {
+		glog.Errorf("Failed to connect to AM server: %s", err)
+		return &AppError{err, "AM server connection failed", http.StatusServiceUnavailable}
+	}
+	defer am.Release()
+
+	policies, err := ListPolicy(am)
+	if err != nil {
+		glog.Errorf("Failed to list AM policies: %s", err)
+		return &AppError{err, "Could not list AM policies", http.StatusBadGateway}
+	}
+
+	status.Policies = ApplicationPolicies(policies, request.Application)
+	return nil
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/h2non/gock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusSBS(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-sbs"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"admin\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get(policyURL).
+		MatchParam("_queryFilter", "true").
+		Reply(200).
+		BodyString(`{"result": [{"name": "Testapp_001"}, {"name": "Testapp2_001"}, {"name": "OAuth2ProviderPolicy",
+			"resources": ["https://server.domain.com/testapp/*"]}], "resultCount": 3}`)
+
+	req, _ := http.NewRequest("GET", "/status/testapp/t0", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var status ConfigurationStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, ZoneSbs, status.Zone)
+	assert.Nil(t, status.Agent)
+	assert.Len(t, status.Policies, 1)
+	assert.Equal(t, "Testapp_001", status.Policies[0].Name)
+}
+
+func TestStatusSBSWhenPolicyListingIsRejected(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-sbs"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"reader\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get(policyURL).
+		MatchParam("_queryFilter", "true").
+		Reply(403).
+		BodyString(`{"code": 403, "reason": "Forbidden"}`)
+
+	req, _ := http.NewRequest("GET", "/status/testapp/t0", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Contains(t, rr.Body.String(), "Could not list AM policies")
+	assert.True(t, gock.IsDone())
+}
+
+func TestStatusFSS(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"admin\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/agents/testapp-t0").
+		Times(2).
+		Reply(200).
+		BodyString(`{"com.forgerock.openam.oauth2provider.redirectionURIs": ["[0]=https://testapp.nais.preprod.local/test"]}`)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", "testapp-oidc").
+		MatchParam("type", ResourceTypeOIDC).
+		Reply(200).File("testdata/fasitOpenIDConnectResponse.json")
+
+	req, _ := http.NewRequest("GET", "/status/testapp/t0", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var status ConfigurationStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, ZoneFss, status.Zone)
+	assert.Equal(t, &AgentStatus{Name: "testapp-t0", Exists: true,
+		RedirectionUris: []string{"https://testapp.nais.preprod.local/test"}}, status.Agent)
+	assert.True(t, status.FasitResource.Exists)
+	assert.Equal(t, 256, status.FasitResource.ID)
+	assert.Equal(t, "nais-testapp-t6", status.FasitResource.Properties["agentName"])
+	assert.Equal(t, []string{"password"}, status.FasitResource.Secrets)
+	assert.Empty(t, status.Policies)
+	assert.True(t, gock.IsDone())
+}
+
+func TestStatusFSSWithoutAgentOrResource(t *testing.T) {
+	api := API{FasitURL: "https://fasit.local", ClusterName: "dev-fss"}
+
+	defer gock.Off()
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/environments/t0").
+		Reply(200).BodyString("{\"environmentclass\": \"t\"}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/applications/testapp").
+		Reply(200)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "BaseUrl").
+		Reply(200).BodyString("{\"properties\": {\"url\": \"" + baseURL + "\"}}")
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", openidconnectalias).
+		MatchParam("type", "Credential").
+		Reply(200).BodyString("{\"properties\": {\"username\": \"admin\"}}")
+
+	gock.New(baseURL).
+		Post(authURL).
+		Reply(200).BodyString("{\"tokenId\": \"token\"}")
+
+	gock.New(baseURL).
+		Get("/json/agents/testapp-t0").
+		Reply(404)
+
+	gock.New("https://fasit.local").
+		Get("/api/v2/scopedresource").
+		MatchParam("alias", "testapp-oidc").
+		MatchParam("type", ResourceTypeOIDC).
+		Reply(404)
+
+	req, _ := http.NewRequest("GET", "/status/testapp/t0", nil)
+	req.SetBasicAuth("user", "pass")
+	rr := httptest.NewRecorder()
+	api.MakeHandler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var status ConfigurationStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, &AgentStatus{Name: "testapp-t0"}, status.Agent)
+	assert.Equal(t, &FasitResourceStatus{Alias: "testapp-oidc"}, status.FasitResource)
+	assert.True(t, gock.IsDone())
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"github.com/nais/named/api/policyfile"
+	"github.com/nais/named/api/version"
+)
+
+// Formats of validation reports
+const (
+	ReportText  = "text"
+	ReportJSON  = "json"
+	ReportJUnit = "junit"
+	ReportSARIF = "sarif"
+)
+
+const (
+	// invalidFileRuleID is used in reports for problems found before linting, like syntax errors
+	invalidFileRuleID   = "invalid-file"
+	sarifSchema         = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion        = "2.1.0"
+	namedInformationURI = "https://github.com/nais/named"
+)
+
+// ValidationReport formats the result of validating the files, so CI systems can annotate and archive it
+func ValidationReport(files []string, validationErrors ValidationErrors, format string) ([]byte, error) {
+	switch format {
+	case ReportText:
+		return []byte(validationErrors.Error()), nil
+	case ReportJSON:
+		return jsonReport(files, validationErrors)
+	case ReportJUnit:
+		return junitReport(files, validationErrors)
+	case ReportSARIF:
+		return sarifReport(validationErrors)
+	}
+	return nil, fmt.Errorf("unknown report format %s, must be one of %s, %s, %s or %s", format, ReportText,
+		ReportJSON, ReportJUnit, ReportSARIF)
+}
+
+func jsonReport(files []string, validationErrors ValidationErrors) ([]byte, error) {
+	problems := validationErrors.Errors
+	if problems == nil {
+		problems = []ValidationError{}
+	}
+
+	return json.MarshalIndent(struct {
+		Valid    bool              `json:"valid"`
+		Files    []string          `json:"files"`
+		Errors   int               `json:"errors"`
+		Warnings int               `json:"warnings"`
+		Problems []ValidationError `json:"problems"`
+	}{
+		Valid:    !validationErrors.HasErrors(),
+		Files:    files,
+		Errors:   len(problems) - len(validationErrors.Warnings()),
+		Warnings: len(validationErrors.Warnings()),
+		Problems: problems,
+	}, "", "  ")
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport has a test case for each file, failing with its errors. Warnings are only written to system-out.
+func junitReport(files []string, validationErrors ValidationErrors) ([]byte, error) {
+	suite := junitTestSuite{Name: "named validate", Tests: len(files)}
+
+	for _, file := range files {
+		testCase := junitTestCase{ClassName: "named.validate", Name: file}
+
+		var errs, warnings []string
+		for _, validationError := range validationErrors.Errors {
+			if validationError.File != file {
+				continue
+			}
+			if validationError.Severity == policyfile.SeverityWarning {
+				warnings = append(warnings, validationError.String())
+			} else {
+				errs = append(errs, validationError.String())
+			}
+		}
+
+		if len(errs) > 0 {
+			suite.Failures++
+			testCase.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d problems found in %s", len(errs), file),
+				Type:    "validation",
+				Text:    strings.Join(errs, "\n"),
+			}
+		}
+		testCase.SystemOut = strings.Join(warnings, "\n")
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	report, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), report...), nil
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn"`
+}
+
+// sarifReport lists every lint rule, so code scanning can describe them, and a result for each problem
+func sarifReport(validationErrors ValidationErrors) ([]byte, error) {
+	rules := []sarifRule{{
+		ID:                   invalidFileRuleID,
+		ShortDescription:     sarifMessage{"policy files must be readable and well formed"},
+		DefaultConfiguration: sarifConfiguration{string(policyfile.SeverityError)},
+	}}
+	for _, rule := range policyfile.LintRules {
+		rules = append(rules, sarifRule{
+			ID:                   rule.ID,
+			ShortDescription:     sarifMessage{rule.Description},
+			DefaultConfiguration: sarifConfiguration{string(rule.Severity)},
+		})
+	}
+
+	results := []sarifResult{}
+	for _, validationError := range validationErrors.Errors {
+		result := sarifResult{
+			RuleID:  validationError.RuleID,
+			Level:   string(validationError.Severity),
+			Message: sarifMessage{validationError.ErrorMessage},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{validationError.File},
+			}}},
+		}
+		if len(result.RuleID) == 0 {
+			result.RuleID = invalidFileRuleID
+		}
+		if validationError.Line > 0 {
+			result.Locations[0].PhysicalLocation.Region = &sarifRegion{validationError.Line, validationError.Column}
+		}
+		results = append(results, result)
+	}
+
+	return json.MarshalIndent(sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "named",
+				Version:        version.Version,
+				InformationURI: namedInformationURI,
+				Rules:          rules,
+			}},
+			Results: results,
+		}},
+	}, "", "  ")
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+
+	"github.com/nais/named/api/policyfile"
+	"github.com/stretchr/testify/assert"
+)
+
+var reportFiles = []string{"app-policies.xml", "not-enforced-urls.txt"}
+
+var reportErrors = ValidationErrors{Errors: []ValidationError{
+	{ErrorMessage: "Rule r has no ServiceName", File: "app-policies.xml", Line: 3, Column: 5,
+		Severity: policyfile.SeverityError},
+	{ErrorMessage: "not enforced URL https://app-q1.nav.no/login* does not use ${DomainName}",
+		File: "not-enforced-urls.txt", Line: 1, Column: 1, RuleID: policyfile.RuleMissingDomainName,
+		Severity: policyfile.SeverityWarning},
+}}
+
+func TestValidationErrorString(t *testing.T) {
+	assert.Equal(t, "app-policies.xml:3:5: error: Rule r has no ServiceName", reportErrors.Errors[0].String())
+	assert.Equal(t, "not-enforced-urls.txt:1:1: warning: not enforced URL https://app-q1.nav.no/login* does not "+
+		"use ${DomainName} [missing-domain-name]", reportErrors.Errors[1].String())
+	assert.Equal(t, "app.xml: error: Unknown file type",
+		ValidationError{ErrorMessage: "Unknown file type", File: "app.xml", Severity: policyfile.SeverityError}.String())
+}
+
+func TestJSONReport(t *testing.T) {
+	report, err := ValidationReport(reportFiles, reportErrors, ReportJSON)
+	assert.NoError(t, err)
+
+	var parsed map[string]interface{}
+	assert.NoError(t, json.Unmarshal(report, &parsed))
+	assert.Equal(t, false, parsed["valid"])
+	assert.Equal(t, float64(1), parsed["errors"])
+	assert.Equal(t, float64(1), parsed["warnings"])
+
+	problem := parsed["problems"].([]interface{})[1].(map[string]interface{})
+	assert.Equal(t, "not-enforced-urls.txt", problem["file"])
+	assert.Equal(t, float64(1), problem["line"])
+	assert.Equal(t, "missing-domain-name", problem["ruleId"])
+	assert.Equal(t, "warning", problem["severity"])
+}
+
+func TestJUnitReport(t *testing.T) {
+	report, err := ValidationReport(reportFiles, reportErrors, ReportJUnit)
+	assert.NoError(t, err)
+
+	var parsed junitTestSuites
+	assert.NoError(t, xml.Unmarshal(report, &parsed))
+	suite := parsed.Suites[0]
+	assert.Equal(t, 2, suite.Tests)
+	assert.Equal(t, 1, suite.Failures)
+	assert.Equal(t, "app-policies.xml:3:5: error: Rule r has no ServiceName", suite.TestCases[0].Failure.Text)
+	assert.Nil(t, suite.TestCases[1].Failure)
+	assert.Contains(t, suite.TestCases[1].SystemOut, "[missing-domain-name]")
+}
+
+func TestSARIFReport(t *testing.T) {
+	report, err := ValidationReport(reportFiles, reportErrors, ReportSARIF)
+	assert.NoError(t, err)
+
+	var parsed sarifLog
+	assert.NoError(t, json.Unmarshal(report, &parsed))
+	assert.Equal(t, "2.1.0", parsed.Version)
+
+	run := parsed.Runs[0]
+	assert.Len(t, run.Tool.Driver.Rules, len(policyfile.LintRules)+1)
+	assert.Equal(t, invalidFileRuleID, run.Results[0].RuleID)
+	assert.Equal(t, "error", run.Results[0].Level)
+	assert.Equal(t, &sarifRegion{3, 5}, run.Results[0].Locations[0].PhysicalLocation.Region)
+	assert.Equal(t, "missing-domain-name", run.Results[1].RuleID)
+	assert.Equal(t, "not-enforced-urls.txt", run.Results[1].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+}
+
+func TestUnknownReportFormat(t *testing.T) {
+	_, err := ValidationReport(reportFiles, reportErrors, "html")
+	assert.EqualError(t, err, "unknown report format html, must be one of text, json, junit or sarif")
+}
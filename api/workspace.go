@@ -0,0 +1,128 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/sftp"
+)
+
+const (
+	workspacePrefix = "named-"
+	// remoteWorkspaceRoot is where workspaces are created on the AM hosts
+	remoteWorkspaceRoot = "/tmp"
+	// staleWorkspaceAge is how old a remote workspace has to be before another request may remove it
+	staleWorkspaceAge = time.Hour
+)
+
+// Workspace is the directory the policy files of a single request are written to, locally and on the AM host. Its
+// name is unique, so concurrent requests for the same application never share files.
+type Workspace struct {
+	Name  string
+	Dir   string
+	Files []string
+}
+
+// newWorkspace creates an empty workspace for the application in the temp directory
+func newWorkspace(application string) (*Workspace, error) {
+	dir, err := ioutil.TempDir("", workspacePrefix+filepath.Base(application)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create workspace: %s", err)
+	}
+
+	return &Workspace{Name: filepath.Base(dir), Dir: dir}, nil
+}
+
+// RemoteDir is the directory of the workspace on the AM host
+func (w *Workspace) RemoteDir() string {
+	return path.Join(remoteWorkspaceRoot, w.Name)
+}
+
+// Remove deletes the local workspace with its files
+func (w *Workspace) Remove() error {
+	if w == nil {
+		return nil
+	}
+
+	if err := os.RemoveAll(w.Dir); err != nil {
+		glog.Errorf("Could not remove workspace %s: %s", w.Dir, err)
+		return fmt.Errorf("could not remove workspace: %s", w.Dir)
+	}
+	return nil
+}
+
+// RemoveRemote deletes the workspace on the AM host with its files
+func (w *Workspace) RemoveRemote(sftpClient *sftp.Client) error {
+	if err := removeRemoteDir(sftpClient, w.RemoteDir()); err != nil {
+		glog.Errorf("Could not remove remote workspace %s: %s", w.RemoteDir(), err)
+		return err
+	}
+	return nil
+}
+
+// SweepWorkspaces removes the local workspaces left behind by an earlier run, which was killed before it could clean
+// up. It is called at startup, before any request is handled.
+func SweepWorkspaces() {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), workspacePrefix+"*"))
+	if err != nil {
+		glog.Errorf("Could not list workspaces: %s", err)
+		return
+	}
+
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		glog.Infof("Removing stale workspace %s", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			glog.Errorf("Could not remove stale workspace %s: %s", dir, err)
+		}
+	}
+}
+
+// sweepRemoteWorkspaces removes workspaces on the AM host older than staleWorkspaceAge. Younger ones may belong to
+// requests still running in another replica.
+func sweepRemoteWorkspaces(sftpClient *sftp.Client) {
+	entries, err := sftpClient.ReadDir(remoteWorkspaceRoot)
+	if err != nil {
+		glog.Errorf("Could not list remote workspaces: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), workspacePrefix) ||
+			time.Since(entry.ModTime()) < staleWorkspaceAge {
+			continue
+		}
+
+		dir := path.Join(remoteWorkspaceRoot, entry.Name())
+		glog.Infof("Removing stale remote workspace %s", dir)
+		if err := removeRemoteDir(sftpClient, dir); err != nil {
+			glog.Errorf("Could not remove stale remote workspace %s: %s", dir, err)
+		}
+	}
+}
+
+func removeRemoteDir(sftpClient *sftp.Client, dir string) error {
+	entries, err := sftpClient.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("could not list remote directory %s: %s", dir, err)
+	}
+
+	for _, entry := range entries {
+		if err := sftpClient.Remove(path.Join(dir, entry.Name())); err != nil {
+			return fmt.Errorf("could not remove remote file %s: %s", path.Join(dir, entry.Name()), err)
+		}
+	}
+
+	if err := sftpClient.Remove(dir); err != nil {
+		return fmt.Errorf("could not remove remote directory %s: %s", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkspacesAreUnique(t *testing.T) {
+	first, err := newWorkspace("testapp")
+	assert.NoError(t, err)
+	second, err := newWorkspace("testapp")
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, first.Dir, second.Dir)
+	assert.Contains(t, first.Name, "named-testapp-")
+	assert.Equal(t, "/tmp/"+first.Name, first.RemoteDir())
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(first.Dir, "app-policies.xml"), []byte("<Policies/>"), 0644))
+	assert.NoError(t, first.Remove())
+	assert.NoError(t, second.Remove())
+
+	_, err = os.Stat(first.Dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestInvalidFilesDoNotLeaveWorkspace(t *testing.T) {
+	before, _ := filepath.Glob(filepath.Join(os.TempDir(), workspacePrefix+"brokenapp-*"))
+
+	_, _, err := GenerateAmFiles(&NamedConfigurationRequest{Application: "brokenapp", PolicyFiles: map[string][]byte{
+		"app-policies.xml": []byte("<Policies>"),
+	}})
+	assert.Error(t, err)
+
+	after, _ := filepath.Glob(filepath.Join(os.TempDir(), workspacePrefix+"brokenapp-*"))
+	assert.Equal(t, len(before), len(after))
+}
+
+func TestSweepWorkspaces(t *testing.T) {
+	workspace, err := newWorkspace("testapp")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(workspace.Dir, "app-policies.xml"), []byte("<Policies/>"), 0644))
+
+	SweepWorkspaces()
+
+	_, err = os.Stat(workspace.Dir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/cookiejar"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/nais/named/api"
@@ -15,8 +17,24 @@ import (
 )
 
 const configureEndpoint = "/configure"
+const jobsEndpoint = "/jobs/"
+const jobPollInterval = 2 * time.Second
+
+// maxJobMisses is how many polls in a row may reach a replica not knowing the job, before it is given up as lost
+const maxJobMisses = 15
 const defaultCluster = "dev-fss"
 
+// errJobNotFound is returned when the replica answering does not know the job
+var errJobNotFound = errors.New("job not found")
+
+// namedClient keeps the affinity cookie of the ingress, so the job is polled from the replica running it
+var namedClient = newNamedClient()
+
+func newNamedClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{Jar: jar}
+}
+
 var clustersDict = map[string]string{
 	"nais-dev":     "nais.devillo.no",
 	"dev-fss":      "nais.preprod.local",
@@ -70,6 +88,7 @@ var configurationCmd = &cobra.Command{
 			"username": &configurationRequest.Username,
 			"password": &configurationRequest.Password,
 			"cluster":  &cluster,
+			"realm":    &configurationRequest.Realm,
 		}
 
 		zone := api.GetZone(cluster)
@@ -92,11 +111,40 @@ var configurationCmd = &cobra.Command{
 			}
 		}
 
+		oauth2, err := oauth2SettingsFromFlags(cmd)
+		if err != nil {
+			fmt.Printf("Error when getting OAuth2 flags: %v\n", err)
+			os.Exit(1)
+		}
+		configurationRequest.OAuth2 = oauth2
+
+		recreate, err := cmd.Flags().GetBool("recreate")
+		if err != nil {
+			fmt.Printf("Error when getting flag: recreate. %v\n", err)
+			os.Exit(1)
+		}
+		configurationRequest.Recreate = recreate
+
 		if err := configurationRequest.Validate(zone); err != nil {
 			fmt.Printf("Configuration request is not valid: %v\n", err)
 			os.Exit(1)
 		}
 
+		policyDir, err := cmd.Flags().GetString("policy-dir")
+		if err != nil {
+			fmt.Printf("Error when getting flag: policy-dir. %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(policyDir) > 0 {
+			policyFiles, err := readPolicyDir(policyDir)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+			configurationRequest.PolicyFiles = policyFiles
+		}
+
 		clusterUrl, err := getClusterUrl(cluster)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
@@ -109,9 +157,20 @@ var configurationCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			fmt.Printf("Error when getting flag: dry-run. %v\n", err)
+			os.Exit(1)
+		}
+
+		endpoint := configureEndpoint
+		if dryRun {
+			endpoint += "?dryRun=true"
+		}
+
 		start := time.Now()
 
-		resp, err := http.Post(clusterUrl+configureEndpoint, "application/json", bytes.NewBuffer(jsonStr))
+		resp, err := namedClient.Post(clusterUrl+endpoint, "application/json", bytes.NewBuffer(jsonStr))
 		if err != nil {
 			fmt.Printf("Error while POSTing to API: %v\n", err)
 			os.Exit(1)
@@ -120,6 +179,23 @@ var configurationCmd = &cobra.Command{
 		defer resp.Body.Close()
 
 		body, _ := ioutil.ReadAll(resp.Body)
+
+		if dryRun {
+			if resp.StatusCode > 299 {
+				fmt.Println("response Status:", resp.Status)
+				fmt.Println("response Body:", string(body))
+				os.Exit(1)
+			}
+
+			var plan bytes.Buffer
+			if err := json.Indent(&plan, body, "", "  "); err != nil {
+				fmt.Println(string(body))
+			} else {
+				fmt.Println(plan.String())
+			}
+			return
+		}
+
 		fmt.Println("response Status:", resp.Status)
 		fmt.Println("response Body:", string(body))
 
@@ -127,11 +203,238 @@ var configurationCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		wait, err := cmd.Flags().GetBool("wait")
+		if err != nil {
+			fmt.Printf("Error when getting flag: wait. %v\n", err)
+			os.Exit(1)
+		}
+
+		if !wait {
+			fmt.Println("Configuration queued")
+			return
+		}
+
+		timeout, err := cmd.Flags().GetDuration("timeout")
+		if err != nil {
+			fmt.Printf("Error when getting flag: timeout. %v\n", err)
+			os.Exit(1)
+		}
+
+		var job api.Job
+		if err := json.Unmarshal(body, &job); err != nil {
+			fmt.Printf("Could not read job from response: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := waitForJob(clusterUrl, job.ID, timeout); err != nil {
+			fmt.Printf("Configuration failed: %v\n", err)
+			os.Exit(1)
+		}
+
 		elapsed := time.Since(start)
 		fmt.Printf("Configuration successful, took %v\n", elapsed)
 	},
 }
 
+// readPolicyDir validates the policy files in the directory like named does, and returns them by file name
+func readPolicyDir(dir string) (map[string][]byte, error) {
+	files, err := api.PolicyFilesInDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	validationErrors := api.ValidatePolicyFiles(files, nil)
+	if len(validationErrors.Errors) > 0 {
+		fmt.Print(validationErrors.Error())
+	}
+	if validationErrors.HasErrors() {
+		return nil, fmt.Errorf("policy files in %s are not valid", dir)
+	}
+
+	policyFiles := map[string][]byte{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read policy file %s: %v", file, err)
+		}
+		policyFiles[filepath.Base(file)] = content
+	}
+	return policyFiles, nil
+}
+
+// oauth2SettingsFromFlags returns the OAuth2 settings given as flags, or nil if none are given
+func oauth2SettingsFromFlags(cmd *cobra.Command) (*api.OAuth2Settings, error) {
+	flags := cmd.Flags()
+	settings := &api.OAuth2Settings{}
+	changed := false
+
+	if flags.Changed("scopes") {
+		scopes, err := flags.GetStringSlice("scopes")
+		if err != nil {
+			return nil, err
+		}
+		settings.Scopes = scopes
+		changed = true
+	}
+
+	if flags.Changed("post-logout-uris") {
+		uris, err := flags.GetStringSlice("post-logout-uris")
+		if err != nil {
+			return nil, err
+		}
+		settings.PostLogoutRedirectUris = uris
+		changed = true
+	}
+
+	strings := map[string]*string{
+		"id-token-alg": &settings.IDTokenSignedResponseAlg,
+		"client-type":  &settings.ClientType,
+	}
+	for key, pointer := range strings {
+		if flags.Changed(key) {
+			value, err := flags.GetString(key)
+			if err != nil {
+				return nil, err
+			}
+			*pointer = value
+			changed = true
+		}
+	}
+
+	ints := map[string]**int{
+		"access-token-lifetime":  &settings.AccessTokenLifetime,
+		"refresh-token-lifetime": &settings.RefreshTokenLifetime,
+	}
+	for key, pointer := range ints {
+		if flags.Changed(key) {
+			value, err := flags.GetInt(key)
+			if err != nil {
+				return nil, err
+			}
+			*pointer = &value
+			changed = true
+		}
+	}
+
+	if flags.Changed("consent-implied") {
+		consentImplied, err := flags.GetBool("consent-implied")
+		if err != nil {
+			return nil, err
+		}
+		settings.ConsentImplied = &consentImplied
+		changed = true
+	}
+
+	if !changed {
+		return nil, nil
+	}
+	return settings, nil
+}
+
+var stageDescriptions = map[string]string{
+	api.StageFasitLookup:    "Fasit lookup",
+	api.StagePolicyDownload: "Policy download",
+	api.StageSftpCopy:       "SFTP copy",
+	api.StageScriptRun:      "Script run",
+	api.StagePolicyImport:   "Policy import",
+	api.StageAgentCreation:  "Agent creation",
+	api.StageFasitUpsert:    "Fasit resource upsert",
+}
+
+// waitForJob polls the job until it has finished, printing each stage as it finishes
+func waitForJob(clusterUrl, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	printed := 0
+	misses := 0
+
+	for {
+		job, err := getJob(clusterUrl, id)
+		if err == errJobNotFound && misses < maxJobMisses && time.Now().Before(deadline) {
+			// another replica answered, or the one running the job was restarted
+			misses++
+			time.Sleep(jobPollInterval)
+			continue
+		}
+		if err == errJobNotFound {
+			return fmt.Errorf("job %s was not found, the replica running it may have been restarted", id)
+		}
+		if err != nil {
+			return err
+		}
+		misses = 0
+
+		for ; printed < len(job.Stages) && job.Stages[printed].Finished != nil; printed++ {
+			stage := job.Stages[printed]
+			description, exists := stageDescriptions[stage.Name]
+			if !exists {
+				description = stage.Name
+			}
+			fmt.Printf("%s %s (%dms)\n", description, stage.Status, stage.DurationMs)
+		}
+
+		switch job.Status {
+		case api.JobSucceeded:
+			if len(job.Message) > 0 {
+				fmt.Println(job.Message)
+			}
+			return nil
+		case api.JobFailed:
+			printScriptResult(job.Script)
+			if job.Error != nil {
+				return job.Error
+			}
+			return errors.New("job failed without an error message")
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("gave up waiting for job %s after %v, it is still %s", id, timeout, job.Status)
+		}
+
+		time.Sleep(jobPollInterval)
+	}
+}
+
+// printScriptResult prints the known failures of the policy script with hints, or else its output
+func printScriptResult(result *api.ScriptResult) {
+	if result == nil || result.ExitStatus == 0 {
+		return
+	}
+
+	if len(result.Failures) == 0 {
+		fmt.Printf("Output of the AM policy script (exit status %d):\n%s%s", result.ExitStatus, result.Stdout,
+			result.Stderr)
+		return
+	}
+
+	for _, failure := range result.Failures {
+		fmt.Printf("AM policy script failed with %s: %s\n  %s\n", failure.Code, failure.Line, failure.Hint)
+	}
+}
+
+func getJob(clusterUrl, id string) (*api.Job, error) {
+	resp, err := namedClient.Get(clusterUrl + jobsEndpoint + id)
+	if err != nil {
+		return nil, fmt.Errorf("could not get job status: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errJobNotFound
+	}
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("could not get job status: %s %s", resp.Status, string(body))
+	}
+
+	job := &api.Job{}
+	if err := json.Unmarshal(body, job); err != nil {
+		return nil, fmt.Errorf("could not read job status: %v", err)
+	}
+
+	return job, nil
+}
+
 func init() {
 	RootCmd.AddCommand(configurationCmd)
 	configurationCmd.Flags().StringP("app", "a", "", "name of your app")
@@ -141,5 +444,17 @@ func init() {
 	configurationCmd.Flags().StringP("contexts", "r", "", "the context roots to configure in ISSO")
 	configurationCmd.Flags().StringP("username", "u", "", "the username")
 	configurationCmd.Flags().StringP("password", "p", "", "the password")
+	configurationCmd.Flags().String("realm", "", "the AM realm of your app, if not the one set in Fasit")
+	configurationCmd.Flags().String("policy-dir", "", "directory with SBS policy files to upload instead of the raw repository ones")
 	configurationCmd.Flags().Bool("wait", false, "whether to wait until the deploy has succeeded (or failed)")
+	configurationCmd.Flags().StringSlice("scopes", []string{"openid"}, "OAuth2 scopes of the ISSO agent")
+	configurationCmd.Flags().String("id-token-alg", api.DefaultIDTokenSignedResponseAlg, "algorithm used to sign ID tokens")
+	configurationCmd.Flags().StringSlice("post-logout-uris", []string{}, "post logout redirection URIs of the ISSO agent, empty to clear them")
+	configurationCmd.Flags().Int("access-token-lifetime", 0, "access token lifetime in seconds, 0 for the AM default (kept if not set)")
+	configurationCmd.Flags().Int("refresh-token-lifetime", 0, "refresh token lifetime in seconds, 0 for the AM default (kept if not set)")
+	configurationCmd.Flags().String("client-type", api.DefaultClientType, "OAuth2 client type, Confidential or Public")
+	configurationCmd.Flags().Bool("consent-implied", true, "whether the user's consent is implied")
+	configurationCmd.Flags().Bool("recreate", false, "delete and re-create the ISSO agent instead of updating it")
+	configurationCmd.Flags().Bool("dry-run", false, "show what would be configured without changing anything")
+	configurationCmd.Flags().Duration("timeout", 10*time.Minute, "how long to wait for the configuration when using --wait")
 }
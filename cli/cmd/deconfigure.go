@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/nais/named/api"
+	"github.com/spf13/cobra"
+)
+
+var deconfigurationCmd = &cobra.Command{
+	Use:   "deconfigure",
+	Short: "Removes the AM configuration of your application",
+	Long:  `Removes the ISSO agent and OpenIdConnect Fasit resource (FSS) or the AM policies (SBS) of your application`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var application, environment, cluster, realm string
+		username := os.Getenv("NAIS_USERNAME")
+		password := os.Getenv("NAIS_PASSWORD")
+
+		strings := map[string]*string{
+			"app":      &application,
+			"env":      &environment,
+			"username": &username,
+			"password": &password,
+			"cluster":  &cluster,
+			"realm":    &realm,
+		}
+
+		for key, pointer := range strings {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		for key, value := range map[string]string{"app": application, "env": environment, "username": username, "password": password} {
+			if len(value) == 0 {
+				fmt.Printf("%s is required but empty\n", key)
+				os.Exit(1)
+			}
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		req, err := http.NewRequest("DELETE", clusterUrl+configureEndpoint+"/"+application+"/"+environment+realmQuery(realm), nil)
+		if err != nil {
+			fmt.Printf("Error while creating request: %v\n", err)
+			os.Exit(1)
+		}
+		req.SetBasicAuth(username, password)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("Error while calling API: %v\n", err)
+			os.Exit(1)
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		var result api.DeconfigurationResult
+		if err := json.Unmarshal(body, &result); err != nil {
+			fmt.Println("response Status:", resp.Status)
+			fmt.Println("response Body:", string(body))
+			os.Exit(1)
+		}
+
+		if len(result.Removed) == 0 {
+			fmt.Println("Nothing was removed")
+		}
+		for _, removed := range result.Removed {
+			fmt.Printf("Removed %s %s\n", removed.Kind, removed.Name)
+		}
+
+		if result.Error != nil {
+			fmt.Printf("Deconfiguration failed: %v\n", result.Error)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(deconfigurationCmd)
+	deconfigurationCmd.Flags().StringP("app", "a", "", "name of your app")
+	deconfigurationCmd.Flags().StringP("cluster", "c", "", "the cluster your app is configured in")
+	deconfigurationCmd.Flags().StringP("env", "e", "", "environment you want to remove the configuration from")
+	deconfigurationCmd.Flags().StringP("username", "u", "", "the username")
+	deconfigurationCmd.Flags().StringP("password", "p", "", "the password")
+	deconfigurationCmd.Flags().String("realm", "", "the AM realm of your app, if not the one set in Fasit")
+}
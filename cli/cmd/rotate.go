@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/nais/named/api"
+	"github.com/spf13/cobra"
+)
+
+const rotateEndpoint = "/rotate"
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotates the ISSO agent secret of your application",
+	Long: `Generates a new secret for the ISSO agent of your application, and stores it in the OpenIdConnect Fasit resource.
+With --strategy overlap the new secret is first stored as nextPassword next to the current one, and set on the agent
+when rotate is run again`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var application, environment, cluster, realm, strategy string
+		username := os.Getenv("NAIS_USERNAME")
+		password := os.Getenv("NAIS_PASSWORD")
+
+		strings := map[string]*string{
+			"app":      &application,
+			"env":      &environment,
+			"username": &username,
+			"password": &password,
+			"cluster":  &cluster,
+			"realm":    &realm,
+			"strategy": &strategy,
+		}
+
+		for key, pointer := range strings {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		for key, value := range map[string]string{"app": application, "env": environment, "username": username, "password": password} {
+			if len(value) == 0 {
+				fmt.Printf("%s is required but empty\n", key)
+				os.Exit(1)
+			}
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		query := url.Values{}
+		query.Set("strategy", strategy)
+		if len(realm) > 0 {
+			query.Set("realm", realm)
+		}
+
+		req, err := http.NewRequest("POST", clusterUrl+rotateEndpoint+"/"+application+"/"+environment+"?"+query.Encode(), nil)
+		if err != nil {
+			fmt.Printf("Error while creating request: %v\n", err)
+			os.Exit(1)
+		}
+		req.SetBasicAuth(username, password)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("Error while calling API: %v\n", err)
+			os.Exit(1)
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		var result api.RotationResult
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &result) != nil {
+			fmt.Println("response Status:", resp.Status)
+			fmt.Println("response Body:", string(body))
+			os.Exit(1)
+		}
+
+		if result.Stage == api.RotationStaged {
+			fmt.Printf("Stored the next secret of agent %s, redeploy the application and run rotate again to switch to it\n",
+				result.Agent)
+			return
+		}
+		fmt.Printf("Rotated secret of agent %s, redeploy the application to use the new secret\n", result.Agent)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rotateCmd)
+	rotateCmd.Flags().StringP("app", "a", "", "name of your app")
+	rotateCmd.Flags().StringP("cluster", "c", "", "the cluster your app is configured in")
+	rotateCmd.Flags().StringP("env", "e", "", "environment of the agent")
+	rotateCmd.Flags().StringP("username", "u", "", "the username")
+	rotateCmd.Flags().StringP("password", "p", "", "the password")
+	rotateCmd.Flags().String("realm", "", "the AM realm of your app, if not the one set in Fasit")
+	rotateCmd.Flags().String("strategy", api.RotateImmediate, "immediate, or overlap to store the new secret before switching to it")
+}
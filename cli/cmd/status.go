@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nais/named/api"
+	"github.com/spf13/cobra"
+)
+
+const statusEndpoint = "/status"
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the current AM configuration of your application",
+	Long:  `Shows the ISSO agent and OpenIdConnect Fasit resource (FSS) or the AM policies (SBS) of your application`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var application, environment, cluster, realm string
+		username := os.Getenv("NAIS_USERNAME")
+		password := os.Getenv("NAIS_PASSWORD")
+
+		flags := map[string]*string{
+			"app":      &application,
+			"env":      &environment,
+			"username": &username,
+			"password": &password,
+			"cluster":  &cluster,
+			"realm":    &realm,
+		}
+
+		for key, pointer := range flags {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		for key, value := range map[string]string{"app": application, "env": environment, "username": username, "password": password} {
+			if len(value) == 0 {
+				fmt.Printf("%s is required but empty\n", key)
+				os.Exit(1)
+			}
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		req, err := http.NewRequest("GET", clusterUrl+statusEndpoint+"/"+application+"/"+environment+realmQuery(realm), nil)
+		if err != nil {
+			fmt.Printf("Error while creating request: %v\n", err)
+			os.Exit(1)
+		}
+		req.SetBasicAuth(username, password)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("Error while calling API: %v\n", err)
+			os.Exit(1)
+		}
+
+		defer resp.Body.Close()
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode > 299 {
+			fmt.Println("response Status:", resp.Status)
+			fmt.Println("response Body:", string(body))
+			os.Exit(1)
+		}
+
+		var status api.ConfigurationStatus
+		if err := json.Unmarshal(body, &status); err != nil {
+			fmt.Printf("Could not read status from response: %v\n", err)
+			os.Exit(1)
+		}
+
+		printStatus(status)
+	},
+}
+
+func printStatus(status api.ConfigurationStatus) {
+	fmt.Printf("%s in %s (%s)\n", status.Application, status.Environment, status.Zone)
+
+	if status.Agent != nil {
+		if status.Agent.Exists {
+			fmt.Printf("Agent %s exists\nRedirection URIs:\n\t%s\n", status.Agent.Name,
+				strings.Join(status.Agent.RedirectionUris, "\n\t"))
+		} else {
+			fmt.Printf("Agent %s does not exist\n", status.Agent.Name)
+		}
+	}
+
+	if status.FasitResource != nil {
+		if status.FasitResource.Exists {
+			fmt.Printf("Fasit resource %s (%d) exists\n", status.FasitResource.Alias, status.FasitResource.ID)
+			for key, value := range status.FasitResource.Properties {
+				fmt.Printf("\t%s: %s\n", key, value)
+			}
+			for _, secret := range status.FasitResource.Secrets {
+				fmt.Printf("\t%s: (secret)\n", secret)
+			}
+		} else {
+			fmt.Printf("Fasit resource %s does not exist\n", status.FasitResource.Alias)
+		}
+	}
+
+	if status.Zone == api.ZoneSbs {
+		fmt.Printf("%d AM policies belong to the application\n", len(status.Policies))
+		for _, policy := range status.Policies {
+			fmt.Printf("\t%s (active: %t)\n", policy.Name, policy.Active)
+		}
+	}
+}
+
+// realmQuery returns the query string selecting the AM realm, or nothing for the realm set in Fasit
+func realmQuery(realm string) string {
+	if len(realm) == 0 {
+		return ""
+	}
+	return "?" + url.Values{"realm": {realm}}.Encode()
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringP("app", "a", "", "name of your app")
+	statusCmd.Flags().StringP("cluster", "c", "", "the cluster your app is configured in")
+	statusCmd.Flags().StringP("env", "e", "", "environment you want the status for")
+	statusCmd.Flags().StringP("username", "u", "", "the username")
+	statusCmd.Flags().StringP("password", "p", "", "the password")
+	statusCmd.Flags().String("realm", "", "the AM realm of your app, if not the one set in Fasit")
+}
@@ -3,9 +3,11 @@ package cmd
 import (
 	"fmt"
 	"github.com/nais/named/api"
+	"github.com/nais/named/api/policyfile"
 	"github.com/spf13/cobra"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 var validateSbsCmd = &cobra.Command{
@@ -20,23 +22,106 @@ var validateSbsCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		output, err := ioutil.ReadFile(file)
+		dir, err := cmd.Flags().GetString("dir")
 		if err != nil {
-			fmt.Printf("Could not read file: %s. %v", file, err)
-			fmt.Printf("File contents: %s", output)
+			fmt.Printf("Error when getting flag: dir. %v", err)
+			os.Exit(1)
+		}
+
+		environment, err := cmd.Flags().GetString("env")
+		if err != nil {
+			fmt.Printf("Error when getting flag: env. %v", err)
+			os.Exit(1)
+		}
+
+		files := []string{file}
+		if len(dir) > 0 {
+			files, err = api.PolicyFilesInDir(dir)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		for _, file := range files {
+			if _, err := ioutil.ReadFile(file); err != nil {
+				fmt.Printf("Could not read file: %s. %v", file, err)
+				os.Exit(1)
+			}
+		}
+
+		disabled, err := cmd.Flags().GetStringSlice("disable")
+		if err != nil {
+			fmt.Printf("Error when getting flag: disable. %v", err)
+			os.Exit(1)
+		}
+
+		for _, id := range disabled {
+			if _, ok := policyfile.FindLintRule(id); !ok {
+				fmt.Printf("Unknown lint rule: %s\n", id)
+				os.Exit(1)
+			}
+		}
+
+		format, err := cmd.Flags().GetString("output")
+		if err != nil {
+			fmt.Printf("Error when getting flag: output. %v", err)
 			os.Exit(1)
 		}
 
-		validationErrors := api.ValidatePolicyFiles([]string{file})
-		if len(validationErrors.Errors) != 0 {
-			fmt.Println("Found errors while validating policy files")
-			fmt.Printf("%v", validationErrors)
+		var validationErrors api.ValidationErrors
+		if len(environment) > 0 {
+			validationErrors, err = api.ValidateRenderedPolicyFiles(files, environment, disabled)
+			if err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			validationErrors = api.ValidatePolicyFiles(files, disabled)
+		}
+
+		if format == api.ReportText {
+			if len(validationErrors.Errors) != 0 {
+				fmt.Println("Found problems while validating policy files")
+				fmt.Print(validationErrors.Error())
+			}
+			if len(environment) > 0 {
+				printRendered(files, environment)
+			}
+		} else {
+			report, err := api.ValidationReport(files, validationErrors, format)
+			if err != nil {
+				fmt.Printf("Could not create report. %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Println(string(report))
+		}
+
+		if validationErrors.HasErrors() {
 			os.Exit(1)
 		}
 	},
 }
 
+// printRendered prints the files as named ships them to AM for the environment
+func printRendered(files []string, environment string) {
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Could not read file: %s. %v", file, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("\n--- %s for %s ---\n", file, environment)
+		fmt.Println(strings.TrimRight(string(api.RenderPolicyFile(content, environment)), "\n"))
+	}
+}
+
 func init() {
 	RootCmd.AddCommand(validateSbsCmd)
 	validateSbsCmd.Flags().StringP("file", "f", "app-policies.xml", "path to file")
+	validateSbsCmd.Flags().StringP("dir", "d", "", "directory with the policy files, instead of --file")
+	validateSbsCmd.Flags().StringP("env", "e", "", "validate the files as they are shipped to this environment, and print them with text output")
+	validateSbsCmd.Flags().StringSlice("disable", []string{}, "lint rules to skip, like hardcoded-host,inactive-policy")
+	validateSbsCmd.Flags().StringP("output", "o", api.ReportText, "output format: text, json, junit or sarif")
 }
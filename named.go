@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/golang/glog"
 	"github.com/nais/named/api"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const port string = ":8081"
@@ -12,14 +17,98 @@ const port string = ":8081"
 func main() {
 	fasitURL := flag.String("fasitUrl", "https://fasit.example.no", "URL to fasit instance")
 	clusterName := flag.String("clusterName", "dev-fss", "NAIS cluster name")
+	workers := flag.Int("workers", 4, "number of configuration jobs running concurrently")
+	jobQueueSize := flag.Int("jobQueueSize", 32, "number of configuration jobs allowed to wait for a worker")
+	jobHistory := flag.Int("jobHistory", 256, "number of configuration jobs kept for status lookups")
+	drainTimeout := flag.Duration("drainTimeout", 5*time.Minute,
+		"how long queued and running configuration jobs may take to finish when shutting down")
+	amSessionIdle := flag.Duration("amSessionIdle", 10*time.Minute, "how long an unused AM admin session is kept")
+	sbsPolicyImport := flag.String("sbsPolicyImport", api.PolicyImportSSH, "how SBS policies are imported, ssh or rest")
+	policySource := flag.String("policySource", api.PolicySourceHTTP, "where policy files are fetched from, http, oci or dir")
+	policyLocation := flag.String("policyLocation", api.DefaultPolicyURLTemplate,
+		"URL template for http, repository for oci, or directory for dir")
+	policyRequireDigest := flag.Bool("policyRequireDigest", true,
+		"reject policy files downloaded over http without a .sha256 or .sha1 file next to them")
+	lockMode := flag.String("lockMode", api.LockQueue,
+		"what happens to a request for an application and environment being configured, queue or reject")
+	lockBackend := flag.String("lockBackend", api.LockBackendMemory,
+		"where locks are kept, memory for a single replica or lease for Kubernetes leases shared by all replicas")
+	lockNamespace := flag.String("lockNamespace", "", "namespace of the leases, by default the one named runs in")
+	sshKnownHosts := flag.String("sshKnownHosts", "", "known_hosts file verifying AM hosts without a hostKey in Fasit")
+	sshPrivateKey := flag.String("sshPrivateKey", "", "private key tried before the password of the AM host")
+	sshAgent := flag.Bool("sshAgent", false, "try the keys of the SSH agent at SSH_AUTH_SOCK before the password")
+	sshInsecure := flag.Bool("sshInsecureIgnoreHostKey", false, "accept any AM host key, never use this in production")
+	sshDialTimeout := flag.Duration("sshDialTimeout", 10*time.Second, "how long connecting to an AM host may take")
+	sshHandshakeTimeout := flag.Duration("sshHandshakeTimeout", 10*time.Second,
+		"how long the SSH handshake with an AM host may take")
 	flag.Parse()
 
-	api := api.NewAPI(*fasitURL, *clusterName)
+	if *sbsPolicyImport != api.PolicyImportSSH && *sbsPolicyImport != api.PolicyImportREST {
+		glog.Fatalf("sbsPolicyImport has to be %s or %s, not %s", api.PolicyImportSSH, api.PolicyImportREST,
+			*sbsPolicyImport)
+	}
 
-	glog.Infof("Named running on port %s using fasit instance %s", port, *fasitURL)
+	source, err := api.NewPolicySource(*policySource, *policyLocation, api.PolicySourceAuth{
+		Username:    os.Getenv("POLICY_SOURCE_USERNAME"),
+		Password:    os.Getenv("POLICY_SOURCE_PASSWORD"),
+		BearerToken: os.Getenv("POLICY_SOURCE_TOKEN"),
+	}, *policyRequireDigest)
+	if err != nil {
+		glog.Fatalf("Invalid policy source: %s", err)
+	}
+	api.SetPolicySource(source)
 
-	err := http.ListenAndServe(port, api.MakeHandler())
+	if *lockMode != api.LockQueue && *lockMode != api.LockReject {
+		glog.Fatalf("lockMode has to be %s or %s, not %s", api.LockQueue, api.LockReject, *lockMode)
+	}
+	locker, err := api.NewLocker(*lockBackend, *lockNamespace)
 	if err != nil {
+		glog.Fatalf("Invalid lock backend: %s", err)
+	}
+	glog.Infof("Locking configurations in %s, %s requests for the same application and environment", locker,
+		*lockMode)
+	api.SetConfigurationLock(locker, *lockMode)
+
+	if *sshInsecure {
+		glog.Warning("Accepting any SSH host key of the AM hosts")
+	}
+	api.SetSSHSettings(api.SSHSettings{
+		KnownHostsFile:        *sshKnownHosts,
+		PrivateKeyFile:        *sshPrivateKey,
+		UseAgent:              *sshAgent,
+		InsecureIgnoreHostKey: *sshInsecure,
+		DialTimeout:           *sshDialTimeout,
+		HandshakeTimeout:      *sshHandshakeTimeout,
+	})
+
+	api.SweepWorkspaces()
+
+	api.StartAMSessions(*amSessionIdle)
+	jobs := api.NewJobPool(*workers, *jobQueueSize, *jobHistory)
+	api := api.NewAPI(*fasitURL, *clusterName, jobs, *sbsPolicyImport)
+
+	glog.Infof("Named running on port %s using fasit instance %s", port, *fasitURL)
+
+	server := &http.Server{Addr: port, Handler: api.MakeHandler()}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		// jobs are drained before the server is shut down, so their status can still be polled
+		glog.Infof("Shutting down, waiting up to %v for configuration jobs to finish", *drainTimeout)
+		if !jobs.Drain(*drainTimeout) {
+			glog.Warning("Configuration jobs were still running when the drain timeout expired")
+		}
+		server.Shutdown(context.Background())
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
+
+	glog.Info("Logging out of AM sessions")
+	api.Close()
 }